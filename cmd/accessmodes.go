@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"sort"
+	"strings"
+)
+
+// allAccessModes is every access mode a PV can have
+var allAccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce, corev1.ReadOnlyMany, corev1.ReadWriteMany, corev1.ReadWriteOncePod}
+
+// defaultAccessModes are the access modes each backend supports unless --access-mode-matrix says otherwise.
+// Directories, loop mounts and overlays can be shared by any number of pods on their node and nfs and remote
+// volumes across nodes, so those take every mode. tmpfs volumes are scratch space of a single consumer and
+// only take ReadWriteOnce and ReadWriteOncePod.
+var defaultAccessModes = map[string][]corev1.PersistentVolumeAccessMode{
+	tmpfsBackendName: {corev1.ReadWriteOnce, corev1.ReadWriteOncePod},
+}
+
+// accessModeAbbreviations are the short names kubectl shows, also accepted by --access-mode-matrix
+var accessModeAbbreviations = map[string]corev1.PersistentVolumeAccessMode{
+	"RWO":  corev1.ReadWriteOnce,
+	"ROX":  corev1.ReadOnlyMany,
+	"RWX":  corev1.ReadWriteMany,
+	"RWOP": corev1.ReadWriteOncePod,
+}
+
+// accessModeMatrixFlag parses backend=Mode|Mode,backend=Mode into the access modes allowed per backend, e.g.
+// tmpfs=RWO|RWOP,nfs=RWX|ROX. Backends without an entry keep their defaultAccessModes.
+type accessModeMatrixFlag map[string][]corev1.PersistentVolumeAccessMode
+
+func (f *accessModeMatrixFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for backend, modes := range *f {
+		names := make([]string, len(modes))
+		for i, mode := range modes {
+			names[i] = string(mode)
+		}
+		pairs = append(pairs, backend+"="+strings.Join(names, "|"))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *accessModeMatrixFlag) Set(value string) error {
+	matrix := map[string][]corev1.PersistentVolumeAccessMode{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		backend, list, found := strings.Cut(pair, "=")
+		if !found || list == "" {
+			return fmt.Errorf("entry %q is not in backend=Mode|Mode form", pair)
+		}
+		var modes []corev1.PersistentVolumeAccessMode
+		for _, name := range strings.Split(list, "|") {
+			mode, err := parseAccessMode(strings.TrimSpace(name))
+			if err != nil {
+				return fmt.Errorf("backend %s: %v", backend, err)
+			}
+			modes = append(modes, mode)
+		}
+		matrix[backend] = modes
+	}
+	*f = matrix
+	return nil
+}
+
+// parseAccessMode takes an access mode by its full or abbreviated name
+func parseAccessMode(name string) (corev1.PersistentVolumeAccessMode, error) {
+	if mode, ok := accessModeAbbreviations[strings.ToUpper(name)]; ok {
+		return mode, nil
+	}
+	for _, mode := range allAccessModes {
+		if string(mode) == name {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown access mode %q", name)
+}
+
+// supportedAccessModes returns the access modes the named backend takes, from the matrix or the defaults
+func supportedAccessModes(backend string, matrix accessModeMatrixFlag) []corev1.PersistentVolumeAccessMode {
+	if modes, ok := matrix[backend]; ok {
+		return modes
+	}
+	if modes, ok := defaultAccessModes[backend]; ok {
+		return modes
+	}
+	return allAccessModes
+}
+
+// checkBackendAccessModes refuses access modes the backend doesn't support, naming the ones it does
+func checkBackendAccessModes(backend string, modes []corev1.PersistentVolumeAccessMode, matrix accessModeMatrixFlag) error {
+	supported := supportedAccessModes(backend, matrix)
+	for _, mode := range modes {
+		if !hasAccessModes(supported, []corev1.PersistentVolumeAccessMode{mode}) {
+			names := make([]string, len(supported))
+			for i, s := range supported {
+				names[i] = string(s)
+			}
+			return fmt.Errorf("access mode %s is not supported by backend %s, it supports %s", mode, backend, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// normalizeAccessModes dedupes the access modes of a PVC and resolves combinations that make no sense together.
+// ReadWriteOncePod can't be combined with any other mode, non-strict mode narrows such a list down to it.
+// With strict set duplicates and conflicts are rejected instead of being fixed up.
+func normalizeAccessModes(pvc *corev1.PersistentVolumeClaim, strict bool) ([]corev1.PersistentVolumeAccessMode, error) {
+	seen := map[corev1.PersistentVolumeAccessMode]bool{}
+	modes := []corev1.PersistentVolumeAccessMode{}
+	for _, mode := range pvc.Spec.AccessModes {
+		switch mode {
+		case corev1.ReadWriteOnce, corev1.ReadOnlyMany, corev1.ReadWriteMany, corev1.ReadWriteOncePod:
+		default:
+			return nil, fmt.Errorf("unknown access mode %q", mode)
+		}
+		if seen[mode] {
+			if strict {
+				return nil, fmt.Errorf("access mode %s is listed more than once", mode)
+			}
+			klog.Infof("Dropping duplicate access mode %s of PVC %s/%s", mode, pvc.Namespace, pvc.Name)
+			continue
+		}
+		seen[mode] = true
+		modes = append(modes, mode)
+	}
+
+	if seen[corev1.ReadWriteOncePod] && len(modes) > 1 {
+		if strict {
+			return nil, fmt.Errorf("access mode %s can't be combined with other access modes", corev1.ReadWriteOncePod)
+		}
+		klog.Infof("PVC %s/%s combines %s with other access modes, using only %s", pvc.Namespace, pvc.Name, corev1.ReadWriteOncePod, corev1.ReadWriteOncePod)
+		modes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOncePod}
+	}
+	return modes, nil
+}
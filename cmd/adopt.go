@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// externalMarkerFileName marks a directory an operator pre-created for a PVC, e.g. a static volume joining a
+	// dynamic class. Its content doesn't matter, it is never written by the provisioner.
+	externalMarkerFileName = ".custom-provisioner-external"
+	// annExternal on a PV says its directory was adopted rather than created, Delete leaves it in place
+	annExternal = "custom-provisioner/externally-managed"
+)
+
+// checkExternal reports whether the existing directory at volumePath carries the external marker and can be
+// adopted as is. A marked directory is refused without --allow-adoption, resuming it like a leftover of ours would
+// write our marker into it. Only plain hostpath directories can be adopted, the other backends need a mount or file
+// of their own behind the path.
+func (p *customProvisioner) checkExternal(ctx context.Context, volumePath string, backend VolumeBackend) (bool, error) {
+	marker := filepath.Join(volumePath, externalMarkerFileName)
+	err := p.fsOp(ctx, "stat external marker", marker, func() error {
+		_, err := os.Stat(marker)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !p.config.allowAdoption {
+		return false, fmt.Errorf("directory %s is marked externally managed by %s, set --allow-adoption to adopt it", volumePath, externalMarkerFileName)
+	}
+	if backend.Name() != hostPathBackendName {
+		return false, fmt.Errorf("externally managed directory %s can only be adopted with the %s backend, not %s", volumePath, hostPathBackendName, backend.Name())
+	}
+	return true, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runAgent implements "custom-provisioner agent": a small HTTPS server run on every storage node that creates and
+// deletes volume directories under its base path on behalf of a centralized provisioner using the remote backend
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	address := fs.String("listen-address", fmt.Sprintf(":%d", defaultRemoteAgentPort), "Address to serve the agent API on")
+	basePath := fs.String("base-path", "/tmp/dynamic-volumes", "Directory under which volume directories are created on this node")
+	tokenFile := fs.String("token-file", "", "File holding the bearer token the provisioner must send, required")
+	certFile := fs.String("tls-cert-file", "", "TLS certificate to serve with, required")
+	keyFile := fs.String("tls-key-file", "", "TLS private key to serve with, required")
+	minFreeInodes := fs.Uint64("min-free-inodes", 0, "Reject volumes when fewer inodes than this are free on the base path, 0 disables the check")
+	fs.Parse(args)
+
+	// The agent deletes data on request, so never run it without authentication or encryption
+	if *tokenFile == "" || *certFile == "" || *keyFile == "" {
+		klog.Fatalf("--token-file, --tls-cert-file and --tls-key-file are required")
+	}
+	data, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		klog.Fatalf("Failed to read token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		klog.Fatalf("Token file %s is empty", *tokenFile)
+	}
+	if err := checkBasePathWritable(*basePath); err != nil {
+		klog.Fatalf("Base path self-test failed: %v", err)
+	}
+
+	realBasePath, err := filepath.EvalSymlinks(*basePath)
+	if err != nil {
+		klog.Fatalf("Failed to resolve base path %s: %v", *basePath, err)
+	}
+	a := &agent{basePath: filepath.Clean(*basePath), realBasePath: realBasePath, minFreeInodes: *minFreeInodes, backend: &hostPathBackend{}}
+	mux := http.NewServeMux()
+	mux.Handle("/volumes", requireToken(token, http.HandlerFunc(a.handleVolumes)))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	klog.Infof("Starting storage agent on %s for base path %s", *address, a.basePath)
+	if err := http.ListenAndServeTLS(*address, *certFile, *keyFile, mux); err != nil {
+		klog.Fatalf("Agent server failed: %v", err)
+	}
+}
+
+type agent struct {
+	basePath string
+	// realBasePath is basePath with symlinks resolved, for the containment check of deletes
+	realBasePath  string
+	minFreeInodes uint64
+	backend       VolumeBackend
+	locks         pathLocks
+}
+
+func (a *agent) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		a.createVolume(w, r)
+	case http.MethodDelete:
+		a.deleteVolume(w, r)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *agent) createVolume(w http.ResponseWriter, r *http.Request) {
+	var req agentVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Names come from the provisioner, but a name must never point outside the base path
+	if req.Name == "" || strings.ContainsRune(req.Name, os.PathSeparator) || strings.HasPrefix(req.Name, ".") {
+		http.Error(w, fmt.Sprintf("invalid volume name %q", req.Name), http.StatusBadRequest)
+		return
+	}
+	if req.Mode == 0 || req.Mode > 0777 {
+		req.Mode = defaultDirMode
+	}
+
+	volumePath := filepath.Join(a.basePath, req.Name)
+	unlock := a.locks.lock(volumePath)
+	defer unlock()
+
+	// A retried create for the same name reuses the directory, the provisioner serializes work per PVC
+	if _, err := os.Stat(volumePath); err == nil {
+		klog.Infof("Volume %s already exists at %s, reusing it", req.Name, volumePath)
+		writeJSON(w, agentVolumeResponse{Path: volumePath})
+		return
+	}
+
+	if err := checkCapacity(a.basePath, req.SizeBytes, a.minFreeInodes); err != nil {
+		if ce, ok := err.(*capacityCheckFailed); ok {
+			capacityCheckFailures.WithLabelValues(ce.reason).Inc()
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.backend.Create(r.Context(), volumePath, req.SizeBytes, req.Mode); err != nil {
+		klog.Errorf("Failed to create volume %s: %v", req.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	klog.Infof("Created volume %s at %s", req.Name, volumePath)
+	writeJSON(w, agentVolumeResponse{Path: volumePath})
+}
+
+func (a *agent) deleteVolume(w http.ResponseWriter, r *http.Request) {
+	// Only direct children of the base path may be deleted, whatever the PV claims
+	volumePath := filepath.Clean(r.URL.Query().Get("path"))
+	if !volumeUnderBase(volumePath, a.basePath, a.realBasePath) || strings.HasPrefix(filepath.Base(volumePath), ".") {
+		http.Error(w, fmt.Sprintf("path %q is not a volume under %s", volumePath, a.basePath), http.StatusBadRequest)
+		return
+	}
+
+	unlock := a.locks.lock(volumePath)
+	defer unlock()
+
+	if err := a.backend.Delete(context.Background(), volumePath); err != nil {
+		klog.Errorf("Failed to delete volume at %s: %v", volumePath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	klog.Infof("Deleted volume at %s", volumePath)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// annArchive marks a PV whose data is archived on delete instead of removed, see the archiveOnDelete parameter
+	annArchive = "custom-provisioner/archive-on-delete"
+	// archiveDirName holds the archives under each base path, named <pv>-<time> or <pv>-<time>.tar.gz
+	archiveDirName    = ".archive"
+	archiveTimeFormat = "20060102T150405Z"
+	archiveSuffix     = ".tar.gz"
+	// partialSuffix marks a compressed archive still being written, the pruner ages it out like any other
+	partialSuffix = ".partial"
+)
+
+// Values of --archive-full
+const (
+	archiveFullBlock  = "block"
+	archiveFullDelete = "delete"
+)
+
+// archiveTime returns when the archive was made from the timestamp in its name
+func archiveTime(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, partialSuffix), archiveSuffix)
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(archiveTimeFormat, name[i+1:])
+	return t, err == nil
+}
+
+// archiveVolume moves the volume's data into the archive directory of its base path, so a rename never crosses
+// disks, and returns the archive's path. Without --archive-compress backends whose volumes survive a rename are
+// just moved over, everything else is written to a .tar.gz and then torn down by the backend.
+func (p *customProvisioner) archiveVolume(ctx context.Context, backend VolumeBackend, basePath, pvName, volumePath string) (string, error) {
+	root := filepath.Join(basePath, archiveDirName)
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	dest := filepath.Join(root, pvName+"-"+time.Now().UTC().Format(archiveTimeFormat))
+
+	if !p.config.archiveCompress && stagingSupported(backend) {
+		if err := os.Rename(volumePath, dest); err != nil {
+			return "", fmt.Errorf("failed to move %s to the archive: %v", volumePath, err)
+		}
+		return dest, nil
+	}
+
+	dest += archiveSuffix
+	if err := writeTarGz(volumePath, dest+partialSuffix); err != nil {
+		os.Remove(dest + partialSuffix)
+		return "", err
+	}
+	if err := os.Rename(dest+partialSuffix, dest); err != nil {
+		return "", err
+	}
+	if err := backend.Delete(ctx, volumePath); err != nil {
+		return dest, fmt.Errorf("archived to %s but failed to remove the volume: %v", dest, err)
+	}
+	return dest, nil
+}
+
+// writeTarGz writes the tree under src to dest as a gzipped tar, synced before it returns
+func writeTarGz(src, dest string) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create archive %s: %v", dest, err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", src, err)
+	}
+	return nil
+}
+
+// archiveEntry is one archive found by the pruner
+type archiveEntry struct {
+	path string
+	made time.Time
+	size int64
+	dir  bool
+}
+
+// pruneArchives deletes archives older than --archive-retention, then the oldest ones until the rest of each
+// base path's archives fit in --archive-max-size. Archives whose name carries no timestamp are left alone.
+func (p *customProvisioner) pruneArchives(ctx context.Context) error {
+	release, err := p.scans.acquire(ctx, "archive pruning")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var pruneErr error
+	for _, basePath := range p.config.basePaths() {
+		if err := p.pruneArchivesOf(ctx, basePath); err != nil && pruneErr == nil {
+			pruneErr = err
+		}
+	}
+	return pruneErr
+}
+
+// pruneArchivesOf prunes the archives of one base path
+func (p *customProvisioner) pruneArchivesOf(ctx context.Context, basePath string) error {
+	archives, total, err := p.listArchives(ctx, basePath)
+	if err != nil {
+		return err
+	}
+	var limit int64 = -1
+	if q := p.config.archiveMaxSize.Quantity; q != nil {
+		limit = q.Value()
+	}
+	for _, a := range archives {
+		age := time.Since(a.made)
+		expired := p.config.archiveRetention > 0 && age > p.config.archiveRetention
+		if !expired && (limit < 0 || total <= limit) {
+			// Oldest first, so everything after this one is newer and fits too
+			break
+		}
+		if err := p.deleteArchive(ctx, a); err != nil {
+			klog.Errorf("Failed to prune archive %s: %v", a.path, err)
+			continue
+		}
+		total -= a.size
+		if expired {
+			klog.Infof("Pruned archive %s (%d bytes), %v old", a.path, a.size, age.Round(time.Second))
+		} else {
+			klog.Infof("Pruned archive %s (%d bytes) to bring the archives under %s", a.path, a.size, p.config.archiveMaxSize.String())
+		}
+	}
+	return nil
+}
+
+// listArchives returns the archives under basePath, oldest first, and their total size
+func (p *customProvisioner) listArchives(ctx context.Context, basePath string) ([]archiveEntry, int64, error) {
+	root := filepath.Join(basePath, archiveDirName)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read archive directory %s: %v", root, err)
+	}
+
+	var archives []archiveEntry
+	var total int64
+	calc := newUsageCalculator(1)
+	for _, entry := range entries {
+		made, ok := archiveTime(entry.Name())
+		if !ok {
+			continue
+		}
+		a := archiveEntry{path: filepath.Join(root, entry.Name()), made: made, dir: entry.IsDir()}
+		if a.dir {
+			if a.size, err = calc.size(ctx, a.path); err != nil {
+				klog.Warningf("Failed to measure archive %s: %v", a.path, err)
+				continue
+			}
+		} else if info, err := entry.Info(); err == nil {
+			a.size = info.Size()
+		}
+		archives = append(archives, a)
+		total += a.size
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].made.Before(archives[j].made) })
+	return archives, total, nil
+}
+
+// archiveFits makes sure archiving the volume keeps the archives on its base path, the disk it's archived to,
+// within --max-archive-bytes. When it wouldn't, the oldest of those archives are pruned first if pruning is
+// enabled, and if that isn't enough --archive-full decides: block fails the delete until there is room, delete
+// removes the volume for real with a warning event. It returns whether the volume should be archived.
+func (p *customProvisioner) archiveFits(ctx context.Context, volume *corev1.PersistentVolume, volumePath string) (bool, error) {
+	q := p.config.maxArchiveBytes.Quantity
+	if q == nil {
+		return true, nil
+	}
+	limit := q.Value()
+	// The uncompressed size, a compressed archive can only be smaller
+	need, err := newUsageCalculator(1).size(ctx, volumePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to measure volume %s for the archive cap: %v", volumePath, err)
+	}
+	archives, total, err := p.listArchives(ctx, p.volumeBasePath(volume))
+	if err != nil {
+		return false, err
+	}
+	if total+need > limit && (p.config.archiveRetention > 0 || p.config.archiveMaxSize.Quantity != nil) {
+		for _, a := range archives {
+			if total+need <= limit {
+				break
+			}
+			if err := p.deleteArchive(ctx, a); err != nil {
+				klog.Errorf("Failed to prune archive %s: %v", a.path, err)
+				continue
+			}
+			total -= a.size
+			klog.Infof("Pruned archive %s (%d bytes) to make room for volume %s under --max-archive-bytes", a.path, a.size, volume.Name)
+		}
+	}
+	if total+need <= limit {
+		return true, nil
+	}
+
+	full := fmt.Sprintf("archiving %d bytes would bring the archives to %d bytes, over --max-archive-bytes %s", need, total+need, q.String())
+	if p.config.archiveFull == archiveFullDelete {
+		klog.Warningf("Deleting volume %s instead of archiving it: %s", volume.Name, full)
+		p.recorder.Eventf(volume, corev1.EventTypeWarning, "ArchiveFull", "Deleted instead of archived: %s", full)
+		return false, nil
+	}
+	p.recorder.Eventf(volume, corev1.EventTypeWarning, "ArchiveFull", "Not deleting until the archive has room: %s", full)
+	return false, fmt.Errorf("not archiving volume %s: %s", volume.Name, full)
+}
+
+// deleteArchive removes one archive, directories with the backend named in their marker
+func (p *customProvisioner) deleteArchive(ctx context.Context, a archiveEntry) error {
+	audit := auditEntry{Operation: auditArchivePrune, Path: a.path, Node: p.config.nodeName, BytesRemoved: a.size}
+	var err error
+	if !a.dir {
+		err = os.Remove(a.path)
+	} else {
+		backendName := hostPathBackendName
+		if m, merr := readMarker(a.path); merr == nil {
+			audit.PV, audit.PVCUID = m.PVName, m.PVCUID
+			backendName = markerBackend(m)
+		}
+		audit.Backend = backendName
+		var backend VolumeBackend
+		if backend, err = p.backendFor(backendName); err == nil {
+			err = p.fsOp(ctx, "prune", a.path, func() error { return backend.Delete(ctx, a.path) })
+		}
+	}
+	p.audit.record(audit, err)
+	return err
+}
+
+// runArchivePruner prunes the archives every interval inside the maintenance window until ctx is cancelled
+func (p *customProvisioner) runArchivePruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !p.config.maintenanceWindow.open(time.Now()) {
+			klog.V(logDecisions).Infof("Outside the maintenance window %s, not pruning archives", p.config.maintenanceWindow.String())
+		} else if err := p.pruneArchives(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("Archive pruning failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"testing"
+	"time"
+)
+
+func TestArchiveStaysOnVolumeBasePath(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	p := newTestProvisioner(t, config, nil)
+
+	pvc := testPVC("default", "archived")
+	pvc.Annotations = map[string]string{annBasePathID: "disk2"}
+	class := testClass("archived")
+	class.Parameters = map[string]string{paramArchive: "true"}
+	pv, _, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: class})
+	if err != nil {
+		t.Fatalf("Provision = %v", err)
+	}
+	if err := p.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("Delete = %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(disk2, archiveDirName))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("archives on the pool path = %v, %v, want the volume", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(config.basePath, archiveDirName)); !os.IsNotExist(err) {
+		t.Errorf("archive directory created on --base-path: %v", err)
+	}
+}
+
+func TestPruneArchivesCoversBasePathPool(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	config.archiveRetention = time.Hour
+	p := newTestProvisioner(t, config, nil)
+
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(archiveTimeFormat)
+	var archives []string
+	for _, basePath := range []string{config.basePath, disk2} {
+		path := filepath.Join(basePath, archiveDirName, "pv-default-old-"+old)
+		if err := os.MkdirAll(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, path)
+	}
+
+	if err := p.pruneArchives(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range archives {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expired archive %s survived pruning: %v", path, err)
+		}
+	}
+}
+
+func TestArchiveFitsCountsVolumeBasePath(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	if err := config.maxArchiveBytes.Set("1Ki"); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProvisioner(t, config, nil)
+	volume := provisionedPV("pv-default-small", filepath.Join(disk2, "pv-default-small"), "1Mi", map[string]string{annBasePathID: "disk2"})
+	if err := os.Mkdir(volume.Spec.HostPath.Path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	addArchive := func(basePath string) {
+		t.Helper()
+		name := "pv-default-big-" + time.Now().UTC().Format(archiveTimeFormat) + archiveSuffix
+		if err := os.MkdirAll(filepath.Join(basePath, archiveDirName), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(basePath, archiveDirName, name), make([]byte, 2048), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A full archive on --base-path is another disk's business
+	addArchive(config.basePath)
+	if fits, err := p.archiveFits(context.Background(), volume, volume.Spec.HostPath.Path); !fits || err != nil {
+		t.Errorf("archiveFits with --base-path's archives full = %v, %v, want it to fit", fits, err)
+	}
+
+	addArchive(disk2)
+	if fits, err := p.archiveFits(context.Background(), volume, volume.Spec.HostPath.Path); fits || err == nil {
+		t.Errorf("archiveFits with the pool path's archives full = %v, %v, want it blocked", fits, err)
+	}
+}
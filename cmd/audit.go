@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the audit log
+const (
+	auditDelete        = "delete"
+	auditRecycle       = "recycle"
+	auditOrphanDelete  = "orphan-delete"
+	auditOrphanRecycle = "orphan-recycle"
+	auditArchive       = "archive"
+	auditArchivePrune  = "archive-prune"
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	PV        string    `json:"pv,omitempty"`
+	Path      string    `json:"path"`
+	Node      string    `json:"node,omitempty"`
+	PVCUID    string    `json:"pvcUID,omitempty"`
+	Actor     string    `json:"actor"`
+	Backend   string    `json:"backend,omitempty"`
+	// BytesRemoved is measured right before the operation, -1 when it couldn't be
+	BytesRemoved int64  `json:"bytesRemoved"`
+	Error        string `json:"error,omitempty"`
+}
+
+// auditLog appends destructive operations as JSON lines to a file only readable by us. Every entry is synced to
+// disk before the operation reports back, and the file is rotated to <path>.1 ... <path>.<maxBackups> once it
+// would grow beyond maxSize. A nil auditLog records nothing.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	actor      string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAuditLog(path string, maxSize int64, maxBackups int, actor string) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxBackups: maxBackups, actor: actor}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %v", a.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log %s: %v", a.path, err)
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups up by one, dropping the oldest, and starts a new file
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	for i := a.maxBackups; i > 0; i-- {
+		src := a.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", a.path, i-1)
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", a.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.maxBackups == 0 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// record writes the entry, filling in the time and actor. Failing to audit doesn't fail the operation, which
+// already happened, it is logged loudly instead.
+func (a *auditLog) record(entry auditEntry, opErr error) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Actor = a.actor
+	if opErr != nil {
+		entry.Error = opErr.Error()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		klog.Errorf("Failed to audit %s of %s: %v", entry.Operation, entry.Path, err)
+		return
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			klog.Errorf("Failed to rotate audit log %s: %v", a.path, err)
+		}
+	}
+	if a.file == nil {
+		// A rotation couldn't reopen the file, try again
+		if err := a.open(); err != nil {
+			klog.Errorf("Failed to audit %s of %s: %v", entry.Operation, entry.Path, err)
+			return
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		klog.Errorf("Failed to audit %s of %s: %v", entry.Operation, entry.Path, err)
+	}
+}
+
+// auditBytes measures the data about to be removed at path for the audit log, it costs a walk of the volume so
+// it's skipped without one. Failures are not fatal, the entry then says -1.
+func (p *customProvisioner) auditBytes(ctx context.Context, path string) int64 {
+	if p.audit == nil {
+		return -1
+	}
+	var size int64
+	err := p.fsOp(ctx, "measure", path, func() error {
+		var err error
+		size, err = newUsageCalculator(1).size(ctx, path)
+		return err
+	})
+	if err != nil {
+		klog.Warningf("Failed to measure %s for the audit log: %v", path, err)
+		return -1
+	}
+	return size
+}
+
+// claimUID returns the UID of the claim the PV was bound to, empty without one
+func claimUID(volume *corev1.PersistentVolume) string {
+	if volume.Spec.ClaimRef == nil {
+		return ""
+	}
+	return string(volume.Spec.ClaimRef.UID)
+}
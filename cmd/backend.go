@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// annBackend records on the PV which backend created the volume, so Delete tears it down the same way
+const annBackend = "custom-provisioner/backend"
+
+// VolumeBackend creates and removes the storage behind a single volume path
+type VolumeBackend interface {
+	// Name identifies the backend in flags, annotations and traces
+	Name() string
+	// Create sets up the volume at path with room for sizeBytes, the path must be usable as a directory afterwards
+	Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error
+	// Delete removes the volume at path together with all of its data
+	Delete(ctx context.Context, path string) error
+}
+
+// ResumableBackend is implemented by backends whose volumes need more than their directory, such as a mount, so a
+// volume found again on a retried provision, e.g. after its PV failed to persist, can be brought back as a whole
+type ResumableBackend interface {
+	VolumeBackend
+	// Resume restores whatever is missing of the existing volume at path, nothing for a complete one
+	Resume(ctx context.Context, path string) error
+}
+
+// SyncingBackend is implemented by backends keeping a volume's data in storage of their own, such as an image
+// file, that has to be synced besides the volume directory for the volume to be durable
+type SyncingBackend interface {
+	VolumeBackend
+	// Sync makes what was written to the volume at path so far durable
+	Sync(path string) error
+}
+
+// LimitingBackend is implemented by backends enforcing the volume size, so a pooled directory handed to a new
+// claim can be limited to that claim's request
+type LimitingBackend interface {
+	VolumeBackend
+	// SetLimit limits the existing volume at path to sizeBytes
+	SetLimit(ctx context.Context, path string, sizeBytes int64) error
+}
+
+// newBackend returns the backend registered under name, validating it against the configuration it will work with
+func newBackend(name string, config provisionerConfig, client kubernetes.Interface) (VolumeBackend, error) {
+	switch name {
+	case "", hostPathBackendName:
+		return &hostPathBackend{}, nil
+	case btrfsBackendName:
+		return newBtrfsBackend(config.basePath)
+	case overlayBackendName:
+		return newOverlayBackend(config.basePath, config.overlayLower)
+	case nfsBackendName:
+		return newNFSBackend(config)
+	case remoteBackendName:
+		return newRemoteBackend(config)
+	case encryptedBackendName:
+		return newEncryptedBackend(config, client)
+	case sparseReserveBackendName:
+		return &sparseReserveBackend{}, nil
+	case loopbackBackendName:
+		return newLoopbackBackend(config.basePath, config.loopbackFSType, config.maxConcurrentMkfs)
+	case tmpfsBackendName:
+		return &tmpfsBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
+
+const hostPathBackendName = "hostpath"
+
+// hostPathBackend is a plain directory, the requested size is not enforced
+type hostPathBackend struct{}
+
+func (b *hostPathBackend) Name() string {
+	return hostPathBackendName
+}
+
+func (b *hostPathBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	// Chmod afterwards so the umask doesn't change the configured mode
+	if err := os.MkdirAll(path, mode); err != nil {
+		return fmt.Errorf("failed to create volume directory: %v", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to set mode on volume directory: %v", err)
+	}
+	return nil
+}
+
+func (b *hostPathBackend) Delete(ctx context.Context, path string) error {
+	// removeTree deletes the directory and its contents, logging progress on big trees
+	return removeTree(ctx, path)
+}
+
+// runCommand runs an external tool and includes its output in the error when it fails
+func runCommand(ctx context.Context, name string, args ...string) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// runCommandWithInput is runCommand feeding input on stdin, the input is never part of the error
+func runCommandWithInput(ctx context.Context, input []byte, name string, args ...string) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
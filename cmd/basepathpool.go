@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// annBasePathID on a PVC pins its volume to one of the --base-path-pool entries, it is copied to the PV so Delete
+// knows which base path the volume has to be under
+const annBasePathID = "custom-provisioner/base-path-id"
+
+// basePathPoolFlag parses id=path,id=path into the extra base paths PVCs may pick with annBasePathID
+type basePathPoolFlag map[string]string
+
+func (f *basePathPoolFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for id, path := range *f {
+		pairs = append(pairs, id+"="+path)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *basePathPoolFlag) Set(value string) error {
+	pool := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, path, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("entry %q is not in id=path form", pair)
+		}
+		if errs := validation.IsDNS1123Label(id); len(errs) > 0 {
+			return fmt.Errorf("invalid base path id %q: %s", id, strings.Join(errs, "; "))
+		}
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("base path %q of %s must be absolute", path, id)
+		}
+		pool[id] = filepath.Clean(path)
+	}
+	*f = pool
+	return nil
+}
+
+// ids lists the pool's ids for error messages
+func (f basePathPoolFlag) ids() string {
+	ids := make([]string, 0, len(f))
+	for id := range f {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ", ")
+}
+
+// basePaths returns --base-path followed by the --base-path-pool paths in id order, for the tasks that look after
+// every disk volumes can be on
+func (c *provisionerConfig) basePaths() []string {
+	ids := make([]string, 0, len(c.basePathPool))
+	for id := range c.basePathPool {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	paths := []string{c.basePath}
+	for _, id := range ids {
+		paths = append(paths, c.basePathPool[id])
+	}
+	return paths
+}
+
+// basePathID returns the id of a --base-path-pool path, "" for --base-path
+func (c *provisionerConfig) basePathID(basePath string) string {
+	for id, path := range c.basePathPool {
+		if path == basePath {
+			return id
+		}
+	}
+	return ""
+}
+
+// poolBasePathSupported reports whether volumes of the backend can live under a pool base path. The other
+// backends keep images, layers or cipher directories under --base-path itself.
+func poolBasePathSupported(backend string) bool {
+	return backend == hostPathBackendName || backend == sparseReserveBackendName || backend == tmpfsBackendName
+}
+
+// selectBasePath returns the base path a PVC's volume goes under: the pool entry its annBasePathID names, or
+// --base-path without the annotation
+func (p *customProvisioner) selectBasePath(pvc *corev1.PersistentVolumeClaim, backend VolumeBackend) (string, string, error) {
+	id, ok := pvc.Annotations[annBasePathID]
+	if !ok {
+		return "", p.config.basePath, nil
+	}
+	basePath, ok := p.config.basePathPool[id]
+	if !ok {
+		if len(p.config.basePathPool) == 0 {
+			return "", "", fmt.Errorf("%s annotation %q can't be honored, no --base-path-pool is configured", annBasePathID, id)
+		}
+		return "", "", fmt.Errorf("unknown %s %q, expected one of %s", annBasePathID, id, p.config.basePathPool.ids())
+	}
+	if !poolBasePathSupported(backend.Name()) {
+		return "", "", fmt.Errorf("%s is not supported with backend %s", annBasePathID, backend.Name())
+	}
+	return id, basePath, nil
+}
+
+// volumeBasePath returns the base path the PV's volume lives under, --base-path unless annBasePathID names a
+// pool entry
+func (p *customProvisioner) volumeBasePath(volume *corev1.PersistentVolume) string {
+	if basePath, ok := p.config.basePathPool[volume.Annotations[annBasePathID]]; ok {
+		return basePath
+	}
+	return p.config.basePath
+}
+
+// checkPoolBasePath makes sure a volume provisioned under a pool base path is still where its PV says, so a
+// tampered PV can't make Delete remove a directory elsewhere
+func (p *customProvisioner) checkPoolBasePath(volume *corev1.PersistentVolume, volumePath string) error {
+	id, ok := volume.Annotations[annBasePathID]
+	if !ok {
+		return nil
+	}
+	basePath, ok := p.config.basePathPool[id]
+	if !ok {
+		return fmt.Errorf("base path %s of volume %s is no longer in --base-path-pool", id, volume.Name)
+	}
+	if !volumeUnderBase(volumePath, basePath, "") {
+		return fmt.Errorf("volume path %s is not under base path %s (%s)", volumePath, basePath, id)
+	}
+	return nil
+}
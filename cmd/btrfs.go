@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	btrfsBackendName = "btrfs"
+	// btrfsSuperMagic is the statfs f_type of a btrfs filesystem
+	btrfsSuperMagic = 0x9123683e
+)
+
+// btrfsBackend makes every volume a btrfs subvolume limited to the requested size by a qgroup,
+// quotas have to be enabled on the filesystem beforehand with "btrfs quota enable <base-path>"
+type btrfsBackend struct{}
+
+// newBtrfsBackend refuses base paths that are not on btrfs, subvolume commands would fail for every PVC otherwise
+func newBtrfsBackend(basePath string) (*btrfsBackend, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(basePath, &st); err != nil {
+		return nil, fmt.Errorf("failed to statfs %s: %v", basePath, err)
+	}
+	if int64(st.Type) != btrfsSuperMagic {
+		return nil, fmt.Errorf("base path %s is not on a btrfs filesystem (type 0x%x)", basePath, st.Type)
+	}
+	return &btrfsBackend{}, nil
+}
+
+func (b *btrfsBackend) Name() string {
+	return btrfsBackendName
+}
+
+func (b *btrfsBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	if err := runCommand(ctx, "btrfs", "subvolume", "create", path); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		b.Delete(ctx, path)
+		return fmt.Errorf("failed to set mode on subvolume: %v", err)
+	}
+	// Limit the subvolume's qgroup to the requested size, drop the subvolume again if that doesn't work
+	if err := b.SetLimit(ctx, path, sizeBytes); err != nil {
+		b.Delete(ctx, path)
+		return err
+	}
+	return nil
+}
+
+// SetLimit sets the limit of the subvolume's qgroup
+func (b *btrfsBackend) SetLimit(ctx context.Context, path string, sizeBytes int64) error {
+	return runCommand(ctx, "btrfs", "qgroup", "limit", strconv.FormatInt(sizeBytes, 10), path)
+}
+
+func (b *btrfsBackend) Delete(ctx context.Context, path string) error {
+	return runCommand(ctx, "btrfs", "subvolume", "delete", path)
+}
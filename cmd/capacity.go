@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"syscall"
+)
+
+// capacityCheckFailed describes a pre-provision capacity check that failed, reason is used as the metric label
+type capacityCheckFailed struct {
+	reason string
+	msg    string
+}
+
+func (e *capacityCheckFailed) Error() string {
+	return e.msg
+}
+
+// annSkipSpaceCheck on a PVC bypasses the free space check, only honored with --allow-skip-space-check
+const annSkipSpaceCheck = "custom-provisioner/skip-space-check"
+
+const (
+	// annPVCapacity on a PVC sets the capacity reported on its PV, only honored with --allow-capacity-override
+	annPVCapacity = "custom-provisioner/pv-capacity"
+	// annCapacityOverridden on a PV records the request it was provisioned for when annPVCapacity replaced it
+	annCapacityOverridden = "custom-provisioner/capacity-overridden-from"
+)
+
+// pvCapacity returns the capacity the PV reports, the request unless an allowed annPVCapacity overrides it. The
+// backing storage is sized from the request either way.
+func pvCapacity(pvc *corev1.PersistentVolumeClaim, allowOverride bool) (resource.Quantity, bool, error) {
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	v, ok := pvc.Annotations[annPVCapacity]
+	if !ok || !allowOverride {
+		return requested, false, nil
+	}
+	q, err := resource.ParseQuantity(v)
+	if err != nil || q.Sign() <= 0 {
+		return requested, false, fmt.Errorf("invalid %s annotation %q, expected a positive size like 10Gi", annPVCapacity, v)
+	}
+	return q, true, nil
+}
+
+// maxCapacityPaddingPercent caps --capacity-padding-percent, more than that points at a misconfiguration
+const maxCapacityPaddingPercent = 50
+
+// paddedSize returns size inflated by percent, rounded up to whole bytes
+func paddedSize(size int64, percent int) int64 {
+	if percent <= 0 {
+		return size
+	}
+	return size + (size*int64(percent)+99)/100
+}
+
+// quotaSize returns the size the backing storage of the PVC is capped at: its storage limit when it sets one,
+// otherwise the request. The PV always reports the request as its capacity.
+func quotaSize(pvc *corev1.PersistentVolumeClaim) resource.Quantity {
+	if limit, ok := pvc.Spec.Resources.Limits[corev1.ResourceStorage]; ok && !limit.IsZero() {
+		return limit
+	}
+	return pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+}
+
+// checkCapacity verifies the filesystem holding path has room for a volume of requestBytes and keeps at least
+// minFreeInodes inodes free. A zero requestBytes or minFreeInodes skips the corresponding check.
+func checkCapacity(path string, requestBytes int64, minFreeInodes uint64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fmt.Errorf("failed to statfs %s: %v", path, err)
+	}
+
+	// Bavail is what unprivileged users can still allocate, which is what the pods writing to the volume will see
+	if requestBytes > 0 {
+		available := uint64(st.Bavail) * uint64(st.Bsize)
+		if uint64(requestBytes) > available {
+			return &capacityCheckFailed{
+				reason: "bytes",
+				msg:    fmt.Sprintf("not enough free space on %s: requested %d bytes, %d bytes available", path, requestBytes, available),
+			}
+		}
+	}
+
+	// Linux reports the same value for f_ffree and f_favail, so Ffree is the number of inodes left for new files
+	if minFreeInodes > 0 && uint64(st.Ffree) < minFreeInodes {
+		return &capacityCheckFailed{
+			reason: "inodes",
+			msg:    fmt.Sprintf("not enough free inodes on %s: %d free, at least %d required", path, st.Ffree, minFreeInodes),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"time"
+)
+
+// classWaitExpiry is how long a deferred PVC counts as waiting without coming back. It is longer than the
+// controller's longest retry backoff, a PVC gone for that long was deleted or provisioned elsewhere.
+const classWaitExpiry = 20 * time.Minute
+
+var (
+	// classInFlight is the number of provisions of each StorageClass holding a controller worker
+	classInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "provisioner_class_provisions_in_flight",
+		Help: "Provisions currently running per StorageClass, bounded by its provisionWorkers parameter or --class-provision-workers.",
+	}, []string{"storage_class"})
+	// classDeferred counts provisions put back on the controller's queue because their class had no free worker
+	classDeferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "provisioner_class_provisions_deferred_total",
+		Help: "Provisions deferred because every worker of their StorageClass was busy.",
+	}, []string{"storage_class"})
+	// classWaiting is the number of PVCs of each StorageClass deferred for a worker and not provisioned since
+	classWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "provisioner_class_provisions_waiting",
+		Help: "PVCs per StorageClass deferred because every worker of their class was busy and waiting for the controller's retry.",
+	}, []string{"storage_class"})
+)
+
+// classPools hands out per-StorageClass worker slots. The controller runs Provision on a fixed set of threads
+// shared by all classes, so a class on a slow disk could otherwise tie up every one of them. A class whose slots
+// are all taken has its provisions deferred right away instead of waiting on a thread other classes need.
+type classPools struct {
+	mu sync.Mutex
+	// inUse is the number of slots taken per class, it carries over when the class's pool size changes
+	inUse map[string]int
+	// waiting holds the deferred PVCs of each class with the time they were last deferred
+	waiting map[string]map[types.UID]time.Time
+}
+
+// acquire takes a slot of the class's pool of the given size for the PVC, 0 means unbounded. The returned func
+// gives it back. The size is checked against every provision of the class still running, so when it changes,
+// slots taken under the old size keep counting until they are given back.
+func (c *classPools) acquire(class string, uid types.UID, size int) (func(), error) {
+	if size <= 0 {
+		c.setWaiting(class, uid, false)
+		classInFlight.WithLabelValues(class).Inc()
+		return func() { classInFlight.WithLabelValues(class).Dec() }, nil
+	}
+	c.mu.Lock()
+	if c.inUse == nil {
+		c.inUse = map[string]int{}
+	}
+	if c.inUse[class] >= size {
+		c.mu.Unlock()
+		classDeferred.WithLabelValues(class).Inc()
+		c.setWaiting(class, uid, true)
+		return nil, fmt.Errorf("all %d provision workers of StorageClass %q are busy, deferring", size, class)
+	}
+	c.inUse[class]++
+	c.mu.Unlock()
+
+	c.setWaiting(class, uid, false)
+	classInFlight.WithLabelValues(class).Inc()
+	return func() {
+		c.mu.Lock()
+		if c.inUse[class]--; c.inUse[class] == 0 {
+			delete(c.inUse, class)
+		}
+		c.mu.Unlock()
+		classInFlight.WithLabelValues(class).Dec()
+	}, nil
+}
+
+// setWaiting records whether the PVC is deferred for a slot of the class and updates the waiting gauges. The
+// controller doesn't tell us about PVCs deleted while deferred, so entries older than classWaitExpiry are dropped.
+func (c *classPools) setWaiting(class string, uid types.UID, waiting bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if waiting {
+		if c.waiting == nil {
+			c.waiting = map[string]map[types.UID]time.Time{}
+		}
+		if c.waiting[class] == nil {
+			c.waiting[class] = map[types.UID]time.Time{}
+		}
+		c.waiting[class][uid] = time.Now()
+	} else {
+		delete(c.waiting[class], uid)
+	}
+	for name, uids := range c.waiting {
+		for u, since := range uids {
+			if time.Since(since) > classWaitExpiry {
+				delete(uids, u)
+			}
+		}
+		classWaiting.WithLabelValues(name).Set(float64(len(uids)))
+		if len(uids) == 0 {
+			delete(c.waiting, name)
+		}
+	}
+}
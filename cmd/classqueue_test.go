@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+	"time"
+)
+
+func TestClassPoolsCountWaiting(t *testing.T) {
+	var c classPools
+	waiting := func() float64 { return testutil.ToFloat64(classWaiting.WithLabelValues("slow-waiting")) }
+
+	done, err := c.acquire("slow-waiting", "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deferred PVCs count once however often the controller retries them
+	for _, uid := range []string{"b", "b", "c"} {
+		if _, err := c.acquire("slow-waiting", types.UID(uid), 1); err == nil {
+			t.Fatalf("acquire for %s got a slot of a full class", uid)
+		}
+	}
+	if got := waiting(); got != 2 {
+		t.Errorf("waiting = %v after deferring b and c, want 2", got)
+	}
+
+	done()
+	done, err = c.acquire("slow-waiting", "b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if got := waiting(); got != 1 {
+		t.Errorf("waiting = %v once b got its slot, want 1", got)
+	}
+
+	// c never came back, e.g. its PVC was deleted while deferred
+	c.mu.Lock()
+	c.waiting["slow-waiting"]["c"] = time.Now().Add(-2 * classWaitExpiry)
+	c.mu.Unlock()
+	release, err := c.acquire("other-waiting", "d", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if got := waiting(); got != 0 {
+		t.Errorf("waiting = %v after c expired, want 0", got)
+	}
+}
+
+func TestClassPoolsResizeKeepsHolders(t *testing.T) {
+	var c classPools
+	first, err := c.acquire("resized", "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.acquire("resized", "b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrinking the class leaves both provisions running, nothing new starts until one of them is done
+	if _, err := c.acquire("resized", "c", 1); err == nil {
+		t.Fatal("acquire after shrinking to 1 got a slot while 2 are held")
+	}
+	first()
+	if _, err := c.acquire("resized", "c", 1); err == nil {
+		t.Fatal("acquire after shrinking to 1 got a slot while 1 is held")
+	}
+	second()
+	done, err := c.acquire("resized", "c", 1)
+	if err != nil {
+		t.Fatalf("acquire with the old holders gone = %v", err)
+	}
+
+	// Growing it admits up to the new size, counting the provision already running
+	more, err := c.acquire("resized", "d", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.acquire("resized", "e", 2); err == nil {
+		t.Error("acquire after growing to 2 got a third slot")
+	}
+	more()
+	done()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sync"
+)
+
+// commitment is the capacity one volume holds on its base path
+type commitment struct {
+	basePath string
+	bytes    int64
+}
+
+// committedLedger tracks the bytes committed to volumes per base path for --max-committed-bytes. It counts the
+// capacity volumes were provisioned with, not what they use, so the ceiling holds however full they get.
+type committedLedger struct {
+	mu sync.Mutex
+	// volumes holds the commitment of each volume, keyed by PV name
+	volumes map[string]commitment
+	// totals sums the commitments per base path
+	totals map[string]int64
+}
+
+// set records the commitment of a volume, replacing any earlier one, the caller holds mu
+func (l *committedLedger) set(name string, c commitment) {
+	if l.volumes == nil {
+		l.volumes, l.totals = map[string]commitment{}, map[string]int64{}
+	}
+	if old, ok := l.volumes[name]; ok {
+		l.totals[old.basePath] -= old.bytes
+	}
+	l.volumes[name] = c
+	l.totals[c.basePath] += c.bytes
+}
+
+// reserve commits bytes on basePath to the named volume unless that would take the base path beyond limit. The
+// returned func undoes the reservation, provisions that fail after reserving call it.
+func (l *committedLedger) reserve(name, basePath string, bytes, limit int64) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, hadOld := l.volumes[name]
+	committed := l.totals[basePath]
+	if hadOld && old.basePath == basePath {
+		committed -= old.bytes
+	}
+	if committed+bytes > limit {
+		return nil, &capacityCheckFailed{
+			reason: "ceiling",
+			msg:    fmt.Sprintf("committing %d bytes would exceed --max-committed-bytes on %s: %d of %d bytes already committed", bytes, basePath, committed, limit),
+		}
+	}
+	l.set(name, commitment{basePath: basePath, bytes: bytes})
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if hadOld {
+			l.set(name, old)
+		} else {
+			l.release(name)
+		}
+	}, nil
+}
+
+// release drops the commitment of the named volume, the caller holds mu
+func (l *committedLedger) release(name string) {
+	if c, ok := l.volumes[name]; ok {
+		l.totals[c.basePath] -= c.bytes
+		delete(l.volumes, name)
+	}
+}
+
+// forget drops the commitment of a deleted volume, unknown volumes are ignored
+func (l *committedLedger) forget(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release(name)
+}
+
+// seedCommitted fills the ledger from the PVs already provisioned on our base paths, --base-path and the pool
+// entries named by their annBasePathID. With a node name, volumes pinned to other nodes sharing the same path
+// don't count.
+func (p *customProvisioner) seedCommitted(ctx context.Context) error {
+	var node *corev1.Node
+	if p.config.nodeName != "" {
+		var err error
+		if node, err = p.client.CoreV1().Nodes().Get(ctx, p.config.nodeName, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("failed to get node %s: %v", p.config.nodeName, err)
+		}
+	}
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	p.committed.mu.Lock()
+	defer p.committed.mu.Unlock()
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		path, ok := volumeSourcePath(pv)
+		if !ok || pv.Annotations[annProvisionedBy] != provisionerName {
+			continue
+		}
+		basePath, realBasePath := p.config.basePath, p.config.realBasePath
+		if id, ok := pv.Annotations[annBasePathID]; ok {
+			if basePath, ok = p.config.basePathPool[id]; !ok {
+				continue
+			}
+			realBasePath = ""
+		}
+		if !volumeUnderBase(path, basePath, realBasePath) {
+			continue
+		}
+		if node != nil && pv.Spec.NodeAffinity != nil && !affinitySelectsNode(pv.Spec.NodeAffinity, node) {
+			continue
+		}
+		p.committed.set(pv.Name, commitment{basePath: basePath, bytes: pv.Spec.Capacity.Storage().Value()})
+	}
+	for _, basePath := range p.config.basePaths() {
+		klog.Infof("%d bytes committed to volumes on %s", p.committed.totals[basePath], basePath)
+	}
+	return nil
+}
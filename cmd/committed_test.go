@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path/filepath"
+	"testing"
+)
+
+// provisionedPV returns a PV of ours with a HostPath source at path
+func provisionedPV(name, path, size string, annotations map[string]string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{annProvisionedBy: provisionerName}},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:               corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: path}},
+		},
+	}
+	for k, v := range annotations {
+		pv.Annotations[k] = v
+	}
+	return pv
+}
+
+func TestSeedCommittedCoversBasePathPool(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	p := newTestProvisioner(t, config, nil,
+		provisionedPV("pv-a", filepath.Join(config.basePath, "pv-a"), "1Gi", nil),
+		provisionedPV("pv-b", filepath.Join(disk2, "pv-b"), "2Gi", map[string]string{annBasePathID: "disk2"}),
+		// Pinned to disk2 but pointing elsewhere, it doesn't count anywhere
+		provisionedPV("pv-c", filepath.Join(config.basePath, "pv-c"), "4Gi", map[string]string{annBasePathID: "disk2"}),
+	)
+
+	if err := p.seedCommitted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.committed.totals[config.basePath]; got != 1<<30 {
+		t.Errorf("committed on --base-path = %d, want %d", got, 1<<30)
+	}
+	if got := p.committed.totals[disk2]; got != 2<<30 {
+		t.Errorf("committed on the pool path = %d, want %d", got, 2<<30)
+	}
+}
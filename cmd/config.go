@@ -0,0 +1,781 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// provisionerConfig holds the settings the provisioner itself works with, filled from command line flags
+type provisionerConfig struct {
+	// basePath is the directory under which all volume directories are created, a template is rendered at startup
+	basePath string
+	// realBasePath is basePath with symlinks resolved, set at startup for the containment checks, PV sources
+	// keep the configured path
+	realBasePath string
+	// identity names this replica in events, PV annotations and the audit log
+	identity string
+	// nodeName is the node the provisioner runs on
+	nodeName string
+	// backend is the name of the VolumeBackend new volumes are created with
+	backend string
+	// allowedBackends are the backends a PVC may pick with the backend annotation besides the default one
+	allowedBackends listFlag
+	// overlayLower is the shared read-only lower directory of the overlay backend
+	overlayLower string
+	// loopbackFSType is the filesystem the loopback backend formats its images with
+	loopbackFSType string
+	// checkFreeSpace rejects provisions that don't fit in the free space left on the base path
+	checkFreeSpace bool
+	// minFreeInodes is the number of inodes that must stay free on the base path, 0 disables the check
+	minFreeInodes uint64
+	// writeMarker writes an ownership marker file into every new volume
+	writeMarker bool
+	// preferStaticBinding skips provisioning while a matching pre-created PV is available for the PVC
+	preferStaticBinding bool
+	// capacityPaddingPercent inflates the backing size of size-enforcing backends to cover filesystem overhead
+	capacityPaddingPercent int
+	// gcOrphans lets the orphan scan delete volume directories no PV refers to, otherwise they are only reported
+	gcOrphans bool
+	// pinToNode gives every PV a node affinity to the node the provisioner runs on
+	pinToNode bool
+	// nodeTaintSensitivity decides which node conditions make pinned provisions go elsewhere
+	nodeTaintSensitivity string
+	// fsyncOnCreate fsyncs the base path (and the new volume directory) after creating a volume
+	fsyncOnCreate bool
+	// fsOpTimeout bounds single filesystem operations, 0 waits forever
+	fsOpTimeout time.Duration
+	// maxConcurrentDeletes caps the deletes running at the same time, 0 means no limit
+	maxConcurrentDeletes int
+	// verifyMarkerOnDelete checks the ownership marker matches the PV's claim before deleting data
+	verifyMarkerOnDelete bool
+	// remoteAgentPort, remoteTokenFile, remoteCAFile and remoteTimeout configure how the remote backend reaches node agents
+	remoteAgentPort int
+	remoteTokenFile string
+	remoteCAFile    string
+	remoteTimeout   time.Duration
+	// absoluteMaxSize caps the size of every volume regardless of StorageClass, nil when unset
+	absoluteMaxSize quantityFlag
+	// strictAccessModes rejects PVCs with duplicate or conflicting access modes instead of normalizing them
+	strictAccessModes bool
+	// accessModeMatrix overrides the access modes backends support, see defaultAccessModes
+	accessModeMatrix accessModeMatrixFlag
+	// inheritParentGroup gives new volume directories the base path's group and the setgid bit
+	inheritParentGroup bool
+	// provisionTimeout bounds a whole Provision call, 0 means no limit
+	provisionTimeout time.Duration
+	// skeletonDir is copied into every new volume, empty disables it
+	skeletonDir string
+	// minProvisionInterval is the minimum time between two provision attempts of the same PVC, 0 disables it
+	minProvisionInterval time.Duration
+	// nfsServer, nfsExportOptions and nfsExportsFile configure the nfs backend
+	nfsServer        string
+	nfsExportOptions string
+	nfsExportsFile   string
+	// annotationUpdateRate is the number of batched PV annotation patches sent per second, 0 sends them unbatched
+	annotationUpdateRate float64
+	// defaultReclaimPolicy, defaultDirMode, defaultMinSize and defaultMaxSize apply when neither the StorageClass
+	// nor the policy ConfigMap say otherwise, and on their own to PVCs provisioned without a StorageClass
+	defaultReclaimPolicy string
+	defaultDirMode       string
+	defaultMinSize       quantityFlag
+	defaultMaxSize       quantityFlag
+	// skeletonModeMask is ANDed into the permission bits of everything copied from the skeleton directory
+	skeletonModeMask modeFlag
+	// enableTTLReaper honors the ttl annotation of PVCs and reaps expired volumes every ttlReaperInterval
+	enableTTLReaper   bool
+	ttlReaperInterval time.Duration
+	// encryptionKeySource is where the encrypted backend gets volume keys from: file:<path>, secret:<ns>/<name>/<key> or command:<path>
+	encryptionKeySource string
+	// staleVolumeGrace is how old the marker of an existing directory whose PVC is gone must be before it's taken over
+	staleVolumeGrace time.Duration
+	// auditLog is the file destructive operations are appended to as JSON lines, rotated after auditLogMaxSizeMB
+	auditLog           string
+	auditLogMaxSizeMB  int
+	auditLogMaxBackups int
+	// mountProbeInterval is how often the base path is probed for a stale or unreachable mount
+	mountProbeInterval time.Duration
+	// stagingMaxAge is how old a leftover in the staging directory must be before the startup sweep removes it
+	stagingMaxAge time.Duration
+	// requiredClassParams must all be set on every StorageClass we provision for
+	requiredClassParams listFlag
+	// requiredPVCLabels must all be set, with a value, on every PVC we provision for
+	requiredPVCLabels listFlag
+	// maintenanceWindow confines the TTL reaper and orphan GC to a daily time range
+	maintenanceWindow maintenanceWindow
+	// archiveCompress writes archives as .tar.gz, archiveRetention and archiveMaxSize bound how long and how much
+	// of them is kept, checked every archivePruneInterval
+	archiveCompress      bool
+	archiveRetention     time.Duration
+	archiveMaxSize       quantityFlag
+	archivePruneInterval time.Duration
+	// maxArchiveBytes caps the archives at archive time, archiveFull says what a volume that doesn't fit gets
+	maxArchiveBytes quantityFlag
+	archiveFull     string
+	// reconcileWorkers bounds the directories the orphan scan checks in parallel, reconcileTimeout is how long
+	// /readyz waits for the startup scan
+	reconcileWorkers int
+	reconcileTimeout time.Duration
+	// allowSkipSpaceCheck honors the skip-space-check PVC annotation
+	allowSkipSpaceCheck bool
+	// maxCommittedBytes caps the capacity of all volumes on the base path together, nil when unset
+	maxCommittedBytes quantityFlag
+	// checkTools verifies at startup that the commands of the enabled backends are installed
+	checkTools bool
+	// propagateAnnotationPrefixes selects the PVC annotations copied onto the PV
+	propagateAnnotationPrefixes listFlag
+	// pvNameConflict decides what happens when the PV name of a PVC is taken by another claim's PV
+	pvNameConflict string
+	// maxPVCNameLength caps the PVC names taken as they are, longPVCNames says what happens to longer ones
+	maxPVCNameLength int
+	longPVCNames     string
+	// deletePreconditionFile is a per-volume file template Delete waits for, or for the absence of with
+	// deletePreconditionAbsent, at most deletePreconditionTimeout per attempt
+	deletePreconditionFile    string
+	deletePreconditionAbsent  bool
+	deletePreconditionTimeout time.Duration
+	// classProvisionWorkers caps the provisions running at once per StorageClass unless the class sets provisionWorkers
+	classProvisionWorkers int
+	// noDelete makes Delete a no-op that keeps the data, whatever the reclaim policy
+	noDelete bool
+	// volumeSource is how PVs of backends without a source of their own expose the directory, csiDriver names
+	// the driver of csi sources
+	volumeSource string
+	csiDriver    string
+	// namespaceReclaimOverrides sets the reclaim policy of namespaces unless the class or ConfigMap pin one
+	namespaceReclaimOverrides reclaimOverridesFlag
+	// shutdownReport is where a JSON summary of the session is written on shutdown, after waiting up to
+	// shutdownDrainTimeout for running operations
+	shutdownReport       string
+	shutdownDrainTimeout time.Duration
+	// deleteProgressFiles and deleteProgressInterval are how often a volume removal logs its progress
+	deleteProgressFiles    int64
+	deleteProgressInterval time.Duration
+	// allowCapacityOverride honors the pv-capacity PVC annotation
+	allowCapacityOverride bool
+	// minFreeMemory reschedules tmpfs volumes while the node has less memory available, nil when unset
+	minFreeMemory quantityFlag
+	// forbiddenSubpaths are the parts of the base path volumes are never created in or deleted from, relative to it
+	forbiddenSubpaths listFlag
+	// emitReceipts writes a ConfigMap describing each provisioned volume next to its PVC
+	emitReceipts bool
+	// maxProvisionAttempts is how many times provisioning a PVC may fail before it's given up on, 0 retries forever
+	maxProvisionAttempts int
+	// provisionAttemptsWindow is how long a PVC's failures are remembered after its last one
+	provisionAttemptsWindow time.Duration
+	// basePathPool holds the extra base paths by id PVCs can pin their volume to with annBasePathID
+	basePathPool basePathPoolFlag
+	// annotateMountInfo stamps the filesystem type and mount source of the base path on every local PV
+	annotateMountInfo bool
+	// maxConcurrentScans caps the background disk walks running at once, 0 means no cap
+	maxConcurrentScans int
+	// recreateMissingDirs recreates, empty, the lost directories of bound PVs at startup
+	recreateMissingDirs bool
+	// phaseMetrics times every provision phase into provisioner_provision_phase_duration_seconds
+	phaseMetrics bool
+	// dedupeProvisions makes a Provision of a PVC already being provisioned wait for and share that result
+	dedupeProvisions bool
+	// allowAdoption lets Provision adopt an existing directory carrying the external marker instead of refusing it
+	allowAdoption bool
+	// maxConcurrentMkfs caps the loopback images formatted at once, 0 means no cap
+	maxConcurrentMkfs int
+	// readOnly starts the provisioner with provisioning frozen, it can be toggled at runtime with SIGUSR1
+	readOnly bool
+	// pvLabels are set on every provisioned PV
+	pvLabels labelsFlag
+	// maxDeleteAttempts is how many times Delete may fail for a PV before it is dead-lettered, 0 retries forever
+	maxDeleteAttempts int
+}
+
+// addFlags registers the provisioner flags on fs
+func (c *provisionerConfig) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.basePath, "base-path", "/tmp/dynamic-volumes", "Directory under which volume directories are created, may be a template using the running node's labels, e.g. /data/{{.NodeLabels.disktype}}")
+	fs.StringVar(&c.identity, "identity", defaultIdentity(), "Name of this provisioner replica recorded as the source host of its events, in the custom-provisioner/provisioned-by-identity PV annotation "+
+		"and as the audit log actor; defaults to the hostname, which is the pod name")
+	fs.StringVar(&c.nodeName, "node-name", os.Getenv("NODE_NAME"), "Name of the node the provisioner runs on, defaults to the NODE_NAME environment variable")
+	fs.StringVar(&c.backend, "backend", hostPathBackendName, "Backend used to create volumes: hostpath (plain directories), btrfs (subvolumes with a qgroup size limit), "+
+		"overlay (overlayfs over --overlay-lower, needs a privileged container with Bidirectional mount propagation), "+
+		"nfs (directories exported through the node's NFS server, for ReadWriteMany), "+
+		"sparse-reserve (plain directories with a sparse reservation file, the committed sizes can't exceed the filesystem), "+
+		"loopback (a loop mounted filesystem image per volume, sized to the request; thick or thin per the custom-provisioner/allocation PVC annotation), "+
+		"encrypted (gocryptfs mounts with per-volume keys from --encryption-key-source, needs a privileged container with Bidirectional mount propagation), "+
+		"tmpfs (RAM backed mounts sized to the request, the data doesn't survive a reboot; see --min-free-memory) "+
+		"or remote (directories created by the storage agent on the PV's node, for a centralized controller)")
+	fs.Var(&c.allowedBackends, "allowed-backends", "Comma separated backends PVCs may select with the custom-provisioner/backend annotation, besides the default --backend")
+	fs.StringVar(&c.overlayLower, "overlay-lower", "", "Read-only directory shared as the lower layer of every overlay backend volume")
+	fs.StringVar(&c.loopbackFSType, "loopback-fs-type", defaultLoopbackFSType, "Filesystem the loopback backend formats volume images with, mkfs.<type> must be installed")
+	fs.BoolVar(&c.checkFreeSpace, "check-free-space", true, "Reject provisions whose requested size exceeds the free space on the base path")
+	fs.Uint64Var(&c.minFreeInodes, "min-free-inodes", 0, "Reject provisions when fewer inodes than this are free on the base path, 0 disables the check")
+	fs.Var(&c.pvLabels, "pv-labels", "Comma separated key=value labels set on every provisioned PV, e.g. team=platform,tier=local")
+	fs.IntVar(&c.maxDeleteAttempts, "max-delete-attempts", 0, "Stop retrying a failing delete after this many attempts and mark the PV with the custom-provisioner/delete-failed annotation, 0 retries forever")
+	fs.BoolVar(&c.writeMarker, "write-marker", true, "Write an ownership marker file (PVC name and UID) into every new volume. It lets a retried provision safely "+
+		"reuse its own directory; with it disabled each provision saves a file write, but an existing directory is then reused purely because its name matches the PVC")
+	fs.BoolVar(&c.preferStaticBinding, "prefer-static-binding", false, "Don't provision a PVC while an available pre-created PV matches it, so static binding wins")
+	fs.IntVar(&c.capacityPaddingPercent, "capacity-padding-percent", 0, fmt.Sprintf("Make the backing quota this many percent larger than the request so the usable space matches it, "+
+		"the PV still reports the requested capacity (capped at %d)", maxCapacityPaddingPercent))
+	fs.BoolVar(&c.gcOrphans, "gc-orphans", false, "Delete volume directories (carrying our ownership marker) that no PV refers to, otherwise orphans are only reported")
+	fs.BoolVar(&c.pinToNode, "pin-to-node", false, "Set a node affinity on every PV to the node the provisioner runs on, needs --node-name")
+	fs.StringVar(&c.nodeTaintSensitivity, "node-taint-sensitivity", taintSensitivityNone, "With --pin-to-node, reschedule provisions while the node is unusable: "+
+		"none (never), cordon (node is unschedulable) or noschedule (cordoned or tainted NoSchedule/NoExecute)")
+	fs.BoolVar(&c.fsyncOnCreate, "fsync-on-create", false, "Fsync the base path and the new volume directory after creating a volume, making the directory entries crash-consistent; "+
+		"a PVC annotated custom-provisioner/durable=true or =false overrides this for its volume")
+	fs.DurationVar(&c.fsOpTimeout, "fs-op-timeout", 0, "Give up on a single filesystem operation (stat, create, remove) after this long; provisions are rescheduled and deletes retried, 0 waits forever")
+	fs.IntVar(&c.maxConcurrentDeletes, "max-concurrent-deletes", 0, "Maximum number of volumes deleted at the same time, independent of the provisioning threads, 0 means no limit")
+	fs.BoolVar(&c.verifyMarkerOnDelete, "verify-marker-on-delete", false, "Before deleting a volume, check its ownership marker names the PVC the PV was bound to and refuse to delete on a mismatch")
+	fs.IntVar(&c.remoteAgentPort, "remote-agent-port", defaultRemoteAgentPort, "Port the storage agents of the remote backend listen on, they are reached at each node's internal IP")
+	fs.StringVar(&c.remoteTokenFile, "remote-token-file", "", "File holding the bearer token sent to the storage agents of the remote backend")
+	fs.StringVar(&c.remoteCAFile, "remote-ca-file", "", "CA bundle used to verify the storage agents' TLS certificates, the system roots are used when empty")
+	fs.DurationVar(&c.remoteTimeout, "remote-timeout", defaultRemoteTimeout, "Timeout of a single request to a storage agent of the remote backend")
+	fs.Var(&c.absoluteMaxSize, "absolute-max-size", "Hard cap on the size of any volume (e.g. 500Gi) that no StorageClass or policy can raise, unset means no cap")
+	fs.BoolVar(&c.strictAccessModes, "strict-access-modes", false, "Reject PVCs listing an access mode twice or combining ReadWriteOncePod with other modes, by default the list is normalized")
+	fs.Var(&c.accessModeMatrix, "access-mode-matrix", "Comma separated backend=Mode|Mode access modes each backend supports (e.g. tmpfs=RWO|RWOP,hostpath=RWO), "+
+		"PVCs asking for others fail; backends not listed keep their defaults: every mode, except ReadWriteOnce and ReadWriteOncePod only for tmpfs")
+	fs.BoolVar(&c.inheritParentGroup, "inherit-parent-group", false, "Give new volume directories the group of the base path and set the setgid bit, so files created by pods land in that group")
+	fs.DurationVar(&c.provisionTimeout, "provision-timeout", 0, "Abort a provision that takes longer than this in total, removing any partially created volume, and reschedule it; 0 means no limit")
+	fs.StringVar(&c.skeletonDir, "skeleton-dir", "", "Directory whose contents (files, subdirectories and symlinks, modes preserved) are copied into every new volume")
+	fs.DurationVar(&c.minProvisionInterval, "min-provision-interval", 0, "Reschedule a provision without touching the disk if the same PVC was attempted less than this long ago, 0 disables it")
+	fs.StringVar(&c.nfsServer, "nfs-server", "", "Address of this node's NFS server as clients should mount it, used in the PVs of the nfs backend")
+	fs.StringVar(&c.nfsExportOptions, "nfs-export-options", defaultNFSExportOptions, "Client list and options of every export the nfs backend adds to the exports file")
+	fs.StringVar(&c.nfsExportsFile, "nfs-exports-file", "/etc/exports", "Exports file of the node's NFS server, the nfs backend adds and removes one line per volume")
+	fs.Float64Var(&c.annotationUpdateRate, "annotation-update-rate", 0, fmt.Sprintf("Batch bookkeeping annotation updates of PVs, coalescing those to the same PV within %v into one merge patch, "+
+		"and send at most this many patches per second; 0 patches right away", annotationBatchWindow))
+	fs.StringVar(&c.defaultReclaimPolicy, "default-reclaim-policy", string(corev1.PersistentVolumeReclaimDelete), "Reclaim policy (Delete or Retain) of volumes whose StorageClass sets none and whose namespace has no "+
+		"--namespace-reclaim-overrides entry, in practice PVCs without a StorageClass since the API server fills in the reclaimPolicy field of every class")
+	fs.StringVar(&c.defaultDirMode, "default-dir-mode", fmt.Sprintf("%04o", defaultDirMode), "Octal mode of new volume directories unless the StorageClass or policy ConfigMap sets dirMode")
+	fs.Var(&c.defaultMinSize, "default-min-size", "Minimum volume size unless the StorageClass or policy ConfigMap sets minSize")
+	fs.Var(&c.defaultMaxSize, "default-max-size", "Maximum volume size unless the StorageClass or policy ConfigMap sets maxSize")
+	fs.Var(&c.skeletonModeMask, "skeleton-mode-mask", "Octal mask ANDed into the modes of all files and directories copied from --skeleton-dir, e.g. 0755 drops group and other write; "+
+		"setgid on copied directories is kept. Unset copies the skeleton's modes as they are")
+	fs.BoolVar(&c.enableTTLReaper, "enable-ttl-reaper", false, "Honor the custom-provisioner/ttl PVC annotation (e.g. 2h): the PVC is deleted once its volume expired, "+
+		"unless the PV or PVC is annotated custom-provisioner/protected=true; the reclaim policy decides what happens to the data")
+	fs.DurationVar(&c.ttlReaperInterval, "ttl-reaper-interval", time.Minute, "How often the TTL reaper looks for expired volumes")
+	fs.StringVar(&c.encryptionKeySource, "encryption-key-source", "", "Where the encrypted backend gets volume keys: file:<path> or secret:<namespace>/<name>/<key> hold a master key "+
+		"each volume key is derived from with HMAC-SHA256, command:<path> runs a KMS helper that prints the key of the volume named by its argument")
+	fs.DurationVar(&c.staleVolumeGrace, "stale-volume-grace", time.Minute, "When a volume directory already exists for a PVC without a PV, e.g. after a restart, "+
+		"take it over from a PVC of the same name that no longer exists once its marker is at least this old; directories of active PVCs are never taken over")
+	fs.StringVar(&c.auditLog, "audit-log", "", "File every volume delete and recycle is appended to as a JSON line (time, PV, path, PVC UID, actor, bytes removed), "+
+		"created with mode 0600 and synced after each entry; disabled when empty")
+	fs.IntVar(&c.auditLogMaxSizeMB, "audit-log-max-size-mb", 100, "Rotate the audit log once it would grow beyond this many MiB, 0 never rotates")
+	fs.IntVar(&c.auditLogMaxBackups, "audit-log-max-backups", 5, "Rotated audit logs to keep as <audit-log>.1 to <audit-log>.N")
+	fs.DurationVar(&c.mountProbeInterval, "mount-probe-interval", 10*time.Second, "How often the base path is probed for a stale or unreachable mount (ESTALE, a dead FUSE daemon, a hung NFS server). "+
+		"While it is unavailable /readyz fails, provisions are rescheduled and deletes retried; 0 disables probing")
+	fs.DurationVar(&c.stagingMaxAge, "staging-max-age", time.Hour, "At startup, remove half built volumes left under <base-path>/.tmp by a crash once they are this old; "+
+		"younger ones may belong to an in-flight provision of another replica. 0 disables the sweep")
+	fs.Var(&c.requiredClassParams, "required-class-params", "Comma separated StorageClass parameters that must be set on every class routed here, provisioning fails listing the missing ones otherwise")
+	fs.Var(&c.requiredPVCLabels, "required-pvc-labels", "Comma separated labels (e.g. cost-center,team) every PVC must carry with a non-empty value, "+
+		"provisioning fails with a MissingRequiredLabels event listing the missing ones otherwise")
+	fs.Var(&c.maintenanceWindow, "maintenance-window", "Daily UTC window HH:MM-HH:MM (e.g. 22:00-04:00) outside of which the TTL reaper, archive pruning and the startup orphan GC wait; "+
+		"provisioning, PV deletes and POST /gc are not affected. Unset runs them at any time")
+	fs.BoolVar(&c.archiveCompress, "archive-compress", false, "Write volumes of archiveOnDelete classes to .archive under their base path as .tar.gz instead of moving the directory; "+
+		"backends that can't be moved (mounts) are always compressed")
+	fs.DurationVar(&c.archiveRetention, "archive-retention", 0, "Prune archives older than this, 0 keeps them forever")
+	fs.Var(&c.archiveMaxSize, "archive-max-size", "Prune the oldest archives while those under one base path together are larger than this")
+	fs.Var(&c.maxArchiveBytes, "max-archive-bytes", "Before archiving a volume, check the archives on its base path including it stay within this size, "+
+		"pruning the oldest first when --archive-retention or --archive-max-size enable pruning; see --archive-full for what happens if they still don't")
+	fs.StringVar(&c.archiveFull, "archive-full", archiveFullBlock, "What Delete does with a volume that doesn't fit under --max-archive-bytes: "+
+		"block fails the delete until there is room, delete removes the volume instead of archiving it, with an ArchiveFull warning event")
+	fs.DurationVar(&c.archivePruneInterval, "archive-prune-interval", time.Hour, "How often archives are checked against --archive-retention and --archive-max-size, inside the maintenance window")
+	fs.IntVar(&c.reconcileWorkers, "reconcile-workers", 4, "Directories the orphan scan checks in parallel")
+	fs.DurationVar(&c.reconcileTimeout, "reconcile-timeout", 5*time.Minute, "How long /readyz waits for the startup orphan scan before reporting ready anyway with a warning")
+	fs.BoolVar(&c.allowSkipSpaceCheck, "allow-skip-space-check", false, "Let PVCs annotated custom-provisioner/skip-space-check=true bypass the free space check and overcommit the base path")
+	fs.Var(&c.maxCommittedBytes, "max-committed-bytes", "Reschedule provisions once the capacity of all volumes on the base path together would exceed this (e.g. 2Ti), "+
+		"however much space is free; keeps room for the node OS. Unset means no ceiling")
+	fs.BoolVar(&c.checkTools, "check-tools", true, "At startup, exit listing any command the enabled backends run (btrfs, mount, mkfs.<type>, exportfs, gocryptfs, ...) that is missing from PATH")
+	fs.Var(&c.propagateAnnotationPrefixes, "propagate-annotation-prefixes", "Comma separated prefixes (e.g. backup.velero.io/) of PVC annotations copied onto the PV, "+
+		"custom-provisioner/ and Kubernetes' own PV annotations are never overwritten")
+	fs.StringVar(&c.pvNameConflict, "pv-name-conflict", pvNameConflictUniquify, "What to do when a PV named after the PVC already exists for another claim, e.g. after a crash: "+
+		"uniquify (append the PVC's UID to the name) or fail; a PV already bound to the PVC is always adopted")
+	fs.IntVar(&c.maxPVCNameLength, "max-pvc-name-length", 0, "Longest PVC name used as is in the PV name, see --long-pvc-names for longer ones; "+
+		"0 allows whatever still makes a valid PV name")
+	fs.StringVar(&c.longPVCNames, "long-pvc-names", longPVCNamesTruncate, "What to do with PVC names beyond --max-pvc-name-length: truncate (shorten the PV name and append the PVC's UID) "+
+		"or reject (fail the provision so the user picks a shorter name)")
+	fs.StringVar(&c.deletePreconditionFile, "delete-precondition-file", "", "File Delete waits for before removing a volume's data, e.g. one written by a backup job; "+
+		"a template using .PVName, .VolumePath, .PVCNamespace, .PVCName and .PVCUID such as /backups/{{.PVName}}.done. Empty deletes right away")
+	fs.BoolVar(&c.deletePreconditionAbsent, "delete-precondition-absent", false, "Wait for the --delete-precondition-file to be removed instead of created")
+	fs.DurationVar(&c.deletePreconditionTimeout, "delete-precondition-timeout", time.Minute, "How long one Delete waits for the precondition before failing, the controller retries it later")
+	fs.IntVar(&c.classProvisionWorkers, "class-provision-workers", 0, "Provisions of one StorageClass allowed to run at the same time unless the class sets the provisionWorkers parameter, "+
+		"so a class on a slow disk can't take every controller worker; provisions beyond it are deferred. 0 means no cap")
+	fs.BoolVar(&c.noDelete, "no-delete", false, "Never delete data: Delete only logs and succeeds whatever the reclaim policy, leaving the directory behind; "+
+		"also turns off --gc-orphans and archive pruning")
+	fs.StringVar(&c.volumeSource, "volume-source", volumeSourceHostPath, "Source type of the PVs of backends without one of their own: hostpath, "+
+		"or csi (a CSI source of --csi-driver with the directory as volume handle and path, size, backend and the class's csiAttribute.<name> parameters as attributes)")
+	fs.StringVar(&c.csiDriver, "csi-driver", "", "Driver name of the PVs with --volume-source=csi, a CSI node plugin of that name must mount the path attribute")
+	fs.Var(&c.namespaceReclaimOverrides, "namespace-reclaim-overrides", "Comma separated namespace=policy pairs (Delete or Retain), e.g. prod=Retain,dev=Delete, setting the reclaim policy of PVs "+
+		"in those namespaces. It wins over the class's reclaimPolicy field, which the API server defaults to Delete, and --default-reclaim-policy; "+
+		"the reclaimPolicy class parameter and the policy ConfigMap entry win over it")
+	fs.StringVar(&c.shutdownReport, "shutdown-report", "", "File a JSON summary of the session (provisions, deletes and errors, managed volumes, committed bytes, uptime) "+
+		"is written to on SIGTERM or SIGINT, disabled when empty")
+	fs.DurationVar(&c.shutdownDrainTimeout, "shutdown-drain-timeout", 30*time.Second, "How long shutdown waits for running provisions and deletes before exiting")
+	fs.Int64Var(&c.deleteProgressFiles, "delete-progress-files", removeProgressFiles, "Log the progress of a volume removal every this many removed files")
+	fs.DurationVar(&c.deleteProgressInterval, "delete-progress-interval", removeProgressInterval, "Log the progress of a volume removal at least this often")
+	fs.BoolVar(&c.allowCapacityOverride, "allow-capacity-override", false, "Let the PVC annotation custom-provisioner/pv-capacity set the capacity reported on the PV, "+
+		"e.g. for scheduler tests; the backing storage still follows the request and the PV is annotated custom-provisioner/capacity-overridden-from. "+
+		"A capacity below the request keeps the claim from binding")
+	fs.Var(&c.minFreeMemory, "min-free-memory", "Reschedule tmpfs volumes while the node's MemAvailable from /proc/meminfo is below this (e.g. 2Gi), "+
+		"so RAM backed volumes aren't made on a node under memory pressure; other backends are not affected. Unset means no check")
+	fs.Var(&c.forbiddenSubpaths, "forbidden-subpaths", "Comma separated paths relative to the base path (e.g. .system,backups) no volume may be provisioned into or deleted from, "+
+		"guarding base directories shared with other data")
+	fs.BoolVar(&c.emitReceipts, "emit-receipts", false, "Write a custom-provisioner-receipt-<pv> ConfigMap with the PV name, path, size and time into the PVC's namespace on provision, "+
+		"removed again when the volume is deleted; failing to write it only logs a warning")
+	fs.IntVar(&c.maxProvisionAttempts, "max-provision-attempts", 0, "Give up on a PVC after this many failed provision attempts, with a ProvisioningUnsatisfiable event, "+
+		"and fail its later attempts fast; waiting for a class slot and read-only mode don't count. 0 retries forever")
+	fs.DurationVar(&c.provisionAttemptsWindow, "provision-attempts-window", time.Hour, "How long the failed attempts of a PVC are remembered after the last one, "+
+		"a PVC given up on is tried again once this passed")
+	fs.Var(&c.basePathPool, "base-path-pool", "Comma separated id=path base paths (e.g. disk2=/mnt/disk2) a PVC can pin its volume to with the custom-provisioner/base-path-id annotation, "+
+		"for the hostpath, sparse-reserve and tmpfs backends; PVCs without the annotation use --base-path")
+	fs.BoolVar(&c.annotateMountInfo, "annotate-mount-info", false, "Annotate PVs with custom-provisioner/fs-type and custom-provisioner/mount-source of their base path, "+
+		"looked up once at startup from /proc/self/mounts")
+	fs.IntVar(&c.maxConcurrentScans, "max-concurrent-scans", 0, "Background tasks walking the disk allowed to run at once, shared by the usage scanner, orphan scans (including POST /gc), "+
+		"archive pruning and the staging sweep; the others wait their turn. 0 means no cap")
+	fs.BoolVar(&c.recreateMissingDirs, "recreate-missing-dirs", false, "At startup, recreate empty the missing directories of bound hostpath PVs of ours, "+
+		"with the mode and owner recorded on the PV, so pods can mount them again after e.g. a disk replacement; their data is lost and each one is logged")
+	fs.BoolVar(&c.phaseMetrics, "phase-metrics", false, "Record the latency of each provision phase (validation, space-check, mkdir, chown-mode, marker-write, rename, ...) "+
+		"in the provisioner_provision_phase_duration_seconds histogram")
+	fs.BoolVar(&c.dedupeProvisions, "dedupe-provisions", true, "Let a provision of a PVC that is already being provisioned wait for that attempt and return its result, "+
+		"instead of both racing on the same volume")
+	fs.BoolVar(&c.allowAdoption, "allow-adoption", false, "Adopt an existing hostpath volume directory containing a .custom-provisioner-external file as is: "+
+		"the PV points at it, nothing in it is created or changed, and Delete never removes it")
+	fs.IntVar(&c.maxConcurrentMkfs, "max-concurrent-mkfs", 0, "Loopback volume images formatted at once, the others wait their turn; independent of the provision workers. 0 means no cap")
+	fs.BoolVar(&c.readOnly, "read-only", false, "Start in read-only mode: new volumes are not provisioned but deletes still proceed, send SIGUSR1 to toggle")
+}
+
+// validate checks flag combinations that the flag package can't, values out of range are clamped with a warning
+func (c *provisionerConfig) validate() error {
+	if c.capacityPaddingPercent < 0 {
+		return fmt.Errorf("--capacity-padding-percent must not be negative")
+	}
+	if c.capacityPaddingPercent > maxCapacityPaddingPercent {
+		klog.Warningf("--capacity-padding-percent %d is above the maximum, using %d", c.capacityPaddingPercent, maxCapacityPaddingPercent)
+		c.capacityPaddingPercent = maxCapacityPaddingPercent
+	}
+	if c.identity == "" {
+		return fmt.Errorf("--identity must not be empty")
+	}
+	if errs := validation.IsDNS1123Subdomain(c.identity); len(errs) > 0 {
+		return fmt.Errorf("invalid --identity %q: %s", c.identity, strings.Join(errs, "; "))
+	}
+	if c.pinToNode && c.nodeName == "" {
+		return fmt.Errorf("--pin-to-node needs the node name, set --node-name or NODE_NAME")
+	}
+	if c.remoteTimeout <= 0 {
+		return fmt.Errorf("--remote-timeout must be positive")
+	}
+	switch corev1.PersistentVolumeReclaimPolicy(c.defaultReclaimPolicy) {
+	case corev1.PersistentVolumeReclaimDelete, corev1.PersistentVolumeReclaimRetain:
+	default:
+		return fmt.Errorf("invalid --default-reclaim-policy %q, must be Delete or Retain", c.defaultReclaimPolicy)
+	}
+	if mode, err := strconv.ParseUint(c.defaultDirMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("invalid --default-dir-mode %q, expected an octal permission like 0755", c.defaultDirMode)
+	}
+	if c.enableTTLReaper && c.ttlReaperInterval <= 0 {
+		return fmt.Errorf("--ttl-reaper-interval must be positive")
+	}
+	if c.noDelete && c.gcOrphans {
+		klog.Warningf("--no-delete is set, orphans are only reported despite --gc-orphans")
+		c.gcOrphans = false
+	}
+	if c.noDelete && (c.archiveRetention > 0 || c.archiveMaxSize.Quantity != nil) {
+		klog.Warningf("--no-delete is set, archives are never pruned despite --archive-retention or --archive-max-size")
+		c.archiveRetention, c.archiveMaxSize.Quantity = 0, nil
+	}
+	switch c.archiveFull {
+	case archiveFullBlock, archiveFullDelete:
+	default:
+		return fmt.Errorf("invalid --archive-full %q, must be %s or %s", c.archiveFull, archiveFullBlock, archiveFullDelete)
+	}
+	if (c.archiveRetention > 0 || c.archiveMaxSize.Quantity != nil) && c.archivePruneInterval <= 0 {
+		return fmt.Errorf("--archive-prune-interval must be positive")
+	}
+	if c.deleteProgressFiles <= 0 || c.deleteProgressInterval <= 0 {
+		return fmt.Errorf("--delete-progress-files and --delete-progress-interval must be positive")
+	}
+	if c.maxProvisionAttempts < 0 || c.provisionAttemptsWindow <= 0 {
+		return fmt.Errorf("--max-provision-attempts must not be negative and --provision-attempts-window must be positive")
+	}
+	for _, name := range c.requiredPVCLabels {
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			return fmt.Errorf("invalid --required-pvc-labels entry %q: %s", name, strings.Join(errs, "; "))
+		}
+	}
+	if c.maxConcurrentScans < 0 {
+		return fmt.Errorf("--max-concurrent-scans must not be negative")
+	}
+	if c.maxConcurrentMkfs < 0 {
+		return fmt.Errorf("--max-concurrent-mkfs must not be negative")
+	}
+	if c.classProvisionWorkers < 0 {
+		return fmt.Errorf("--class-provision-workers must not be negative")
+	}
+	if c.auditLogMaxSizeMB < 0 || c.auditLogMaxBackups < 0 {
+		return fmt.Errorf("--audit-log-max-size-mb and --audit-log-max-backups can't be negative")
+	}
+	for _, prefix := range c.propagateAnnotationPrefixes {
+		if reservedAnnotation(prefix) {
+			return fmt.Errorf("--propagate-annotation-prefixes can't include the reserved prefix %s", prefix)
+		}
+	}
+	forbidden, err := cleanSubpaths(c.forbiddenSubpaths)
+	if err != nil {
+		return err
+	}
+	c.forbiddenSubpaths = forbidden
+	if c.deletePreconditionFile != "" {
+		if _, err := parseDeletePrecondition(c.deletePreconditionFile); err != nil {
+			return err
+		}
+	}
+	switch c.volumeSource {
+	case volumeSourceHostPath:
+	case volumeSourceCSI:
+		if c.csiDriver == "" {
+			return fmt.Errorf("--volume-source=csi needs --csi-driver")
+		}
+		if errs := validation.IsDNS1123Subdomain(c.csiDriver); len(errs) > 0 {
+			return fmt.Errorf("invalid --csi-driver %q: %s", c.csiDriver, strings.Join(errs, "; "))
+		}
+	default:
+		return fmt.Errorf("invalid --volume-source %q, must be hostpath or csi", c.volumeSource)
+	}
+	switch c.pvNameConflict {
+	case pvNameConflictUniquify, pvNameConflictFail:
+	default:
+		return fmt.Errorf("invalid --pv-name-conflict %q, must be uniquify or fail", c.pvNameConflict)
+	}
+	switch c.longPVCNames {
+	case longPVCNamesTruncate, longPVCNamesReject:
+	default:
+		return fmt.Errorf("invalid --long-pvc-names %q, must be truncate or reject", c.longPVCNames)
+	}
+	if c.maxPVCNameLength < 0 || (c.maxPVCNameLength > 0 && c.maxPVCNameLength <= uidSuffixLength) {
+		return fmt.Errorf("--max-pvc-name-length must be 0 or above %d", uidSuffixLength)
+	}
+	switch c.nodeTaintSensitivity {
+	case taintSensitivityNone, taintSensitivityCordon, taintSensitivityNoSchedule:
+	default:
+		return fmt.Errorf("invalid --node-taint-sensitivity %q", c.nodeTaintSensitivity)
+	}
+	return nil
+}
+
+// annIdentity records on the PV which provisioner replica created it
+const annIdentity = "custom-provisioner/provisioned-by-identity"
+
+// defaultIdentity is the hostname, the pod name when running in a pod, lowercased to stay DNS-safe
+func defaultIdentity() string {
+	name, _ := os.Hostname()
+	return strings.ToLower(name)
+}
+
+// defaultParams returns the flag defaults in StorageClass parameter form, only for the ones that are set
+func (c *provisionerConfig) defaultParams() map[string]string {
+	params := map[string]string{paramDirMode: c.defaultDirMode}
+	if c.defaultMinSize.Quantity != nil {
+		params[paramMinSize] = c.defaultMinSize.String()
+	}
+	if c.defaultMaxSize.Quantity != nil {
+		params[paramMaxSize] = c.defaultMaxSize.String()
+	}
+	return params
+}
+
+// redacted stands in for secrets and credential locations in the /config output
+const redacted = "<redacted>"
+
+// effective returns the resolved settings keyed by flag name for the /config endpoint. Values are the ones in
+// effect, e.g. the rendered base path rather than its template, and anything pointing at credentials is redacted.
+func (c *provisionerConfig) effective() map[string]interface{} {
+	var absoluteMaxSize string
+	if c.absoluteMaxSize.Quantity != nil {
+		absoluteMaxSize = c.absoluteMaxSize.String()
+	}
+	remoteTokenFile := ""
+	if c.remoteTokenFile != "" {
+		remoteTokenFile = redacted
+	}
+	encryptionKeySource := ""
+	if c.encryptionKeySource != "" {
+		// Only the kind of source, its location points at key material
+		kind, _, _ := strings.Cut(c.encryptionKeySource, ":")
+		encryptionKeySource = kind + ":" + redacted
+	}
+	return map[string]interface{}{
+		"base-path":                     c.basePath,
+		"identity":                      c.identity,
+		"node-name":                     c.nodeName,
+		"backend":                       c.backend,
+		"allowed-backends":              []string(c.allowedBackends),
+		"overlay-lower":                 c.overlayLower,
+		"loopback-fs-type":              c.loopbackFSType,
+		"check-free-space":              c.checkFreeSpace,
+		"min-free-inodes":               c.minFreeInodes,
+		"pv-labels":                     map[string]string(c.pvLabels),
+		"max-delete-attempts":           c.maxDeleteAttempts,
+		"write-marker":                  c.writeMarker,
+		"prefer-static-binding":         c.preferStaticBinding,
+		"capacity-padding-percent":      c.capacityPaddingPercent,
+		"gc-orphans":                    c.gcOrphans,
+		"pin-to-node":                   c.pinToNode,
+		"node-taint-sensitivity":        c.nodeTaintSensitivity,
+		"fsync-on-create":               c.fsyncOnCreate,
+		"fs-op-timeout":                 c.fsOpTimeout.String(),
+		"max-concurrent-deletes":        c.maxConcurrentDeletes,
+		"verify-marker-on-delete":       c.verifyMarkerOnDelete,
+		"remote-agent-port":             c.remoteAgentPort,
+		"remote-token-file":             remoteTokenFile,
+		"remote-ca-file":                c.remoteCAFile,
+		"remote-timeout":                c.remoteTimeout.String(),
+		"absolute-max-size":             absoluteMaxSize,
+		"strict-access-modes":           c.strictAccessModes,
+		"access-mode-matrix":            c.accessModeMatrix.String(),
+		"inherit-parent-group":          c.inheritParentGroup,
+		"provision-timeout":             c.provisionTimeout.String(),
+		"skeleton-dir":                  c.skeletonDir,
+		"min-provision-interval":        c.minProvisionInterval.String(),
+		"nfs-server":                    c.nfsServer,
+		"nfs-export-options":            c.nfsExportOptions,
+		"nfs-exports-file":              c.nfsExportsFile,
+		"annotation-update-rate":        c.annotationUpdateRate,
+		"default-reclaim-policy":        c.defaultReclaimPolicy,
+		"default-dir-mode":              c.defaultDirMode,
+		"default-min-size":              c.defaultMinSize.String(),
+		"default-max-size":              c.defaultMaxSize.String(),
+		"skeleton-mode-mask":            c.skeletonModeMask.String(),
+		"enable-ttl-reaper":             c.enableTTLReaper,
+		"ttl-reaper-interval":           c.ttlReaperInterval.String(),
+		"encryption-key-source":         encryptionKeySource,
+		"stale-volume-grace":            c.staleVolumeGrace.String(),
+		"audit-log":                     c.auditLog,
+		"audit-log-max-size-mb":         c.auditLogMaxSizeMB,
+		"audit-log-max-backups":         c.auditLogMaxBackups,
+		"mount-probe-interval":          c.mountProbeInterval.String(),
+		"staging-max-age":               c.stagingMaxAge.String(),
+		"required-class-params":         []string(c.requiredClassParams),
+		"required-pvc-labels":           []string(c.requiredPVCLabels),
+		"maintenance-window":            c.maintenanceWindow.String(),
+		"archive-compress":              c.archiveCompress,
+		"archive-retention":             c.archiveRetention.String(),
+		"archive-max-size":              c.archiveMaxSize.String(),
+		"archive-prune-interval":        c.archivePruneInterval.String(),
+		"max-archive-bytes":             c.maxArchiveBytes.String(),
+		"archive-full":                  c.archiveFull,
+		"reconcile-workers":             c.reconcileWorkers,
+		"reconcile-timeout":             c.reconcileTimeout.String(),
+		"allow-skip-space-check":        c.allowSkipSpaceCheck,
+		"max-committed-bytes":           c.maxCommittedBytes.String(),
+		"check-tools":                   c.checkTools,
+		"propagate-annotation-prefixes": []string(c.propagateAnnotationPrefixes),
+		"pv-name-conflict":              c.pvNameConflict,
+		"max-pvc-name-length":           c.maxPVCNameLength,
+		"long-pvc-names":                c.longPVCNames,
+		"delete-precondition-file":      c.deletePreconditionFile,
+		"delete-precondition-absent":    c.deletePreconditionAbsent,
+		"delete-precondition-timeout":   c.deletePreconditionTimeout.String(),
+		"class-provision-workers":       c.classProvisionWorkers,
+		"no-delete":                     c.noDelete,
+		"volume-source":                 c.volumeSource,
+		"csi-driver":                    c.csiDriver,
+		"namespace-reclaim-overrides":   c.namespaceReclaimOverrides.String(),
+		"shutdown-report":               c.shutdownReport,
+		"shutdown-drain-timeout":        c.shutdownDrainTimeout.String(),
+		"delete-progress-files":         c.deleteProgressFiles,
+		"delete-progress-interval":      c.deleteProgressInterval.String(),
+		"allow-capacity-override":       c.allowCapacityOverride,
+		"min-free-memory":               c.minFreeMemory.String(),
+		"forbidden-subpaths":            []string(c.forbiddenSubpaths),
+		"emit-receipts":                 c.emitReceipts,
+		"max-provision-attempts":        c.maxProvisionAttempts,
+		"provision-attempts-window":     c.provisionAttemptsWindow.String(),
+		"base-path-pool":                map[string]string(c.basePathPool),
+		"annotate-mount-info":           c.annotateMountInfo,
+		"max-concurrent-scans":          c.maxConcurrentScans,
+		"recreate-missing-dirs":         c.recreateMissingDirs,
+		"phase-metrics":                 c.phaseMetrics,
+		"dedupe-provisions":             c.dedupeProvisions,
+		"allow-adoption":                c.allowAdoption,
+		"max-concurrent-mkfs":           c.maxConcurrentMkfs,
+		"read-only":                     c.readOnly,
+	}
+}
+
+// missingClassParams returns the required StorageClass parameters absent from params, in flag order
+func (c *provisionerConfig) missingClassParams(params map[string]string) []string {
+	var missing []string
+	for _, name := range c.requiredClassParams {
+		if _, ok := params[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// missingPVCLabels returns the required PVC labels absent or empty in labels
+func (c *provisionerConfig) missingPVCLabels(labels map[string]string) []string {
+	var missing []string
+	for _, name := range c.requiredPVCLabels {
+		if labels[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// backendAllowed reports whether PVCs may select the named backend
+func (c *provisionerConfig) backendAllowed(name string) bool {
+	for _, allowed := range c.allowedBackends {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listFlag parses a comma separated list, empty items are dropped
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*l = items
+	return nil
+}
+
+// quantityFlag parses a resource quantity such as 100Gi, the zero value means unset
+type quantityFlag struct {
+	*resource.Quantity
+}
+
+func (q *quantityFlag) String() string {
+	if q.Quantity == nil {
+		return ""
+	}
+	return q.Quantity.String()
+}
+
+func (q *quantityFlag) Set(value string) error {
+	parsed, err := resource.ParseQuantity(value)
+	if err != nil {
+		return err
+	}
+	if parsed.Sign() <= 0 {
+		return fmt.Errorf("size must be positive")
+	}
+	q.Quantity = &parsed
+	return nil
+}
+
+// reclaimOverridesFlag parses namespace=policy,namespace=policy into a reclaim policy per namespace
+type reclaimOverridesFlag map[string]corev1.PersistentVolumeReclaimPolicy
+
+func (r *reclaimOverridesFlag) String() string {
+	pairs := make([]string, 0, len(*r))
+	for ns, policy := range *r {
+		pairs = append(pairs, ns+"="+string(policy))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (r *reclaimOverridesFlag) Set(value string) error {
+	overrides := map[string]corev1.PersistentVolumeReclaimPolicy{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		ns, policy, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("override %q is not in namespace=policy form", pair)
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q: %s", ns, strings.Join(errs, "; "))
+		}
+		switch rp := corev1.PersistentVolumeReclaimPolicy(policy); rp {
+		case corev1.PersistentVolumeReclaimDelete, corev1.PersistentVolumeReclaimRetain:
+			overrides[ns] = rp
+		default:
+			return fmt.Errorf("invalid reclaim policy %q for namespace %s, must be Delete or Retain", policy, ns)
+		}
+	}
+	*r = overrides
+	return nil
+}
+
+// modeFlag parses an octal permission such as 0755, the zero value means unset
+type modeFlag struct {
+	mode os.FileMode
+	set  bool
+}
+
+func (m *modeFlag) String() string {
+	if !m.set {
+		return ""
+	}
+	return fmt.Sprintf("%04o", m.mode)
+}
+
+func (m *modeFlag) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("expected an octal permission like 0755")
+	}
+	m.mode, m.set = os.FileMode(mode), true
+	return nil
+}
+
+// apply masks the permission bits of mode, returning them unchanged when the flag is unset
+func (m *modeFlag) apply(mode os.FileMode) os.FileMode {
+	if !m.set {
+		return mode
+	}
+	return mode & m.mode
+}
+
+// labelsFlag parses key=value,key=value into a label map, rejecting keys and values Kubernetes wouldn't accept
+type labelsFlag map[string]string
+
+func (l *labelsFlag) String() string {
+	pairs := make([]string, 0, len(*l))
+	for k, v := range *l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l *labelsFlag) Set(value string) error {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, val, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("label %q is not in key=value form", pair)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(val); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q for label %s: %s", val, key, strings.Join(errs, "; "))
+		}
+		labels[key] = val
+	}
+	*l = labels
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// parseTestFlags parses args into a config with a temporary base path and validates it
+func parseTestFlags(t *testing.T, args ...string) (provisionerConfig, error) {
+	t.Helper()
+	var c provisionerConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.addFlags(fs)
+	c.basePath = t.TempDir()
+	c.realBasePath = c.basePath
+	c.nodeName = ""
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("parsing %v: %v", args, err)
+	}
+	return c, c.validate()
+}
+
+func TestValidateIdentity(t *testing.T) {
+	tests := []struct {
+		identity string
+		valid    bool
+	}{
+		{"provisioner-0", true},
+		{"node-1.example.com", true},
+		{"", false},
+		{"Provisioner_0", false},
+		{"-provisioner", false},
+		{strings.Repeat("a", 254), false},
+	}
+	for _, tt := range tests {
+		_, err := parseTestFlags(t, "--identity="+tt.identity)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("--identity=%q: validate = %v, want valid %v", tt.identity, err, tt.valid)
+		}
+		if err != nil && !strings.Contains(err.Error(), "--identity") {
+			t.Errorf("--identity=%q: error %q doesn't name the flag", tt.identity, err)
+		}
+	}
+}
+
+func TestValidateDefaultIdentity(t *testing.T) {
+	c, err := parseTestFlags(t)
+	if err != nil {
+		t.Skipf("the hostname doesn't make a valid identity here: %v", err)
+	}
+	if c.identity != defaultIdentity() {
+		t.Errorf("identity = %q, want the lowercased hostname %q", c.identity, defaultIdentity())
+	}
+}
+
+func TestProvisionRecordsIdentity(t *testing.T) {
+	config, err := parseTestFlags(t, "--identity=replica-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProvisioner(t, config, nil)
+	pv := provisionTestVolume(t, p, testPVC("default", "identified"))
+	if got := pv.Annotations[annIdentity]; got != "replica-1" {
+		t.Errorf("%s = %q, want replica-1", annIdentity, got)
+	}
+}
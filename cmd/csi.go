@@ -0,0 +1,44 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// Values of --volume-source
+const (
+	volumeSourceHostPath = "hostpath"
+	volumeSourceCSI      = "csi"
+)
+
+const (
+	// paramCSIAttributePrefix marks StorageClass parameters copied into the CSI volume attributes with the prefix
+	// removed, e.g. csiAttribute.tier: fast becomes tier: fast
+	paramCSIAttributePrefix = "csiAttribute."
+	// csiSizeAttribute and csiBackendAttribute carry the requested size and the backend that made the volume
+	csiSizeAttribute    = "size"
+	csiBackendAttribute = "backend"
+)
+
+// csiVolumeSource exposes the directory at path as a CSI volume of --csi-driver, for tooling that expects CSI
+// volume attributes on every PV. The handle is the directory, and the path attribute names it too, which is what
+// Delete goes by.
+func (p *customProvisioner) csiVolumeSource(path, backend, size string, params map[string]string) corev1.PersistentVolumeSource {
+	attributes := map[string]string{}
+	for k, v := range params {
+		if name := strings.TrimPrefix(k, paramCSIAttributePrefix); name != k && name != "" {
+			attributes[name] = v
+		}
+	}
+	// Ours are set last, a class can't point Delete somewhere else through the path attribute
+	attributes[csiSizeAttribute] = size
+	attributes[csiBackendAttribute] = backend
+	attributes[csiPathAttribute] = path
+	return corev1.PersistentVolumeSource{
+		CSI: &corev1.CSIPersistentVolumeSource{
+			Driver:           p.config.csiDriver,
+			VolumeHandle:     path,
+			VolumeAttributes: attributes,
+		},
+	}
+}
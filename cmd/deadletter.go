@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"strconv"
+)
+
+const (
+	// annDeleteAttempts counts failed deletes of a PV, kept on the PV so it survives provisioner restarts
+	annDeleteAttempts = "custom-provisioner/delete-attempts"
+	// annDeleteFailed marks a PV whose deletion was given up on, remove it to let the provisioner try again
+	annDeleteFailed = "custom-provisioner/delete-failed"
+)
+
+// maxDeleteFailedReasonLength keeps the dead-letter annotation readable when a tool dumps a lot of output
+const maxDeleteFailedReasonLength = 256
+
+// abandonedDelete reports whether a previous Delete gave up on the volume, operators clear annDeleteFailed to retry
+func abandonedDelete(volume *corev1.PersistentVolume) error {
+	if reason, ok := volume.Annotations[annDeleteFailed]; ok {
+		return &controller.IgnoredError{Reason: fmt.Sprintf("deleting volume %s was abandoned earlier: %s", volume.Name, reason)}
+	}
+	return nil
+}
+
+// recordDeleteFailure bumps the attempt counter on the PV and, once --max-delete-attempts is reached, dead-letters it.
+// It returns the error Delete should return: deleteErr while retries are left, an IgnoredError once the PV is
+// dead-lettered so the controller stops retrying but keeps the PV around for an operator to look at.
+func (p *customProvisioner) recordDeleteFailure(ctx context.Context, volume *corev1.PersistentVolume, deleteErr error) error {
+	if p.config.maxDeleteAttempts <= 0 {
+		return deleteErr
+	}
+
+	attempts, _ := strconv.Atoi(volume.Annotations[annDeleteAttempts])
+	attempts++
+	count := strconv.Itoa(attempts)
+	if attempts < p.config.maxDeleteAttempts {
+		if err := p.queuePVAnnotations(ctx, volume.Name, map[string]*string{annDeleteAttempts: &count}); err != nil {
+			klog.Errorf("Failed to record delete attempt %d of volume %s: %v", attempts, volume.Name, err)
+		}
+		return deleteErr
+	}
+
+	reason := deleteErr.Error()
+	if len(reason) > maxDeleteFailedReasonLength {
+		reason = reason[:maxDeleteFailedReasonLength]
+	}
+	if err := p.patchPVAnnotations(ctx, volume.Name, map[string]*string{annDeleteAttempts: &count, annDeleteFailed: &reason}); err != nil {
+		// Keep retrying until the dead-letter mark is persisted, otherwise the next restart would start over silently
+		klog.Errorf("Failed to mark volume %s as failed to delete: %v", volume.Name, err)
+		return deleteErr
+	}
+
+	klog.Errorf("Giving up deleting volume %s after %d attempts: %v", volume.Name, attempts, deleteErr)
+	p.recorder.Eventf(volume, corev1.EventTypeWarning, "VolumeDeleteAbandoned",
+		"Giving up deleting volume after %d attempts, remove the %s annotation to retry: %v", attempts, annDeleteFailed, deleteErr)
+	return &controller.IgnoredError{Reason: fmt.Sprintf("delete of volume %s failed %d times", volume.Name, attempts)}
+}
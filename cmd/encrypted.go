@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	encryptedBackendName = "encrypted"
+	// encryptedCipherDir holds the gocryptfs cipher directory of every volume, next to the plain ones
+	encryptedCipherDir = ".encrypted"
+)
+
+// volumeKeySource hands out the passphrase of a single volume. Keys are secrets: they only ever travel on a
+// tool's stdin, never on command lines, in errors or in logs.
+type volumeKeySource interface {
+	volumeKey(ctx context.Context, volumeName string) ([]byte, error)
+}
+
+// newVolumeKeySource parses --encryption-key-source: file:<path> or secret:<namespace>/<name>/<key> hold a master
+// key every volume key is derived from, command:<path> runs a KMS helper printing the key of the volume it is
+// given as its only argument
+func newVolumeKeySource(source string, client kubernetes.Interface) (volumeKeySource, error) {
+	kind, ref, _ := strings.Cut(source, ":")
+	switch kind {
+	case "file":
+		if ref == "" {
+			return nil, fmt.Errorf("file key source needs a path")
+		}
+		return &masterKeySource{load: func(ctx context.Context) ([]byte, error) {
+			data, err := os.ReadFile(ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read master key file %s: %v", ref, err)
+			}
+			return bytes.TrimSpace(data), nil
+		}}, nil
+	case "secret":
+		parts := strings.Split(ref, "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("secret key source must be secret:<namespace>/<name>/<key>")
+		}
+		if client == nil {
+			return nil, fmt.Errorf("secret key source needs a Kubernetes client")
+		}
+		return &masterKeySource{load: func(ctx context.Context) ([]byte, error) {
+			secret, err := client.CoreV1().Secrets(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get master key secret %s/%s: %v", parts[0], parts[1], err)
+			}
+			key, ok := secret.Data[parts[2]]
+			if !ok {
+				return nil, fmt.Errorf("secret %s/%s has no key %s", parts[0], parts[1], parts[2])
+			}
+			return bytes.TrimSpace(key), nil
+		}}, nil
+	case "command":
+		if ref == "" {
+			return nil, fmt.Errorf("command key source needs a path")
+		}
+		return &commandKeySource{command: ref}, nil
+	default:
+		return nil, fmt.Errorf("unknown key source %q, expected file:, secret: or command:", source)
+	}
+}
+
+// masterKeySource derives every volume key from one master key with HMAC-SHA256 over the volume name, so keys
+// never need to be stored per volume. The master key is loaded on every use so rotating the file or Secret
+// doesn't need a restart, already created volumes keep needing the old one though.
+type masterKeySource struct {
+	load func(ctx context.Context) ([]byte, error)
+}
+
+func (s *masterKeySource) volumeKey(ctx context.Context, volumeName string) ([]byte, error) {
+	master, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(master) < 16 {
+		return nil, fmt.Errorf("master key is too short, it needs at least 16 bytes")
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(volumeName))
+	return []byte(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// commandKeySource asks an external KMS helper for the key of each volume
+type commandKeySource struct {
+	command string
+}
+
+func (s *commandKeySource) volumeKey(ctx context.Context, volumeName string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, volumeName)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// stdout may hold (part of) a key, only stderr is worth reporting
+		return nil, fmt.Errorf("key helper %s failed: %v: %s", s.command, err, strings.TrimSpace(stderr.String()))
+	}
+	key := bytes.TrimSpace(stdout.Bytes())
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key helper %s printed no key", s.command)
+	}
+	return key, nil
+}
+
+// encryptedBackend mounts every volume as a gocryptfs filesystem. The cipher directory lives under
+// <base>/.encrypted/<volume> and the decrypted view is mounted at the volume path, so like the overlay backend
+// it needs a privileged container with Bidirectional mount propagation.
+type encryptedBackend struct {
+	basePath string
+	keys     volumeKeySource
+}
+
+func newEncryptedBackend(config provisionerConfig, client kubernetes.Interface) (*encryptedBackend, error) {
+	if config.encryptionKeySource == "" {
+		return nil, fmt.Errorf("the encrypted backend needs --encryption-key-source")
+	}
+	keys, err := newVolumeKeySource(config.encryptionKeySource, client)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath("gocryptfs"); err != nil {
+		return nil, fmt.Errorf("the encrypted backend needs gocryptfs: %v", err)
+	}
+	return &encryptedBackend{basePath: config.basePath, keys: keys}, nil
+}
+
+func (b *encryptedBackend) Name() string {
+	return encryptedBackendName
+}
+
+func (b *encryptedBackend) cipherDir(path string) string {
+	return filepath.Join(b.basePath, encryptedCipherDir, filepath.Base(path))
+}
+
+func (b *encryptedBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	key, err := b.keys.volumeKey(ctx, filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to get volume key: %v", err)
+	}
+
+	cipher := b.cipherDir(path)
+	for _, dir := range []string{cipher, path} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			os.RemoveAll(cipher)
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	// gocryptfs reads the passphrase from stdin when it isn't a terminal
+	if err := runCommandWithInput(ctx, key, "gocryptfs", "-init", "-q", cipher); err != nil {
+		b.cleanup(path, cipher)
+		return err
+	}
+	if err := runCommandWithInput(ctx, key, "gocryptfs", "-q", "-allow_other", cipher, path); err != nil {
+		b.cleanup(path, cipher)
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		b.Delete(ctx, path)
+		return fmt.Errorf("failed to set mode on volume directory: %v", err)
+	}
+	return nil
+}
+
+// Resume mounts the cipher directory again when the mount is gone, with the same key as on create
+func (b *encryptedBackend) Resume(ctx context.Context, path string) error {
+	mounted, err := isMountPoint(path)
+	if err != nil || mounted {
+		return err
+	}
+	cipher := b.cipherDir(path)
+	if _, err := os.Stat(filepath.Join(cipher, "gocryptfs.conf")); err != nil {
+		return fmt.Errorf("cipher directory %s is not initialized: %v", cipher, err)
+	}
+	key, err := b.keys.volumeKey(ctx, filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to get volume key: %v", err)
+	}
+	return runCommandWithInput(ctx, key, "gocryptfs", "-q", "-allow_other", cipher, path)
+}
+
+func (b *encryptedBackend) Delete(ctx context.Context, path string) error {
+	mounted, err := isMountPoint(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := runCommand(ctx, "fusermount", "-u", path); err != nil {
+			return err
+		}
+	}
+	return b.cleanup(path, b.cipherDir(path))
+}
+
+// cleanup removes the plain and the cipher directory of a volume that isn't mounted
+func (b *encryptedBackend) cleanup(path, cipher string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return os.RemoveAll(cipher)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// cleanSubpaths checks the --forbidden-subpaths entries are relative to the base path without leaving it and
+// returns them cleaned
+func cleanSubpaths(subpaths []string) ([]string, error) {
+	cleaned := make([]string, 0, len(subpaths))
+	for _, subpath := range subpaths {
+		clean := filepath.Clean(subpath)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("--forbidden-subpaths entry %q must be a path below the base path, e.g. .system", subpath)
+		}
+		cleaned = append(cleaned, clean)
+	}
+	return cleaned, nil
+}
+
+// forbiddenSubpath returns the forbidden subpath that path is, lies in or contains, so neither creating nor
+// removing path can touch it. Paths are compared to the base path as configured and with its symlinks resolved,
+// PVs may record either.
+func forbiddenSubpath(path, basePath, realBasePath string, forbidden []string) (string, bool) {
+	if len(forbidden) == 0 {
+		return "", false
+	}
+	path = filepath.Clean(path)
+	for _, base := range []string{basePath, realBasePath} {
+		if base == "" {
+			continue
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		for _, subpath := range forbidden {
+			if rel == "." || rel == subpath || strings.HasPrefix(rel, subpath+"/") || strings.HasPrefix(subpath, rel+"/") {
+				return subpath, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkForbidden refuses path when it touches one of the --forbidden-subpaths
+func (p *customProvisioner) checkForbidden(path string) error {
+	if subpath, ok := forbiddenSubpath(path, p.config.basePath, p.config.realBasePath, p.config.forbiddenSubpaths); ok {
+		return fmt.Errorf("volume path %s touches %s, which --forbidden-subpaths protects", path, filepath.Join(p.config.basePath, subpath))
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// syncDir fsyncs a directory so the entries created in it survive a crash. Some filesystems don't support
+// fsync on directories and answer EINVAL or ENOTSUP, there is nothing more we can do there so those are ignored.
+func syncDir(path string) error {
+	klog.V(logFSSteps).Infof("Fsyncing %s", path)
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for fsync: %v", path, err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return fmt.Errorf("failed to fsync %s: %v", path, err)
+	}
+	return nil
+}
+
+// annDurable on a PVC chooses whether its new volume is fsynced before the PV is created, whatever
+// --fsync-on-create says, and is set on the PV to what was done
+const annDurable = "custom-provisioner/durable"
+
+// volumeDurable returns whether the PVC's volume is fsynced on create: as annDurable asks, --fsync-on-create without it
+func volumeDurable(pvc *corev1.PersistentVolumeClaim, fsyncOnCreate bool) (bool, error) {
+	v, ok := pvc.Annotations[annDurable]
+	if !ok {
+		return fsyncOnCreate, nil
+	}
+	durable, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q, expected true or false", annDurable, v)
+	}
+	return durable, nil
+}
+
+// volumeUnderBase reports whether path is a direct child of the base path. The base path may be a symlink, so
+// besides the configured path the parent is compared against realBasePath, the base path with symlinks
+// resolved, which also catches PVs written through another path to the same directory.
+func volumeUnderBase(path, basePath, realBasePath string) bool {
+	dir := filepath.Dir(filepath.Clean(path))
+	if dir == filepath.Clean(basePath) {
+		return true
+	}
+	if realBasePath == "" {
+		return false
+	}
+	if dir == realBasePath {
+		return true
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	return err == nil && real == realBasePath
+}
+
+// inheritParentGroup gives path the group of parent, the directory it ends up in, and sets the setgid bit, so files
+// pods create in the volume land in that group. A parent whose group can't be determined is only logged, the volume
+// stays usable.
+func inheritParentGroup(path, parent string) error {
+	info, err := os.Stat(parent)
+	if err != nil {
+		klog.Warningf("Can't read the group of %s, not inheriting it on %s: %v", parent, path, err)
+		return nil
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		klog.Warningf("Can't read the group of %s, not inheriting it on %s", parent, path)
+		return nil
+	}
+
+	if err := os.Lchown(path, -1, int(stat.Gid)); err != nil {
+		return fmt.Errorf("failed to set group %d on %s: %v", stat.Gid, path, err)
+	}
+	// Chown may clear setgid, so set it afterwards keeping the permission bits already on the directory
+	current, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, current.Mode().Perm()|os.ModeSetgid); err != nil {
+		return fmt.Errorf("failed to set the setgid bit on %s: %v", path, err)
+	}
+	return nil
+}
+
+// isMountPoint reports whether path is listed as a mount point in /proc/self/mounts
+func isMountPoint(path string) (bool, error) {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return false, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	path = filepath.Clean(path)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// Spaces and other special characters in mount points are octal escaped in the mount table
+		if len(fields) >= 2 && unescapeMountPath(fields[1]) == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+const (
+	// annFSType and annMountSource record on the PV the filesystem type and device of its base path
+	annFSType      = "custom-provisioner/fs-type"
+	annMountSource = "custom-provisioner/mount-source"
+)
+
+// mountInfo is the filesystem a path lives on as the mount table lists it
+type mountInfo struct {
+	fsType string
+	source string
+}
+
+// mountOf returns the mount holding path, the longest mount point in /proc/self/mounts that is path or one of its
+// parents. Symlinks are resolved first, the mount table only knows real paths.
+func mountOf(path string) (mountInfo, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return mountInfo{}, err
+	}
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	var found mountInfo
+	longest := -1
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[1])
+		if mountPoint != "/" && real != mountPoint && !strings.HasPrefix(real, mountPoint+"/") {
+			continue
+		}
+		// Later entries stacked on the same mount point hide earlier ones
+		if len(mountPoint) >= longest {
+			longest = len(mountPoint)
+			found = mountInfo{fsType: fields[2], source: unescapeMountPath(fields[0])}
+		}
+	}
+	if longest < 0 {
+		return mountInfo{}, fmt.Errorf("no mount holds %s", real)
+	}
+	return found, nil
+}
+
+// unescapeMountPath decodes the \040 style escapes used in /proc/self/mounts
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// fsTimeoutError is returned when a filesystem operation didn't finish within --fs-op-timeout
+type fsTimeoutError struct {
+	op      string
+	path    string
+	timeout time.Duration
+}
+
+func (e *fsTimeoutError) Error() string {
+	return fmt.Sprintf("%s %s did not finish within %v", e.op, e.path, e.timeout)
+}
+
+func isFSTimeout(err error) bool {
+	var te *fsTimeoutError
+	return errors.As(err, &te)
+}
+
+// fsAbortedError is returned when a filesystem operation was given up on because its context ended, e.g. at the
+// --provision-timeout deadline. Like after a timeout the operation may still be running.
+type fsAbortedError struct {
+	op   string
+	path string
+	err  error
+}
+
+func (e *fsAbortedError) Error() string {
+	return fmt.Sprintf("%s %s aborted: %v", e.op, e.path, e.err)
+}
+
+func (e *fsAbortedError) Unwrap() error {
+	return e.err
+}
+
+// isFSAbandoned reports whether the filesystem operation that returned err was given up on, by --fs-op-timeout or
+// its context ending, and so may still be running
+func isFSAbandoned(err error) bool {
+	var ae *fsAbortedError
+	return isFSTimeout(err) || errors.As(err, &ae)
+}
+
+// fsOp runs fn, giving up after --fs-op-timeout so a hung NFS server or a dying disk can't block a controller
+// worker forever, or earlier when ctx ends (e.g. at the --provision-timeout deadline). A hung syscall can't be
+// interrupted, so on timeout fn keeps running in its goroutine; the result channel is buffered so that goroutine
+// exits as soon as the call returns instead of blocking on the send.
+func (p *customProvisioner) fsOp(ctx context.Context, op, path string, fn func() error) error {
+	return p.fsOpWithCleanup(ctx, op, path, fn, nil)
+}
+
+// fsOpWithCleanup is fsOp with a cleanup that runs once an abandoned fn has finished, so whatever it left behind
+// is removed only after it stopped touching it
+func (p *customProvisioner) fsOpWithCleanup(ctx context.Context, op, path string, fn func() error, cleanup func()) error {
+	start := time.Now()
+	klog.V(logFSSteps).Infof("Filesystem operation %s on %s starting", op, path)
+	err := p.runFSOp(ctx, op, path, fn, cleanup)
+	klog.V(logFSSteps).Infof("Filesystem operation %s on %s finished after %v: %v", op, path, time.Since(start), err)
+	return err
+}
+
+func (p *customProvisioner) runFSOp(ctx context.Context, op, path string, fn func() error, cleanup func()) error {
+	if p.config.fsOpTimeout <= 0 && ctx.Done() == nil {
+		return fn()
+	}
+
+	parent := ctx
+	if p.config.fsOpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.fsOpTimeout)
+		defer cancel()
+	}
+
+	// Whoever notices first that fn finished after being abandoned runs the cleanup, exactly once
+	var cleanupOnce sync.Once
+	runCleanup := func() {
+		if cleanup != nil {
+			cleanupOnce.Do(func() {
+				klog.Infof("Abandoned %s on %s finished, cleaning up", op, path)
+				cleanup()
+			})
+		}
+	}
+
+	done := make(chan error, 1)
+	abandoned := make(chan struct{})
+	go func() {
+		done <- fn()
+		select {
+		case <-abandoned:
+			runCleanup()
+		default:
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The goroutine may finish right now, either it sees abandoned closed or we see its result
+		close(abandoned)
+		select {
+		case <-done:
+			runCleanup()
+		default:
+		}
+		if parent.Err() != nil {
+			klog.Warningf("Filesystem operation %s on %s aborted: %v", op, path, parent.Err())
+			return &fsAbortedError{op: op, path: path, err: parent.Err()}
+		}
+		klog.Warningf("Filesystem operation %s on %s timed out after %v, abandoning it", op, path, p.config.fsOpTimeout)
+		return &fsTimeoutError{op: op, path: path, timeout: p.config.fsOpTimeout}
+	}
+}
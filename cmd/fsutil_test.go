@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// symlinkedBase returns a base path that is a symlink, and the directory it resolves to
+func symlinkedBase(t *testing.T) (string, string) {
+	t.Helper()
+	real, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "base")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+	return link, real
+}
+
+func TestVolumeUnderSymlinkedBase(t *testing.T) {
+	link, real := symlinkedBase(t)
+	alias := filepath.Join(t.TempDir(), "alias")
+	if err := os.Symlink(real, alias); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(link, "pv-a"), true},
+		{filepath.Join(real, "pv-a"), true},
+		{filepath.Join(alias, "pv-a"), true},
+		{filepath.Join(real, "sub", "pv-a"), false},
+		{filepath.Join(t.TempDir(), "pv-a"), false},
+	}
+	for _, tt := range tests {
+		if got := volumeUnderBase(tt.path, link, real); got != tt.want {
+			t.Errorf("volumeUnderBase(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	// Without a resolved path only the configured one counts
+	if volumeUnderBase(filepath.Join(real, "pv-a"), link, "") {
+		t.Errorf("volumeUnderBase accepted the resolved path without a realBasePath")
+	}
+}
+
+func TestForbiddenSubpathThroughSymlinkedBase(t *testing.T) {
+	link, real := symlinkedBase(t)
+	forbidden := []string{".system"}
+	for _, path := range []string{filepath.Join(link, ".system"), filepath.Join(real, ".system", "x"), real} {
+		if _, ok := forbiddenSubpath(path, link, real, forbidden); !ok {
+			t.Errorf("forbiddenSubpath(%s) allowed a protected path", path)
+		}
+	}
+	if subpath, ok := forbiddenSubpath(filepath.Join(real, "pv-a"), link, real, forbidden); ok {
+		t.Errorf("forbiddenSubpath(pv-a) = %s, want it allowed", subpath)
+	}
+}
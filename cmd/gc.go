@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// orphanGracePeriod protects volumes whose PV the controller may still be persisting
+	orphanGracePeriod = 10 * time.Minute
+	// orphanScanBatch is how many base path entries are read at a time
+	orphanScanBatch = 1024
+)
+
+// gcSummary is the result of one orphan scan, returned as JSON by POST /gc
+type gcSummary struct {
+	Scanned      int      `json:"scanned"`
+	OrphansFound int      `json:"orphansFound"`
+	Deleted      int      `json:"deleted"`
+	DryRun       bool     `json:"dryRun"`
+	Errors       []string `json:"errors"`
+}
+
+// errNotOrphan is returned by deleteOrphan for a directory that turned out to be in use when checked again
+var errNotOrphan = fmt.Errorf("volume is no longer orphaned")
+
+// errGCRunning is returned when an orphan scan is requested while one is still going
+var errGCRunning = fmt.Errorf("orphan garbage collection is already running")
+
+// collectOrphans scans the base paths for volume directories no PV points at any more. Only directories carrying
+// our ownership marker are considered, and they are only removed when --gc-orphans is set, otherwise just reported.
+func (p *customProvisioner) collectOrphans(ctx context.Context) (*gcSummary, error) {
+	if !p.gcRunning.TryLock() {
+		return nil, errGCRunning
+	}
+	defer p.gcRunning.Unlock()
+	release, err := p.scans.acquire(ctx, "orphan scan")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	summary := &gcSummary{DryRun: !p.config.gcOrphans, Errors: []string{}}
+
+	// Every HostPath referenced by a PV is in use, whatever its phase
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVs: %v", err)
+	}
+	inUse := map[string]bool{}
+	for _, pv := range pvs.Items {
+		if path, ok := volumeSourcePath(&pv); ok {
+			inUse[filepath.Clean(path)] = true
+		}
+	}
+
+	// Stream the base paths in batches to a bounded pool of workers, so tens of thousands of directories neither
+	// pile up in memory nor get checked one at a time
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	paths := make(chan string)
+	workers := p.config.reconcileWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for volumePath := range paths {
+				p.checkOrphan(ctx, volumePath, summary, &mu)
+			}
+		}()
+	}
+
+	var readErr error
+	for _, basePath := range p.config.basePaths() {
+		if readErr = p.feedOrphanCandidates(ctx, basePath, inUse, paths, summary, &mu); readErr != nil {
+			break
+		}
+	}
+	close(paths)
+	wg.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	klog.Infof("Orphan scan finished: %d scanned, %d orphans, %d deleted, %d errors (dry run: %v)",
+		summary.Scanned, summary.OrphansFound, summary.Deleted, len(summary.Errors), summary.DryRun)
+	return summary, nil
+}
+
+// feedOrphanCandidates sends the directories of one base path that no PV points at to the orphan workers
+func (p *customProvisioner) feedOrphanCandidates(ctx context.Context, basePath string, inUse map[string]bool, paths chan<- string, summary *gcSummary, mu *sync.Mutex) error {
+	dir, err := os.Open(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to read base path %s: %v", basePath, err)
+	}
+	defer dir.Close()
+
+	for {
+		entries, err := dir.ReadDir(orphanScanBatch)
+		for _, entry := range entries {
+			// Hidden entries are ours (self-test files and the like), never volumes
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			volumePath := filepath.Join(basePath, entry.Name())
+			mu.Lock()
+			summary.Scanned++
+			mu.Unlock()
+			// Protected directories are never orphans, whatever they hold
+			if inUse[volumePath] || p.checkForbidden(volumePath) != nil {
+				continue
+			}
+			select {
+			case paths <- volumePath:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read base path %s: %v", basePath, err)
+		}
+	}
+}
+
+// checkOrphan looks at one directory no PV points at and deletes it when it is an orphan and deletion is on
+func (p *customProvisioner) checkOrphan(ctx context.Context, volumePath string, summary *gcSummary, mu *sync.Mutex) {
+	if ctx.Err() != nil {
+		return
+	}
+	marker, err := readMarker(volumePath)
+	if err != nil {
+		// Without a marker we can't prove we created it, leave it alone
+		return
+	}
+	// Free pool directories are waiting for a claim, not orphaned
+	if marker.Free || time.Since(marker.CreatedAt) < orphanGracePeriod {
+		return
+	}
+
+	mu.Lock()
+	summary.OrphansFound++
+	mu.Unlock()
+	klog.Infof("Found orphaned volume %s (PVC %s/%s, PV %s)", volumePath, marker.PVCNamespace, marker.PVCName, marker.PVName)
+	if summary.DryRun {
+		return
+	}
+	err = p.deleteOrphan(ctx, volumePath, marker)
+	mu.Lock()
+	defer mu.Unlock()
+	if err == errNotOrphan {
+		summary.OrphansFound--
+		return
+	}
+	if err != nil {
+		klog.Errorf("Failed to delete orphaned volume %s: %v", volumePath, err)
+		summary.Errors = append(summary.Errors, err.Error())
+		return
+	}
+	summary.Deleted++
+}
+
+// deleteOrphan removes an orphaned volume with the backend recorded in its marker. The PV list the scan went by
+// may be stale, e.g. a retried provision may have resumed the directory since, so under the path lock the marker
+// is read again and the directory is left alone while its PV or its PVC exists.
+func (p *customProvisioner) deleteOrphan(ctx context.Context, volumePath string, marker *volumeMarker) error {
+	unlock := p.locks.lock(volumePath)
+	defer unlock()
+
+	current, err := readMarker(volumePath)
+	if err != nil || current.PVCUID != marker.PVCUID || current.PVName != marker.PVName || current.Free {
+		klog.Infof("Volume %s changed since the orphan scan looked at it, leaving it alone", volumePath)
+		return errNotOrphan
+	}
+	if current.PVName != "" {
+		_, err := p.client.CoreV1().PersistentVolumes().Get(ctx, current.PVName, metav1.GetOptions{})
+		if err == nil {
+			klog.Infof("Volume %s has PV %s again, it is not orphaned", volumePath, current.PVName)
+			return errNotOrphan
+		}
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("%s: failed to check for PV %s: %v", volumePath, current.PVName, err)
+		}
+	}
+	if current.PVCName != "" {
+		pvc, err := p.client.CoreV1().PersistentVolumeClaims(current.PVCNamespace).Get(ctx, current.PVCName, metav1.GetOptions{})
+		if err == nil && string(pvc.UID) == current.PVCUID {
+			klog.Infof("Volume %s still belongs to PVC %s/%s, it is not orphaned", volumePath, current.PVCNamespace, current.PVCName)
+			return errNotOrphan
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("%s: failed to check for PVC %s/%s: %v", volumePath, current.PVCNamespace, current.PVCName, err)
+		}
+	}
+
+	// Pool directories go back to the pool rather than away
+	audit := auditEntry{Operation: auditOrphanDelete, PV: marker.PVName, Path: volumePath, Node: p.config.nodeName, PVCUID: marker.PVCUID,
+		Backend: markerBackend(marker), BytesRemoved: p.auditBytes(ctx, volumePath)}
+	if marker.Pool {
+		audit.Operation = auditOrphanRecycle
+		err := releasePoolDir(volumePath, markerBackend(marker))
+		p.audit.record(audit, err)
+		if err != nil {
+			return fmt.Errorf("%s: %v", volumePath, err)
+		}
+		klog.Infof("Returned orphaned pool directory %s to the pool", volumePath)
+		return nil
+	}
+
+	backend, err := p.backendFor(markerBackend(marker))
+	if err != nil {
+		return fmt.Errorf("%s: %v", volumePath, err)
+	}
+	err = backend.Delete(ctx, volumePath)
+	p.audit.record(audit, err)
+	if err != nil {
+		return fmt.Errorf("%s: %v", volumePath, err)
+	}
+	klog.Infof("Deleted orphaned volume %s", volumePath)
+	return nil
+}
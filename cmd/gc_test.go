@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeOrphan creates a volume directory whose marker is old enough for the orphan scan
+func writeOrphan(t *testing.T, basePath, pvName string, pvc *corev1.PersistentVolumeClaim) (string, *volumeMarker) {
+	t.Helper()
+	path := filepath.Join(basePath, pvName)
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := volumeMarker{PVName: pvName, PVCNamespace: pvc.Namespace, PVCName: pvc.Name, PVCUID: string(pvc.UID),
+		Backend: hostPathBackendName, CreatedAt: time.Now().Add(-2 * orphanGracePeriod)}
+	if err := storeMarker(path, m); err != nil {
+		t.Fatal(err)
+	}
+	return path, &m
+}
+
+func TestDeleteOrphanRechecksPV(t *testing.T) {
+	config := newTestConfig(t)
+	pvc := testPVC("default", "resumed")
+	// The PV was persisted after the scan listed the PVs
+	pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-default-resumed"}}
+	p := newTestProvisioner(t, config, nil, pv)
+	path, marker := writeOrphan(t, config.basePath, pv.Name, pvc)
+
+	if err := p.deleteOrphan(context.Background(), path, marker); err != errNotOrphan {
+		t.Fatalf("deleteOrphan = %v, want errNotOrphan", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("volume with a PV was removed: %v", err)
+	}
+}
+
+func TestDeleteOrphanRechecksPVC(t *testing.T) {
+	config := newTestConfig(t)
+	pvc := testPVC("default", "pending")
+	p := newTestProvisioner(t, config, nil, pvc)
+	path, marker := writeOrphan(t, config.basePath, "pv-default-pending", pvc)
+
+	if err := p.deleteOrphan(context.Background(), path, marker); err != errNotOrphan {
+		t.Fatalf("deleteOrphan = %v, want errNotOrphan", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("volume of an existing PVC was removed: %v", err)
+	}
+}
+
+func TestDeleteOrphanRemovesOrphan(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+	path, marker := writeOrphan(t, config.basePath, "pv-default-gone", testPVC("default", "gone"))
+
+	if err := p.deleteOrphan(context.Background(), path, marker); err != nil {
+		t.Fatalf("deleteOrphan = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("orphan still there: %v", err)
+	}
+}
+
+func TestCollectOrphansScansBasePathPool(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	p := newTestProvisioner(t, config, nil)
+	writeOrphan(t, config.basePath, "pv-default-one", testPVC("default", "one"))
+	writeOrphan(t, disk2, "pv-default-two", testPVC("default", "two"))
+
+	summary, err := p.collectOrphans(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Scanned != 2 || summary.OrphansFound != 2 {
+		t.Errorf("scanned %d, found %d orphans, want 2 and 2", summary.Scanned, summary.OrphansFound)
+	}
+}
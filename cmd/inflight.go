@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"sync"
+)
+
+// provisionResult is what one Provision call returned
+type provisionResult struct {
+	pv    *corev1.PersistentVolume
+	state controller.ProvisioningState
+	err   error
+}
+
+// inflightCall is a running Provision, done is closed once its result is set
+type inflightCall struct {
+	done   chan struct{}
+	result provisionResult
+}
+
+// inflightProvisions runs one Provision per PVC UID at a time. A call for a PVC that is already being provisioned,
+// e.g. a controller retry overlapping a slow attempt, waits for that attempt and returns its result instead of
+// racing it on the same directory. Entries are evicted as soon as their call returns.
+type inflightProvisions struct {
+	mu    sync.Mutex
+	calls map[types.UID]*inflightCall
+}
+
+// do runs fn for the PVC unless a call for it is already running, then it waits for that call and returns its
+// result. shared reports whether the result came from another call. A waiter whose ctx ends first gives up with
+// ProvisioningNoChange, the running call carries on.
+func (f *inflightProvisions) do(ctx context.Context, uid types.UID, fn func() provisionResult) (result provisionResult, shared bool) {
+	f.mu.Lock()
+	if call, ok := f.calls[uid]; ok {
+		f.mu.Unlock()
+		select {
+		case <-call.done:
+			result = call.result
+			if result.pv != nil {
+				result.pv = result.pv.DeepCopy()
+			}
+			return result, true
+		case <-ctx.Done():
+			return provisionResult{state: controller.ProvisioningNoChange, err: fmt.Errorf("gave up waiting for the provision already in flight: %v", ctx.Err())}, true
+		}
+	}
+	if f.calls == nil {
+		f.calls = map[types.UID]*inflightCall{}
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	f.calls[uid] = call
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, uid)
+		f.mu.Unlock()
+		close(call.done)
+	}()
+	call.result = fn()
+	return call.result, false
+}
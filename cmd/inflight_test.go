@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInflightProvisionsDedupe(t *testing.T) {
+	var f inflightProvisions
+	var runs int32
+	release := make(chan struct{})
+	fn := func() provisionResult {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return provisionResult{pv: &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-default-slow"}}, state: controller.ProvisioningFinished}
+	}
+
+	const callers = 8
+	results := make([]provisionResult, callers)
+	var shared int32
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var s bool
+			results[i], s = f.do(context.Background(), "slow-uid", fn)
+			if s {
+				atomic.AddInt32(&shared, 1)
+			}
+		}(i)
+	}
+	// Let every caller find the running call before it finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&runs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if runs != 1 {
+		t.Errorf("fn ran %d times, want once", runs)
+	}
+	if shared != callers-1 {
+		t.Errorf("%d callers shared the result, want %d", shared, callers-1)
+	}
+	for i, result := range results {
+		if result.err != nil || result.pv == nil || result.pv.Name != "pv-default-slow" {
+			t.Fatalf("caller %d got %v, %v", i, result.pv, result.err)
+		}
+		for _, other := range results[:i] {
+			if other.pv == result.pv {
+				t.Errorf("callers share one PV object, they must each get a copy")
+			}
+		}
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("%d calls left in flight after all returned", len(f.calls))
+	}
+
+	// A later call runs again instead of returning the old result
+	f.do(context.Background(), "slow-uid", func() provisionResult { atomic.AddInt32(&runs, 1); return provisionResult{} })
+	if runs != 2 {
+		t.Errorf("fn ran %d times after the first call returned, want 2", runs)
+	}
+}
+
+func TestInflightProvisionsWaiterGivesUp(t *testing.T) {
+	var f inflightProvisions
+	started, release := make(chan struct{}), make(chan struct{})
+	go f.do(context.Background(), "slow-uid", func() provisionResult {
+		close(started)
+		<-release
+		return provisionResult{}
+	})
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, shared := f.do(ctx, "slow-uid", func() provisionResult {
+		t.Error("fn ran while another call for the PVC was in flight")
+		return provisionResult{}
+	})
+	if !shared || result.err == nil || result.state != controller.ProvisioningNoChange {
+		t.Errorf("do = %s, %v, shared %v, want NoChange with an error", result.state, result.err, shared)
+	}
+}
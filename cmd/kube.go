@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+// patchPVAnnotations merges annotations into the PV's metadata, a nil value removes the annotation
+func (p *customProvisioner) patchPVAnnotations(ctx context.Context, pvName string, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Patch(ctx, pvName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch annotations of PV %s: %v", pvName, err)
+	}
+	return nil
+}
+
+// annotationBatchWindow is how long queued annotation updates of a PV are collected before being sent as one patch
+const annotationBatchWindow = 2 * time.Second
+
+// annotationBatcher coalesces annotation updates of the same PV into one merge patch per window and sends the
+// patches no faster than the configured rate, so frequent bookkeeping can't flood the API server
+type annotationBatcher struct {
+	p       *customProvisioner
+	limiter flowcontrol.RateLimiter
+
+	mu      sync.Mutex
+	pending map[string]map[string]*string
+}
+
+func newAnnotationBatcher(p *customProvisioner, rate float64) *annotationBatcher {
+	burst := int(rate)
+	if burst < 1 {
+		burst = 1
+	}
+	return &annotationBatcher{
+		p:       p,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(float32(rate), burst),
+		pending: map[string]map[string]*string{},
+	}
+}
+
+// queue adds annotations to the next patch of the PV, later values for the same key replace earlier ones
+func (b *annotationBatcher) queue(pvName string, annotations map[string]*string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	merged, ok := b.pending[pvName]
+	if !ok {
+		merged = map[string]*string{}
+		b.pending[pvName] = merged
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+}
+
+// run flushes the queued updates every window until ctx is cancelled, flushing once more on the way out
+func (b *annotationBatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(annotationBatchWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.flush(context.Background())
+			return
+		case <-ticker.C:
+			b.flush(ctx)
+		}
+	}
+}
+
+func (b *annotationBatcher) flush(ctx context.Context) {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = map[string]map[string]*string{}
+	b.mu.Unlock()
+
+	for pvName, annotations := range batch {
+		if err := b.limiter.Wait(ctx); err != nil {
+			// Put the rest back, they go out with the next flush
+			b.requeue(batch)
+			return
+		}
+		delete(batch, pvName)
+		if err := b.p.patchPVAnnotations(ctx, pvName, annotations); err != nil && !apierrors.IsNotFound(err) {
+			klog.Errorf("Failed to apply batched annotation update: %v", err)
+		}
+	}
+}
+
+// requeue puts updates back that weren't sent, without overriding anything queued meanwhile
+func (b *annotationBatcher) requeue(batch map[string]map[string]*string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for pvName, annotations := range batch {
+		merged, ok := b.pending[pvName]
+		if !ok {
+			b.pending[pvName] = annotations
+			continue
+		}
+		for k, v := range annotations {
+			if _, newer := merged[k]; !newer {
+				merged[k] = v
+			}
+		}
+	}
+}
+
+// queuePVAnnotations updates PV annotations through the batcher when --annotation-update-rate is set and directly
+// otherwise. Batched updates are applied asynchronously so only bookkeeping that may lag a little belongs here.
+func (p *customProvisioner) queuePVAnnotations(ctx context.Context, pvName string, annotations map[string]*string) error {
+	if p.annotations == nil {
+		return p.patchPVAnnotations(ctx, pvName, annotations)
+	}
+	p.annotations.queue(pvName, annotations)
+	return nil
+}
+
+// namespacePhaseTTL is how long a namespace's phase is cached, a namespace only ever goes from Active to Terminating
+const namespacePhaseTTL = 30 * time.Second
+
+type namespacePhase struct {
+	phase   corev1.NamespacePhase
+	fetched time.Time
+}
+
+// namespacePhases caches namespace phase lookups, so a burst of PVCs in one namespace costs one API call
+type namespacePhases struct {
+	mu      sync.Mutex
+	entries map[string]namespacePhase
+}
+
+// namespaceTerminating reports whether the namespace is being deleted
+func (p *customProvisioner) namespaceTerminating(ctx context.Context, namespace string) (bool, error) {
+	c := &p.namespaces
+	c.mu.Lock()
+	entry, ok := c.entries[namespace]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < namespacePhaseTTL {
+		return entry.phase == corev1.NamespaceTerminating, nil
+	}
+
+	ns, err := p.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get namespace %s: %v", namespace, err)
+	}
+	terminating := ns.Status.Phase == corev1.NamespaceTerminating || ns.DeletionTimestamp != nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]namespacePhase{}
+	}
+	// Expired entries are dropped here, the map never grows beyond the namespaces seen within one TTL
+	for name, e := range c.entries {
+		if time.Since(e.fetched) >= namespacePhaseTTL {
+			delete(c.entries, name)
+		}
+	}
+	phase := ns.Status.Phase
+	if terminating {
+		phase = corev1.NamespaceTerminating
+	}
+	c.entries[namespace] = namespacePhase{phase: phase, fetched: time.Now()}
+	return terminating, nil
+}
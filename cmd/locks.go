@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"time"
+)
+
+// pathLocks serializes operations on the same volume path, so a retried Delete can't race with
+// another Delete (or a Provision) of the same directory
+type pathLocks struct {
+	locks sync.Map
+}
+
+// lock blocks until the caller holds the lock for path and returns the matching unlock function.
+// Mutexes are kept for the lifetime of the process, one per path ever touched, which is cheap
+// compared to the risk of handing out two different mutexes for the same path.
+func (l *pathLocks) lock(path string) func() {
+	m, _ := l.locks.LoadOrStore(path, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// minAttemptSweepSize is the number of tracked PVCs below which stale attempts aren't swept at all
+const minAttemptSweepSize = 1024
+
+// attemptTracker remembers when each PVC was last provisioned, so a PVC retried in a hot loop doesn't hit the disk
+// on every attempt. Entries older than the interval are swept whenever the map doubled since the last sweep,
+// which keeps memory bounded by the PVCs seen within one interval.
+type attemptTracker struct {
+	mu        sync.Mutex
+	last      map[types.UID]time.Time
+	nextSweep int
+}
+
+// allow records an attempt for uid and reports whether the previous one is at least interval ago
+func (t *attemptTracker) allow(uid types.UID, interval time.Duration) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.last == nil {
+		t.last = map[types.UID]time.Time{}
+	}
+	if last, ok := t.last[uid]; ok && now.Sub(last) < interval {
+		return false, interval - now.Sub(last)
+	}
+	t.last[uid] = now
+
+	if len(t.last) >= t.nextSweep {
+		for id, last := range t.last {
+			if now.Sub(last) >= interval {
+				delete(t.last, id)
+			}
+		}
+		t.nextSweep = 2 * len(t.last)
+		if t.nextSweep < minAttemptSweepSize {
+			t.nextSweep = minAttemptSweepSize
+		}
+	}
+	return true, 0
+}
+
+// nameReservations hands each volume name to one PVC at a time, so two claims resolving to the same name fail
+// fast instead of both racing to create the same directory
+type nameReservations struct {
+	mu    sync.Mutex
+	names map[string]types.UID
+}
+
+// reserve claims name for uid until the returned release is called. Reserving a name the same PVC already holds
+// succeeds, e.g. for a retry overlapping with a slow earlier attempt.
+func (r *nameReservations) reserve(name string, uid types.UID) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names == nil {
+		r.names = map[string]types.UID{}
+	}
+	if owner, ok := r.names[name]; ok && owner != uid {
+		return nil, fmt.Errorf("volume name %s is being provisioned for another PVC (UID %s)", name, owner)
+	} else if ok {
+		return func() {}, nil
+	}
+	r.names[name] = uid
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.names, name)
+	}, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNameReservationsCollision(t *testing.T) {
+	var r nameReservations
+	release, err := r.reserve("pv-default-data", "uid-a")
+	if err != nil {
+		t.Fatalf("first reservation failed: %v", err)
+	}
+	// Another claim resolving to the same name loses instead of sharing the directory
+	if _, err := r.reserve("pv-default-data", "uid-b"); err == nil {
+		t.Error("a second PVC reserved a name already held")
+	}
+	// A retry of the holder overlapping its earlier attempt doesn't
+	again, err := r.reserve("pv-default-data", "uid-a")
+	if err != nil {
+		t.Errorf("the holder couldn't reserve its own name again: %v", err)
+	}
+	again()
+	if _, err := r.reserve("pv-default-data", "uid-b"); err == nil {
+		t.Error("the holder's retry released the name of the still running attempt")
+	}
+
+	release()
+	releaseB, err := r.reserve("pv-default-data", "uid-b")
+	if err != nil {
+		t.Errorf("name still held after release: %v", err)
+	}
+	releaseB()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"k8s.io/klog"
+	"strconv"
+)
+
+// Verbosity levels used with klog.V. Outcomes (volume provisioned, deleted, failed) are always logged, the levels
+// add detail on top:
+//
+//	1  summary of every Provision/Delete call as it starts
+//	2  decisions taken along the way: resolved policy, backend, node affinity
+//	4  every filesystem step (stat, create, remove, marker, fsync) with its duration
+//
+// Filesystem steps are logged from fsutil.go, so -vmodule=fsutil=4 shows them while keeping the rest quiet.
+const (
+	logCalls     klog.Level = 1
+	logDecisions klog.Level = 2
+	logFSSteps   klog.Level = 4
+)
+
+// applyLogLevel sets klog's -v from --log-level when it was given, -v itself keeps working as before
+func applyLogLevel(fs *flag.FlagSet, level int) error {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			set = true
+		}
+	})
+	if !set {
+		return nil
+	}
+	return fs.Set("v", strconv.Itoa(level))
+}
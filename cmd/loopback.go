@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	loopbackBackendName = "loopback"
+	// loopbackImageDir holds the backing image of every loopback volume
+	loopbackImageDir = ".loopback"
+	// defaultLoopbackFSType is the filesystem created in new images
+	defaultLoopbackFSType = "ext4"
+
+	// annAllocation on a PVC asks for thick (fully allocated up front) or thin (sparse) backing storage, it is
+	// copied to the PV as the allocation that was used
+	annAllocation    = "custom-provisioner/allocation"
+	allocationThick  = "thick"
+	allocationThin   = "thin"
+	zeroFillChunkLen = 1 << 20
+)
+
+var (
+	// mkfsDuration and mkfsWait time the format step of loopback volumes, mkfsWait being the time spent queued
+	// for one of the --max-concurrent-mkfs slots
+	mkfsDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "provisioner_mkfs_duration_seconds",
+		Help:    "Time mkfs took to format the image of a new loopback volume.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	mkfsWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "provisioner_mkfs_wait_seconds",
+		Help:    "Time new loopback volumes waited for a --max-concurrent-mkfs slot before formatting.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+)
+
+// PreallocatingBackend is implemented by backends that can allocate a volume's storage in full at creation, so
+// writes never find the underlying filesystem full later
+type PreallocatingBackend interface {
+	VolumeBackend
+	// CreatePreallocated is Create with every byte of sizeBytes allocated up front
+	CreatePreallocated(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error
+}
+
+// volumeAllocation returns the allocation the PVC asks for with annAllocation, thin without one
+func volumeAllocation(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	switch v := pvc.Annotations[annAllocation]; v {
+	case "", allocationThin:
+		return allocationThin, nil
+	case allocationThick:
+		return allocationThick, nil
+	default:
+		return "", fmt.Errorf("invalid %s annotation %q, expected %s or %s", annAllocation, v, allocationThick, allocationThin)
+	}
+}
+
+// loopbackBackend backs every volume with its own filesystem image under <base>/.loopback, loop mounted at the
+// volume path, so the size is enforced by the filesystem itself. Like the overlay backend it needs a privileged
+// container with Bidirectional mount propagation.
+type loopbackBackend struct {
+	basePath string
+	fsType   string
+	// mkfsSlots bounds the images formatted at once, nil lets every provision format right away
+	mkfsSlots chan struct{}
+}
+
+func newLoopbackBackend(basePath, fsType string, maxConcurrentMkfs int) (*loopbackBackend, error) {
+	if fsType == "" {
+		fsType = defaultLoopbackFSType
+	}
+	if _, err := exec.LookPath("mkfs." + fsType); err != nil {
+		return nil, fmt.Errorf("the loopback backend needs mkfs.%s: %v", fsType, err)
+	}
+	b := &loopbackBackend{basePath: basePath, fsType: fsType}
+	if maxConcurrentMkfs > 0 {
+		b.mkfsSlots = make(chan struct{}, maxConcurrentMkfs)
+	}
+	return b, nil
+}
+
+func (b *loopbackBackend) Name() string {
+	return loopbackBackendName
+}
+
+func (b *loopbackBackend) imagePath(path string) string {
+	return filepath.Join(b.basePath, loopbackImageDir, filepath.Base(path)+".img")
+}
+
+// Create makes a sparse image, only the blocks written get allocated
+func (b *loopbackBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	return b.create(ctx, path, sizeBytes, mode, false)
+}
+
+func (b *loopbackBackend) CreatePreallocated(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	return b.create(ctx, path, sizeBytes, mode, true)
+}
+
+func (b *loopbackBackend) create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode, thick bool) error {
+	image := b.imagePath(path)
+	if err := os.MkdirAll(filepath.Dir(image), 0700); err != nil {
+		return fmt.Errorf("failed to create image directory: %v", err)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create volume directory: %v", err)
+	}
+	if err := allocateImage(ctx, image, sizeBytes, thick); err != nil {
+		b.Delete(ctx, path)
+		return err
+	}
+
+	if err := b.format(ctx, image); err != nil {
+		b.Delete(ctx, path)
+		return err
+	}
+	// A loop device set up by mount is released again on umount
+	if err := runCommand(ctx, "mount", "-o", "loop", image, path); err != nil {
+		b.Delete(ctx, path)
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		b.Delete(ctx, path)
+		return fmt.Errorf("failed to set mode on volume directory: %v", err)
+	}
+	return nil
+}
+
+// format runs mkfs on the image once a --max-concurrent-mkfs slot is free, formatting is the IO heavy part of
+// creating a loopback volume and many at once saturate the disk
+func (b *loopbackBackend) format(ctx context.Context, image string) error {
+	start := time.Now()
+	if b.mkfsSlots != nil {
+		select {
+		case b.mkfsSlots <- struct{}{}:
+			defer func() { <-b.mkfsSlots }()
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for a mkfs slot: %v", ctx.Err())
+		}
+	}
+	mkfsWait.Observe(time.Since(start).Seconds())
+
+	start = time.Now()
+	err := runCommand(ctx, "mkfs."+b.fsType, "-q", image)
+	mkfsDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// Sync fsyncs the volume's image. Fsyncs inside the mounted volume already reach the image through the loop
+// device, this makes the image file itself, its size and allocation, durable on the base path too.
+func (b *loopbackBackend) Sync(path string) error {
+	image := b.imagePath(path)
+	klog.V(logFSSteps).Infof("Fsyncing %s", image)
+	f, err := os.Open(image)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for fsync: %v", image, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync %s: %v", image, err)
+	}
+	return nil
+}
+
+// Resume mounts the image again when the mount is gone, e.g. after a restart between the create and the retry
+func (b *loopbackBackend) Resume(ctx context.Context, path string) error {
+	mounted, err := isMountPoint(path)
+	if err != nil || mounted {
+		return err
+	}
+	image := b.imagePath(path)
+	if _, err := os.Stat(image); err != nil {
+		return fmt.Errorf("volume image %s: %v", image, err)
+	}
+	return runCommand(ctx, "mount", "-o", "loop", image, path)
+}
+
+func (b *loopbackBackend) Delete(ctx context.Context, path string) error {
+	// The mount may already be gone, e.g. after a node reboot, then only the image and directory are left
+	mounted, err := isMountPoint(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := runCommand(ctx, "umount", path); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(b.imagePath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// allocateImage creates the image file at its full size. A thin image is only truncated to size, a thick one has
+// every block allocated with fallocate, or by writing zeros on filesystems that don't support fallocate.
+func allocateImage(ctx context.Context, image string, sizeBytes int64, thick bool) error {
+	f, err := os.OpenFile(image, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create image %s: %v", image, err)
+	}
+	defer f.Close()
+	if !thick {
+		if err := f.Truncate(sizeBytes); err != nil {
+			return fmt.Errorf("failed to size image %s: %v", image, err)
+		}
+		return nil
+	}
+
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, sizeBytes)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		klog.Warningf("Filesystem of %s doesn't support fallocate, allocating %d bytes by writing zeros", image, sizeBytes)
+		err = zeroFill(ctx, f, sizeBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to allocate %d bytes for image %s: %v", sizeBytes, image, err)
+	}
+	return f.Sync()
+}
+
+// zeroFill writes sizeBytes of zeros to f, stopping early when ctx ends
+func zeroFill(ctx context.Context, f *os.File, sizeBytes int64) error {
+	chunk := make([]byte, zeroFillChunkLen)
+	for written := int64(0); written < sizeBytes; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := int64(len(chunk))
+		if sizeBytes-written < n {
+			n = sizeBytes - written
+		}
+		if _, err := f.Write(chunk[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
@@ -2,107 +2,1048 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type customProvisioner struct {
 	// Define any dependencies that your provisioner might need here, here I use the kubernetes client
 	client kubernetes.Interface
+	// config holds the settings from the command line
+	config provisionerConfig
+	// backend creates the storage for new volumes unless the PVC asks for another one
+	backend VolumeBackend
+	// backends are all backends PVCs may select, keyed by name, including the default one
+	backends map[string]VolumeBackend
+	// recorder emits events on PVCs and PVs
+	recorder record.EventRecorder
+	// policies holds the per-StorageClass defaults from the policy ConfigMap, empty when no ConfigMap is configured
+	policies *policyStore
+	// locks serializes Provision and Delete calls that touch the same volume path
+	locks pathLocks
+	// readOnly is set while provisioning is frozen, see setReadOnly
+	readOnly atomic.Bool
+	// deleteSlots bounds the number of concurrent deletes, nil when unlimited
+	deleteSlots chan struct{}
+	// attempts tracks the last provision attempt of each PVC for --min-provision-interval
+	attempts attemptTracker
+	// namespaces caches namespace phases for the terminating namespace check
+	namespaces namespacePhases
+	// annotations batches PV annotation updates, nil when they are sent right away
+	annotations *annotationBatcher
+	// audit records destructive operations, nil without --audit-log
+	audit *auditLog
+	// mount tracks whether the base path's filesystem is usable
+	mount mountHealth
+	// classes bounds the provisions running at once per StorageClass
+	classes classPools
+	// names holds the volume names of in-flight provisions
+	names nameReservations
+	// committed tracks the bytes committed per base path, only kept with --max-committed-bytes
+	committed committedLedger
+	// scans bounds the background disk walks running at once, nil without --max-concurrent-scans
+	scans scanSlots
+	// baseMounts holds the filesystem of each base path, only looked up with --annotate-mount-info
+	baseMounts map[string]mountInfo
+	// budget counts failed provisions per PVC, only kept with --max-provision-attempts
+	budget provisionBudget
+	// inflight tracks the PVCs being provisioned, for --dedupe-provisions
+	inflight inflightProvisions
+	// reconciled is set once the startup orphan scan finished (or timed out), /readyz fails until then
+	reconciled atomic.Bool
+	// stats counts the operations of this session for the shutdown report
+	stats sessionStats
+	// gcRunning is held while an orphan scan runs, so two scans never race each other
+	gcRunning sync.Mutex
 }
 
 // NewCustomProvisioner creates a new instance of the custom provisioner
-func NewCustomProvisioner(client kubernetes.Interface) controller.Provisioner {
+func NewCustomProvisioner(client kubernetes.Interface, recorder record.EventRecorder, config provisionerConfig, backends map[string]VolumeBackend, policies *policyStore) *customProvisioner {
 	// customProvisioner needs to implement "Provision" and "Delete" methods in order to satisfy the Provisioner interface
-	return &customProvisioner{
-		client: client,
+	p := &customProvisioner{
+		client:   client,
+		recorder: recorder,
+		config:   config,
+		backend:  backends[config.backend],
+		backends: backends,
+		policies: policies,
 	}
+	p.stats.startedAt = time.Now()
+	if config.maxConcurrentDeletes > 0 {
+		p.deleteSlots = make(chan struct{}, config.maxConcurrentDeletes)
+	}
+	if config.annotationUpdateRate > 0 {
+		p.annotations = newAnnotationBatcher(p, config.annotationUpdateRate)
+	}
+	p.setReadOnly(config.readOnly)
+	p.scans = newScanSlots(config.maxConcurrentScans)
+	// The disks behind the base paths don't change while we run, look them up once
+	if config.annotateMountInfo {
+		p.baseMounts = map[string]mountInfo{}
+		for _, basePath := range config.basePaths() {
+			info, err := mountOf(basePath)
+			if err != nil {
+				klog.Warningf("Not annotating PVs on %s with their mount: %v", basePath, err)
+				continue
+			}
+			klog.Infof("Base path %s is on %s (%s)", basePath, info.source, info.fsType)
+			p.baseMounts[basePath] = info
+		}
+	}
+	return p
 }
 
 func (p *customProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*corev1.PersistentVolume, controller.ProvisioningState, error) {
+	// Legacy default-class setups can route claims without a StorageClass here, the flag defaults apply to them
+	if options.StorageClass == nil {
+		klog.Warningf("PVC %s/%s has no StorageClass, provisioning it with the default policy", options.PVC.Namespace, options.PVC.Name)
+		defaultsApplied.WithLabelValues("storageClass").Inc()
+		p.recorder.Event(options.PVC, corev1.EventTypeWarning, "DefaultApplied", "PVC has no StorageClass, provisioning it with the default policy from the provisioner flags")
+		options.StorageClass = &storagev1.StorageClass{}
+	}
+
+	// Wrap the actual work in a span, this is a no-op unless tracing is enabled
+	requested := options.PVC.Spec.Resources.Requests[corev1.ResourceStorage]
+	klog.V(logCalls).Infof("Provisioning PVC %s/%s (StorageClass %s, %s)", options.PVC.Namespace, options.PVC.Name, options.StorageClass.Name, requested.String())
+	ctx, span := tracer.Start(ctx, "Provision", trace.WithAttributes(
+		attribute.String("pvc", options.PVC.Namespace+"/"+options.PVC.Name),
+		attribute.Int64("size", requested.Value()),
+	))
+	// Bound the whole provision, slow storage must not tie up a worker forever
+	if p.config.provisionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.provisionTimeout)
+		defer cancel()
+	}
+	// A PVC that failed too often fails fast, there's no point in trying it again and again
+	if err := p.checkBudget(options.PVC); err != nil {
+		endSpan(span, err)
+		return nil, controller.ProvisioningFinished, err
+	}
+	run := func() provisionResult {
+		done := p.stats.track(&p.stats.provisions, &p.stats.provisionErrors)
+		pv, state, err := p.provision(ctx, options)
+		done(err)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			klog.Warningf("Provisioning PVC %s/%s did not finish within %v: %v", options.PVC.Namespace, options.PVC.Name, p.config.provisionTimeout, err)
+			state = controller.ProvisioningReschedule
+			err = fmt.Errorf("provisioning did not finish within %v: %v", p.config.provisionTimeout, err)
+		}
+		state, err = p.chargeBudget(options.PVC, state, err)
+		return provisionResult{pv: pv, state: state, err: err}
+	}
+	var result provisionResult
+	if p.config.dedupeProvisions {
+		// A second call for the same PVC shares the first one's result, stats and budget are charged once
+		var shared bool
+		if result, shared = p.inflight.do(ctx, options.PVC.UID, run); shared {
+			klog.Infof("PVC %s/%s was already being provisioned, returning the result of that attempt", options.PVC.Namespace, options.PVC.Name)
+		}
+	} else {
+		result = run()
+	}
+	pv, state, err := result.pv, result.state, result.err
+	if pv != nil {
+		span.SetAttributes(attribute.String("pv", pv.Name))
+	}
+	endSpan(span, err)
+	return pv, state, err
+}
+
+func (p *customProvisioner) provision(ctx context.Context, options controller.ProvisionOptions) (*corev1.PersistentVolume, controller.ProvisioningState, error) {
+	phases := newPhaseTimer(p.config.phaseMetrics)
+
+	// No new volumes while in read-only mode, another replica (or this one later) can pick the PVC up
+	if p.readOnly.Load() {
+		return nil, controller.ProvisioningReschedule, &notAttemptedError{fmt.Errorf("provisioner in read-only mode")}
+	}
+
+	// Never work on a half-mounted base path, the mount probe lets provisioning resume once it's back
+	if err := p.mount.unavailable(); err != nil {
+		return nil, controller.ProvisioningReschedule, &notAttemptedError{fmt.Errorf("base path unavailable: %v", err)}
+	}
+
+	// Dampen retry storms, a PVC failing over and over only touches the disk once per interval
+	if p.config.minProvisionInterval > 0 {
+		if ok, retryIn := p.attempts.allow(options.PVC.UID, p.config.minProvisionInterval); !ok {
+			return nil, controller.ProvisioningReschedule, &notAttemptedError{fmt.Errorf("PVC was attempted less than %v ago, retrying in %v", p.config.minProvisionInterval, retryIn.Round(time.Second))}
+		}
+	}
+
 	// Validate the PVC spec, 0 storage size is not allowed
 	requestedStorage := options.PVC.Spec.Resources.Requests[corev1.ResourceStorage]
 	if requestedStorage.IsZero() {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("requested storage size is zero")
 	}
+	// A storage limit caps the backing quota, it can't be below what the PV will report as its capacity
+	quota := quotaSize(options.PVC)
+	if quota.Cmp(requestedStorage) < 0 {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("requested storage %s is larger than its limit %s", requestedStorage.String(), quota.String())
+	}
 
 	// If no access mode is specified, return an error
 	if len(options.PVC.Spec.AccessModes) == 0 {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("access mode is not specified")
 	}
+	accessModes, err := normalizeAccessModes(options.PVC, p.config.strictAccessModes)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("invalid access modes: %v", err)
+	}
+
+	// A claim naming its PV waits for that PV, a new volume would only be a duplicate nobody binds to
+	if options.PVC.Spec.VolumeName != "" {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("PVC is pre-bound to PV %s, deferring to static binding", options.PVC.Spec.VolumeName)
+	}
+
+	// A volume in a namespace that is being deleted would be cleaned up right away, don't bother creating it.
+	// If the namespace can't be looked up, provision anyway rather than block on it.
+	if terminating, err := p.namespaceTerminating(ctx, options.PVC.Namespace); err != nil {
+		klog.Warningf("Can't check whether namespace %s is terminating: %v", options.PVC.Namespace, err)
+	} else if terminating {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("namespace terminating")
+	}
+
+	// Catch StorageClasses that forgot a parameter the operator declared mandatory, PVCs without a class have
+	// no parameters to check
+	if options.StorageClass.Name != "" {
+		if missing := p.config.missingClassParams(options.StorageClass.Parameters); len(missing) > 0 {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("StorageClass %s is missing required parameters: %s", options.StorageClass.Name, strings.Join(missing, ", "))
+		}
+	}
+
+	// Governance may insist on labels such as a cost center, tell the user which ones the claim lacks
+	if missing := p.config.missingPVCLabels(options.PVC.Labels); len(missing) > 0 {
+		p.recorder.Eventf(options.PVC, corev1.EventTypeWarning, "MissingRequiredLabels", "PVC lacks the required labels %s, add them to have it provisioned", strings.Join(missing, ", "))
+		return nil, controller.ProvisioningFinished, fmt.Errorf("PVC is missing required labels: %s", strings.Join(missing, ", "))
+	}
+
+	// Resolve the size limits, reclaim policy and directory mode for this StorageClass
+	policy, err := p.resolvePolicy(options.StorageClass, options.PVC.Namespace)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("invalid policy for StorageClass %s: %v", options.StorageClass.Name, err)
+	}
+	if policy.minSize != nil && requestedStorage.Cmp(*policy.minSize) < 0 {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("requested storage %s is smaller than the minimum %s", requestedStorage.String(), policy.minSize.String())
+	}
+	if policy.maxSize != nil && requestedStorage.Cmp(*policy.maxSize) > 0 {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("requested storage %s is larger than the maximum %s", requestedStorage.String(), policy.maxSize.String())
+	}
+	if policy.maxSize != nil && quota.Cmp(*policy.maxSize) > 0 {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("storage limit %s is larger than the maximum %s", quota.String(), policy.maxSize.String())
+	}
+	if err := checkGranularity(requestedStorage, policy.sizeGranularity); err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	klog.V(logDecisions).Infof("Policy for PVC %s/%s: reclaim %s, dir mode %o, min %v, max %v", options.PVC.Namespace, options.PVC.Name,
+		policy.reclaimPolicy, policy.dirMode, policy.minSize, policy.maxSize)
+
+	// Take one of the class's workers, a busy class is retried later by the controller rather than starving the others
+	done, err := p.classes.acquire(options.StorageClass.Name, options.PVC.UID, policy.workers)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	defer done()
+
+	// The node-wide cap is the last line of defence against a StorageClass or policy allowing too much
+	if limit := p.config.absoluteMaxSize.Quantity; limit != nil && requestedStorage.Cmp(*limit) > 0 {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("requested storage %s is larger than the node-wide maximum %s", requestedStorage.String(), limit.String())
+	}
+	if limit := p.config.absoluteMaxSize.Quantity; limit != nil && quota.Cmp(*limit) > 0 {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("storage limit %s is larger than the node-wide maximum %s", quota.String(), limit.String())
+	}
+
+	// Let the PV controller bind a matching pre-created PV rather than creating a duplicate, the controller
+	// retries the PVC later and by then it is normally bound
+	if p.config.preferStaticBinding {
+		staticPV, err := p.findStaticPV(ctx, options.PVC, options.StorageClass.Name)
+		if err != nil {
+			return nil, controller.ProvisioningNoChange, err
+		}
+		if staticPV != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("available PV %s matches the claim, deferring to static binding", staticPV.Name)
+		}
+	}
+
+	// Volumes pinned to this node are useless while the node can't take pods, let a replica on a healthy node have it
+	var node *corev1.Node
+	if p.config.pinToNode {
+		node, err = p.client.CoreV1().Nodes().Get(ctx, p.config.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, controller.ProvisioningNoChange, fmt.Errorf("failed to get node %s: %v", p.config.nodeName, err)
+		}
+		if reason := nodeUnavailable(node, p.config.nodeTaintSensitivity); reason != "" {
+			return nil, controller.ProvisioningReschedule, fmt.Errorf("node %s can't accept workloads: %s", node.Name, reason)
+		}
+	}
+
+	// Respect the class's allowedTopologies for the node the volume lands on, pinned or picked by the scheduler
+	var affinity *corev1.VolumeNodeAffinity
+	if node != nil {
+		affinity = nodeAffinityFor(node)
+	}
+	if allowed := options.StorageClass.AllowedTopologies; len(allowed) > 0 {
+		target := node
+		if target == nil {
+			target = options.SelectedNode
+		}
+		affinity, err = topologyAffinity(allowed, target, node != nil)
+		if err != nil {
+			return nil, controller.ProvisioningReschedule, err
+		}
+	}
+
+	// Pick the backend, the PVC may ask for one of the allowed backends through an annotation
+	backend, err := p.selectBackend(options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("backend", backend.Name()))
+	klog.V(logDecisions).Infof("Using backend %s for PVC %s/%s, node affinity %v", backend.Name(), options.PVC.Namespace, options.PVC.Name, affinity != nil)
+
+	// Backends differ in who can share a volume, e.g. tmpfs volumes have a single consumer
+	if err := checkBackendAccessModes(backend.Name(), accessModes, p.config.accessModeMatrix); err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	// Every backend hands out a directory, a Block claim would get a Filesystem PV its pods can't use
+	if mode := options.PVC.Spec.VolumeMode; mode != nil && *mode == corev1.PersistentVolumeBlock {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("volumeMode %s is not supported by backend %s, it only provides %s volumes",
+			corev1.PersistentVolumeBlock, backend.Name(), corev1.PersistentVolumeFilesystem)
+	}
+
+	// Thick allocation is up to backends that can preallocate, thin is what every backend does anyway
+	allocation, err := volumeAllocation(options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	_, preallocating := backend.(PreallocatingBackend)
+	if allocation == allocationThick && !preallocating {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("backend %s doesn't support %s allocation", backend.Name(), allocationThick)
+	}
+
+	// The PVC may trade latency for durability, or the other way round, against --fsync-on-create
+	if policy.durable, err = volumeDurable(options.PVC, p.config.fsyncOnCreate); err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
 
 	// Generate a unique name for the volume using the PVC namespace and name
-	volumeName := fmt.Sprintf("pv-%s-%s", options.PVC.Namespace, options.PVC.Name)
+	volumeName, err := p.volumeNameFor(options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	// A PV of that name left over from an earlier claim would be taken as ours by the controller
+	volumeName, existingPV, err := p.resolvePVName(ctx, options.PVC, volumeName)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	// Hold the name for the rest of the provision, another PVC resolving to it loses instead of sharing the directory
+	release, err := p.names.reserve(volumeName, options.PVC.UID)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	defer release()
+	// A PV an earlier attempt already saved for this claim is handed back as it is, the controller reuses it
+	if existingPV != nil {
+		klog.Infof("Adopting existing PV %s for PVC %s/%s", existingPV.Name, options.PVC.Namespace, options.PVC.Name)
+		return existingPV, controller.ProvisioningFinished, nil
+	}
+
+	annotations := map[string]string{
+		annBackend:  backend.Name(),
+		annIdentity: p.config.identity,
+	}
+	if preallocating {
+		annotations[annAllocation] = allocation
+	}
+	// Testing setups may report a capacity other than what is allocated, the PV says so
+	capacity, overridden, err := pvCapacity(options.PVC, p.config.allowCapacityOverride)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	if overridden {
+		klog.Warningf("PV %s of PVC %s/%s reports a capacity of %s instead of the requested %s, as set by its %s annotation",
+			volumeName, options.PVC.Namespace, options.PVC.Name, capacity.String(), requestedStorage.String(), annPVCapacity)
+		annotations[annCapacityOverridden] = requestedStorage.String()
+	}
+	// Billing may want the capacity in a particular unit system, the class says which
+	capacity = formatCapacity(capacity, policy.capacityFormat)
+	if p.config.enableTTLReaper {
+		expiresAt, err := volumeExpiry(options.PVC, time.Now())
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if !expiresAt.IsZero() {
+			annotations[annExpiresAt] = expiresAt.Format(time.RFC3339)
+		}
+	}
+
+	// Copy the allowlisted PVC annotations last, so they can't shadow anything set above
+	propagateAnnotations(options.PVC, p.config.propagateAnnotationPrefixes, annotations)
 
-	// Check if the volume already exists
-	volumePath := "/tmp/dynamic-volumes/" + volumeName
-	if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
-		return nil, controller.ProvisioningFinished, fmt.Errorf("volume %s already exists at %s", volumeName, volumePath)
+	// uncommit gives back the committed bytes reserved below unless the provision succeeds
+	uncommit := func() {}
+	defer func() { uncommit() }()
+
+	// The PVC may pin its volume to one of the pool's disks, --base-path is used otherwise
+	basePathID, basePath, err := p.selectBasePath(options.PVC, backend)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
 	}
+	if basePathID != "" {
+		if policy.reuseDir {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("%s can't be combined with %s", annBasePathID, paramReuseDir)
+		}
+		annotations[annBasePathID] = basePathID
+	}
+
+	phases.mark("validation")
+
+	var volumePath string
+	if remote, ok := backend.(RemoteBackend); ok {
+		// The agent on the storage node does the existence and capacity checks there, the PV is pinned to that node
+		targetNode, err := p.remoteTargetNode(ctx, options)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		path, state, err := p.createRemoteVolume(ctx, remote, targetNode, volumeName, options.PVC, policy)
+		if err != nil {
+			return nil, state, err
+		}
+		volumePath = path
+		affinity = nodeAffinityFor(targetNode)
+		annotations[annNode] = targetNode.Name
+	} else {
+		annotations[annDurable] = strconv.FormatBool(policy.durable)
+		// Pool classes get the emptied directory of an earlier volume when one is free, on whichever base path it is
+		reusedPoolDir := false
+		if policy.reuseDir {
+			if !poolBackendAllowed(backend.Name()) {
+				return nil, controller.ProvisioningFinished, fmt.Errorf("%s is not supported with backend %s", paramReuseDir, backend.Name())
+			}
+			annotations[annReuseDir] = "true"
+			var poolID string
+			volumePath, poolID, err = p.claimPoolDir(ctx, volumeName, backend, options.PVC)
+			if err != nil {
+				return nil, controller.ProvisioningFinished, err
+			}
+			reusedPoolDir = volumePath != ""
+			if poolID != "" {
+				annotations[annBasePathID] = poolID
+				basePath = p.config.basePathPool[poolID]
+			}
+		}
+		// Say which disk the volume is on, for telling apart the performance of different disks
+		if info, ok := p.baseMounts[basePath]; ok {
+			annotations[annFSType] = info.fsType
+			annotations[annMountSource] = info.source
+		}
+		// Keep the base path under its committed ceiling whatever the disk says, another node may still have room
+		if limit := p.config.maxCommittedBytes.Quantity; limit != nil {
+			undo, err := p.committed.reserve(volumeName, basePath, requestedStorage.Value(), limit.Value())
+			if err != nil {
+				capacityCheckFailures.WithLabelValues("ceiling").Inc()
+				return nil, controller.ProvisioningReschedule, err
+			}
+			uncommit = undo
+		}
+		// Archiving happens on this node's base path, remote volumes are deleted by their agent as usual
+		if policy.archiveOnDelete {
+			annotations[annArchive] = "true"
+		}
+		if volumePath == "" {
+			// Serialize with any other Provision or Delete working on the same path
+			volumePath = filepath.Join(basePath, volumeName)
+			// Whatever the name template made of the PVC, protected parts of the base path are never provisioned into
+			if err := p.checkForbidden(volumePath); err != nil {
+				return nil, controller.ProvisioningFinished, err
+			}
+			unlock := p.locks.lock(volumePath)
+			defer unlock()
 
-	// Create the volume directory
-	if err := os.MkdirAll(volumePath, 0755); err != nil {
-		return nil, controller.ProvisioningFinished, fmt.Errorf("failed to create volume directory: %v", err)
+			// Check if the volume already exists, a directory left behind by an earlier attempt for this same PVC is reused
+			statErr := p.fsOp(ctx, "stat", volumePath, func() error {
+				_, err := os.Stat(volumePath)
+				return err
+			})
+			if isFSAbandoned(statErr) || p.checkMount(statErr) {
+				return nil, controller.ProvisioningReschedule, statErr
+			}
+			if !os.IsNotExist(statErr) {
+				// A directory pre-created by an operator is adopted untouched, it isn't a leftover of ours
+				external, err := p.checkExternal(ctx, volumePath, backend)
+				if isFSAbandoned(err) {
+					return nil, controller.ProvisioningReschedule, err
+				}
+				if err != nil {
+					return nil, controller.ProvisioningFinished, err
+				}
+				if external {
+					klog.Infof("Adopting externally managed directory %s for PVC %s/%s, it is neither modified nor deleted", volumePath, options.PVC.Namespace, options.PVC.Name)
+					annotations[annExternal] = "true"
+				} else {
+					// A mount that went away since the earlier attempt hides the marker, restore it before looking
+					if rb, ok := backend.(ResumableBackend); ok {
+						err := p.fsOp(ctx, "resume", volumePath, func() error { return rb.Resume(ctx, volumePath) })
+						if isFSAbandoned(err) {
+							return nil, controller.ProvisioningReschedule, err
+						}
+						if err != nil {
+							return nil, controller.ProvisioningFinished, fmt.Errorf("failed to resume existing volume %s: %v", volumePath, err)
+						}
+					}
+					if state, err := p.resumeExistingVolume(ctx, volumeName, volumePath, backend, options.PVC); err != nil {
+						return nil, state, err
+					}
+					klog.Infof("Reusing existing volume %s at %s for PVC %s/%s", volumeName, volumePath, options.PVC.Namespace, options.PVC.Name)
+				}
+			} else if state, err := p.createVolume(ctx, backend, basePath, volumeName, volumePath, options.PVC, policy, phases); err != nil {
+				return nil, state, err
+			}
+		}
+		if policy.reuseDir {
+			p.recordPoolUse(options.PVC, basePath, volumePath, reusedPoolDir)
+		}
+		// Remember how the directory was set up, --recreate-missing-dirs restores it like that if it goes missing
+		if dirAnns, err := dirAnnotations(volumePath); err == nil {
+			for k, v := range dirAnns {
+				annotations[k] = v
+			}
+		} else {
+			klog.Warningf("Can't record mode and owner of %s: %v", volumePath, err)
+		}
 	}
 
-	// Based on the above checks, we can now create the PV, HostPath is used as the volume source
+	// Based on the above checks, we can now create the PV, HostPath is used as the volume source unless the backend has its own
+	source := corev1.PersistentVolumeSource{
+		HostPath: &corev1.HostPathVolumeSource{
+			Path: volumePath,
+		},
+	}
+	if p.config.volumeSource == volumeSourceCSI {
+		source = p.csiVolumeSource(volumePath, backend.Name(), requestedStorage.String(), options.StorageClass.Parameters)
+	}
+	if sb, ok := backend.(SourceBackend); ok {
+		source = sb.VolumeSource(volumePath)
+		if !sb.NodeLocal() {
+			affinity = nil
+		}
+	}
 	pv := &corev1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: volumeName,
+			Name:        volumeName,
+			Annotations: annotations,
 		},
 		Spec: corev1.PersistentVolumeSpec{
 			Capacity: corev1.ResourceList{
-				corev1.ResourceStorage: options.PVC.Spec.Resources.Requests[corev1.ResourceStorage],
-			},
-			AccessModes:                   options.PVC.Spec.AccessModes,
-			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
-			PersistentVolumeSource: corev1.PersistentVolumeSource{
-				HostPath: &corev1.HostPathVolumeSource{
-					Path: volumePath,
-				},
+				corev1.ResourceStorage: capacity,
 			},
+			AccessModes:                   accessModes,
+			PersistentVolumeReclaimPolicy: policy.reclaimPolicy,
+			PersistentVolumeSource:        source,
+			// Match the claim's class so binding and class-based selectors see the same value, "" for classless claims
+			StorageClassName: options.StorageClass.Name,
 		},
 	}
 
-	// Return the PV, ProvisioningFinished and nil error to indicate success
+	pv.Spec.NodeAffinity = affinity
+
+	// Stamp the configured static labels, they win over anything already set on the PV
+	for k, v := range p.config.pvLabels {
+		if pv.Labels == nil {
+			pv.Labels = map[string]string{}
+		}
+		pv.Labels[k] = v
+	}
+
+	if p.config.emitReceipts {
+		p.writeReceipt(ctx, options.PVC, pv, volumePath)
+	}
+	phases.mark("pv-object")
+
+	// Return the PV, ProvisioningFinished and nil error to indicate success, leaving an audit trail on the PVC
+	uncommit = func() {}
 	klog.Infof("Successfully provisioned volume %s for PVC %s/%s", volumeName, options.PVC.Namespace, options.PVC.Name)
+	// Only now, so the retries of a deferred or failed attempt don't repeat the defaults on the PVC
+	p.reportDefaults(options.PVC, policy)
+	p.recorder.Eventf(options.PVC, corev1.EventTypeNormal, "Provisioned", "Provisioned volume %s at %s with backend %s", volumeName, volumePath, backend.Name())
 	return pv, controller.ProvisioningFinished, nil
 }
 
+// createVolume checks there is room for the volume under basePath and creates it with the given backend, marking
+// the end of each phase on phases
+func (p *customProvisioner) createVolume(ctx context.Context, backend VolumeBackend, basePath, volumeName, volumePath string, pvc *corev1.PersistentVolumeClaim, policy *volumePolicy, phases *phaseTimer) (controller.ProvisioningState, error) {
+	// Size the backing storage for the limit when there is one and pad it for filesystem overhead, the PV keeps
+	// reporting the requested capacity
+	quota := quotaSize(pvc)
+	backingBytes := paddedSize(quota.Value(), p.config.capacityPaddingPercent)
+	if backingBytes != quota.Value() {
+		klog.Infof("Volume %s is capped at %d bytes, using a backing size of %d bytes (%d%% padding)", volumeName, quota.Value(), backingBytes, p.config.capacityPaddingPercent)
+	}
+
+	// Make sure the base path has room for the volume, a full disk is node specific so ask for another node.
+	// Operators may let single PVCs overcommit, the inode check still applies to them.
+	var requestBytes int64
+	if p.config.checkFreeSpace {
+		requestBytes = backingBytes
+		if p.config.allowSkipSpaceCheck && pvc.Annotations[annSkipSpaceCheck] == "true" {
+			klog.Warningf("Skipping the free space check for PVC %s/%s as requested by its %s annotation, the volume may overcommit %s",
+				pvc.Namespace, pvc.Name, annSkipSpaceCheck, basePath)
+			p.recorder.Eventf(pvc, corev1.EventTypeWarning, "SpaceCheckSkipped", "Free space check skipped, the volume may overcommit the node")
+			requestBytes = 0
+		}
+	}
+	err := checkCapacity(basePath, requestBytes, p.config.minFreeInodes)
+	// Sparse reservations don't take space yet, their sizes are checked against the filesystem as a whole
+	if err == nil && backend.Name() == sparseReserveBackendName {
+		err = checkCommitted(basePath, backingBytes)
+	}
+	// tmpfs volumes live in RAM, don't add one to a node that is short on memory
+	if err == nil && backend.Name() == tmpfsBackendName && p.config.minFreeMemory.Quantity != nil {
+		err = checkFreeMemory(p.config.minFreeMemory.Value())
+	}
+	if err != nil {
+		if ce, ok := err.(*capacityCheckFailed); ok {
+			capacityCheckFailures.WithLabelValues(ce.reason).Inc()
+			return controller.ProvisioningReschedule, err
+		}
+		return controller.ProvisioningFinished, err
+	}
+	phases.mark("space-check")
+
+	// Backends that allow it build the volume in the staging directory and rename it into place once it's complete,
+	// so a crash never leaves a half made volume at the path a retry or the GC would trust
+	buildPath := volumePath
+	staged := stagingSupported(backend)
+	if staged {
+		buildPath = stagingPath(basePath, backend.Name(), volumeName)
+		err := p.fsOp(ctx, "prepare staging", buildPath, func() error { return p.prepareStaging(ctx, backend, buildPath) })
+		if isFSAbandoned(err) {
+			return controller.ProvisioningReschedule, err
+		}
+		if err != nil {
+			return controller.ProvisioningFinished, err
+		}
+	}
+
+	// Every failure from here on, a cancelled provision included, removes what was built so far, so no half made
+	// volume is left in the staging directory until the next sweep. It gets a context of its own, the provision's
+	// may be what ended.
+	built := false
+	defer func() {
+		if built {
+			return
+		}
+		if err := backend.Delete(context.Background(), buildPath); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("Failed to remove half made volume %s: %v", buildPath, err)
+		}
+	}()
+
+	// Create the volume with the selected backend
+	// An abandoned create is undone once it finishes, so a retry doesn't find a half made directory without a marker
+	err = p.fsOpWithCleanup(ctx, "create", buildPath, func() error {
+		if pb, ok := backend.(PreallocatingBackend); ok && pvc.Annotations[annAllocation] == allocationThick {
+			return pb.CreatePreallocated(ctx, buildPath, backingBytes, policy.dirMode)
+		}
+		return backend.Create(ctx, buildPath, backingBytes, policy.dirMode)
+	}, func() {
+		backend.Delete(context.Background(), buildPath)
+	})
+	if isFSAbandoned(err) {
+		// The create may still be running, its own cleanup undoes it once it finishes
+		built = true
+		return controller.ProvisioningReschedule, err
+	}
+	if err != nil {
+		return controller.ProvisioningFinished, fmt.Errorf("failed to create volume with backend %s: %v", backend.Name(), err)
+	}
+	phases.mark("mkdir")
+
+	// Hand the directory the parent's group before anything is written into it, so the marker gets the group too
+	if p.config.inheritParentGroup {
+		if err := inheritParentGroup(buildPath, filepath.Dir(volumePath)); err != nil {
+			return controller.ProvisioningFinished, err
+		}
+		phases.mark("chown-mode")
+	}
+
+	// Lay down the standard skeleton, a volume with half a skeleton is worse than none so failures undo the volume
+	if p.config.skeletonDir != "" {
+		err := p.fsOpWithCleanup(ctx, "copy skeleton", buildPath, func() error {
+			return copySkeleton(p.config.skeletonDir, buildPath, &p.config.skeletonModeMask)
+		}, func() {
+			backend.Delete(context.Background(), buildPath)
+		})
+		if isFSAbandoned(err) {
+			// Like an abandoned create, the copy may still be writing into the volume
+			built = true
+			return controller.ProvisioningReschedule, err
+		}
+		if err != nil {
+			return controller.ProvisioningFinished, fmt.Errorf("failed to copy skeleton %s into volume: %v", p.config.skeletonDir, err)
+		}
+		phases.mark("skeleton")
+	}
+
+	// Record the owning PVC so a retry can tell this directory apart from someone else's, pool directories
+	// are tracked through their marker so they always get one
+	if p.config.writeMarker || policy.reuseDir {
+		err := p.fsOpWithCleanup(ctx, "write marker", buildPath, func() error {
+			return writeMarker(buildPath, volumeName, backend.Name(), pvc, policy.reuseDir)
+		}, func() {
+			backend.Delete(context.Background(), buildPath)
+		})
+		if isFSAbandoned(err) {
+			built = true
+			return controller.ProvisioningReschedule, err
+		}
+		if err != nil {
+			return controller.ProvisioningFinished, err
+		}
+		phases.mark("marker-write")
+	}
+
+	// Make the volume's content durable before it shows up at its final path
+	if policy.durable && staged {
+		if err := syncDir(buildPath); err != nil {
+			return controller.ProvisioningFinished, err
+		}
+	}
+	if staged {
+		err := p.fsOp(ctx, "rename", volumePath, func() error { return os.Rename(buildPath, volumePath) })
+		if err != nil {
+			return controller.ProvisioningFinished, fmt.Errorf("failed to move volume into place: %v", err)
+		}
+		phases.mark("rename")
+	}
+	built = true
+
+	// Make the new directory entry (and the marker inside it) durable before the PV points at it, with the
+	// backend's own storage in between
+	if policy.durable {
+		err := syncDir(volumePath)
+		if sb, ok := backend.(SyncingBackend); ok && err == nil {
+			err = sb.Sync(volumePath)
+		}
+		if err == nil {
+			err = syncDir(basePath)
+		}
+		if err != nil {
+			backend.Delete(ctx, volumePath)
+			return controller.ProvisioningFinished, err
+		}
+		phases.mark("fsync")
+	}
+	return controller.ProvisioningFinished, nil
+}
+
 func (p *customProvisioner) Delete(ctx context.Context, volume *corev1.PersistentVolume) error {
-	// Validate whether the volume is a HostPath volume
-	if volume.Spec.HostPath == nil {
-		klog.Infof("Volume %s is not a HostPath volume, skipping deletion.", volume.Name)
+	klog.V(logCalls).Infof("Deleting PV %s (backend %s, reclaim policy %s)", volume.Name, volumeBackendName(volume), volume.Spec.PersistentVolumeReclaimPolicy)
+	ctx, span := tracer.Start(ctx, "Delete", trace.WithAttributes(
+		attribute.String("pv", volume.Name),
+		attribute.String("backend", volumeBackendName(volume)),
+	))
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		span.SetAttributes(attribute.String("pvc", ref.Namespace+"/"+ref.Name))
+	}
+	if capacity, ok := volume.Spec.Capacity[corev1.ResourceStorage]; ok {
+		span.SetAttributes(attribute.Int64("size", capacity.Value()))
+	}
+	done := p.stats.track(&p.stats.deletes, &p.stats.deleteErrors)
+	err := p.deleteVolume(ctx, volume)
+	done(err)
+	if err == nil {
+		p.committed.forget(volume.Name)
+		if p.config.emitReceipts {
+			p.deleteReceipt(ctx, volume)
+		}
+	}
+	endSpan(span, err)
+	return err
+}
+
+func (p *customProvisioner) deleteVolume(ctx context.Context, volume *corev1.PersistentVolume) error {
+	// Nothing is ever removed with --no-delete, the data stays behind the PV object going away
+	if p.config.noDelete {
+		klog.Infof("Not deleting data of volume %s, --no-delete is set", volume.Name)
+		deletesSkipped.Inc()
+		return nil
+	}
+	// Adopted directories belong to whoever pre-created them, whether or not --allow-adoption is still set
+	if volume.Annotations[annExternal] == "true" {
+		klog.Infof("Not deleting data of volume %s, its directory is externally managed", volume.Name)
 		return nil
 	}
 
-	// Get the volume path
-	volumePath := volume.Spec.HostPath.Path
+	// Find the directory behind the volume, whether it is exposed as a HostPath, Local, NFS or CSI source
+	volumePath, ok := volumeSourcePath(volume)
+	if !ok {
+		klog.Warningf("Volume %s has no source pointing at a directory of ours, skipping deletion.", volume.Name)
+		return nil
+	}
+	// A PV pointing into a protected part of the base path, or out of the pool entry it was made in, is refused and
+	// stays Released for an operator to look at
+	err := p.checkForbidden(volumePath)
+	if err == nil {
+		err = p.checkPoolBasePath(volume, volumePath)
+	}
+	if err != nil {
+		klog.Errorf("Refusing to delete volume %s: %v", volume.Name, err)
+		p.recorder.Eventf(volume, corev1.EventTypeWarning, "ForbiddenPath", "Refusing to delete %s: %v", volumePath, err)
+		return err
+	}
+
+	// The reclaim policy may have been switched to Retain after binding, the PV's own policy wins over the class
+	if volume.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimRetain {
+		klog.Infof("Volume %s has reclaim policy Retain, keeping its data", volume.Name)
+		return &controller.IgnoredError{Reason: fmt.Sprintf("volume %s has reclaim policy Retain", volume.Name)}
+	}
+
+	// Don't touch volumes an earlier Delete already gave up on
+	if err := abandonedDelete(volume); err != nil {
+		return err
+	}
+
+	// Let external cleanup such as a backup job say when the data may go, before taking a delete slot
+	if p.config.deletePreconditionFile != "" {
+		if err := p.waitDeletePrecondition(ctx, volume, volumePath); err != nil {
+			klog.Infof("Not deleting volume %s yet: %v", volume.Name, err)
+			return err
+		}
+	}
+
+	// Cap concurrent deletions so a storm of PVC deletions doesn't thrash the disk
+	if p.deleteSlots != nil {
+		select {
+		case p.deleteSlots <- struct{}{}:
+			defer func() { <-p.deleteSlots }()
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for a delete slot: %v", ctx.Err())
+		}
+	}
+
+	// Tear the volume down with the backend that created it, remote volumes are deleted by the agent on their node
+	backend, err := p.backendFor(volumeBackendName(volume))
+	if err != nil {
+		return fmt.Errorf("can't delete volume %s: %v", volume.Name, err)
+	}
+	if remote, ok := backend.(RemoteBackend); ok {
+		return p.deleteRemoteVolume(ctx, remote, volume)
+	}
+
+	// A stale mount could make the volume look gone or half there, retry until the mount probe says it's back
+	if err := p.mount.unavailable(); err != nil {
+		return fmt.Errorf("base path unavailable: %v", err)
+	}
+
+	// Hold the volume path's lock until the deletion is done
+	unlock := p.locks.lock(volumePath)
+	defer unlock()
 
-	// Check if the volume path exists
-	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+	// Check if the volume path exists, a timeout is returned so the controller retries
+	statErr := p.fsOp(ctx, "stat", volumePath, func() error {
+		_, err := os.Stat(volumePath)
+		return err
+	})
+	if isFSAbandoned(statErr) || p.checkMount(statErr) {
+		return statErr
+	}
+	if os.IsNotExist(statErr) {
 		klog.Infof("Volume path %s does not exist, nothing to delete.", volumePath)
 		return nil
 	}
 
-	// Delete the volume directory, using os.RemoveAll to delete the directory and its contents
-	klog.Infof("Deleting volume %s at path %s", volume.Name, volumePath)
-	if err := os.RemoveAll(volumePath); err != nil {
+	// Refuse to wipe a directory that was reused by another volume since this PV was provisioned
+	if p.config.verifyMarkerOnDelete {
+		if err := verifyMarkerOwner(volumePath, volume); err != nil {
+			klog.Errorf("Refusing to delete volume %s: %v", volume.Name, err)
+			p.recorder.Eventf(volume, corev1.EventTypeWarning, "VolumeOwnershipMismatch", "Refusing to delete %s: %v", volumePath, err)
+			return p.recordDeleteFailure(ctx, volume, err)
+		}
+	}
+
+	// Pool volumes are only emptied, their directory waits for the next claim
+	if volume.Annotations[annReuseDir] == "true" {
+		klog.Infof("Emptying volume %s at path %s and returning it to the pool", volume.Name, volumePath)
+		audit := auditEntry{Operation: auditRecycle, PV: volume.Name, Path: volumePath, Node: p.config.nodeName, PVCUID: claimUID(volume),
+			Backend: backend.Name(), BytesRemoved: p.auditBytes(ctx, volumePath)}
+		err := p.fsOp(ctx, "empty", volumePath, func() error { return releasePoolDir(volumePath, backend.Name()) })
+		p.audit.record(audit, err)
+		if err != nil {
+			klog.Errorf("Failed to empty volume %s at path %s: %v", volume.Name, volumePath, err)
+			return p.recordDeleteFailure(ctx, volume, err)
+		}
+		klog.Infof("Successfully returned volume %s at path %s to the pool", volume.Name, volumePath)
+		return nil
+	}
+
+	// Archived volumes move to the archive directory instead of away, the archive pruner removes them later
+	archive := volume.Annotations[annArchive] == "true"
+	if archive {
+		var err error
+		if archive, err = p.archiveFits(ctx, volume, volumePath); err != nil {
+			klog.Errorf("Failed to delete volume %s: %v", volume.Name, err)
+			return p.recordDeleteFailure(ctx, volume, err)
+		}
+	}
+	if archive {
+		klog.Infof("Archiving volume %s at path %s", volume.Name, volumePath)
+		audit := auditEntry{Operation: auditArchive, PV: volume.Name, Path: volumePath, Node: p.config.nodeName, PVCUID: claimUID(volume),
+			Backend: backend.Name(), BytesRemoved: p.auditBytes(ctx, volumePath)}
+		var archivePath string
+		err := p.fsOp(ctx, "archive", volumePath, func() error {
+			var err error
+			archivePath, err = p.archiveVolume(ctx, backend, p.volumeBasePath(volume), volume.Name, volumePath)
+			return err
+		})
+		p.audit.record(audit, err)
+		if err != nil {
+			klog.Errorf("Failed to archive volume %s at path %s: %v", volume.Name, volumePath, err)
+			return p.recordDeleteFailure(ctx, volume, err)
+		}
+		klog.Infof("Successfully archived volume %s to %s", volume.Name, archivePath)
+		return nil
+	}
+
+	klog.Infof("Deleting volume %s at path %s with backend %s", volume.Name, volumePath, backend.Name())
+	audit := auditEntry{Operation: auditDelete, PV: volume.Name, Path: volumePath, Node: p.config.nodeName, PVCUID: claimUID(volume),
+		Backend: backend.Name(), BytesRemoved: p.auditBytes(ctx, volumePath)}
+	err = p.fsOp(ctx, "remove", volumePath, func() error { return backend.Delete(ctx, volumePath) })
+	p.audit.record(audit, err)
+	if err != nil {
 		klog.Errorf("Failed to delete volume %s at path %s: %v", volume.Name, volumePath, err)
-		return err
+		return p.recordDeleteFailure(ctx, volume, err)
 	}
 
 	klog.Infof("Successfully deleted volume %s at path %s", volume.Name, volumePath)
 	return nil
 }
 
+// selectBackend returns the backend named by the PVC's backend annotation, or the default backend without one
+func (p *customProvisioner) selectBackend(pvc *corev1.PersistentVolumeClaim) (VolumeBackend, error) {
+	name, ok := pvc.Annotations[annBackend]
+	if !ok || name == p.backend.Name() {
+		return p.backend, nil
+	}
+	if !p.config.backendAllowed(name) {
+		return nil, fmt.Errorf("backend %q requested by annotation %s is not allowed, allowed backends: %s", name, annBackend, strings.Join(p.config.allowedBackends, ", "))
+	}
+	return p.backends[name], nil
+}
+
+// volumeBackendName returns the backend recorded on the PV, volumes from before backends existed are plain directories
+func volumeBackendName(volume *corev1.PersistentVolume) string {
+	if name, ok := volume.Annotations[annBackend]; ok {
+		return name
+	}
+	return hostPathBackendName
+}
+
+// backendFor returns the backend to delete a volume created by the named backend with
+func (p *customProvisioner) backendFor(name string) (VolumeBackend, error) {
+	if backend, ok := p.backends[name]; ok {
+		return backend, nil
+	}
+	return newBackend(name, p.config, p.client)
+}
+
+// checkBasePathWritable makes sure the base path exists and that we can actually create files in it,
+// so a wrong hostPath mount or a read-only filesystem shows up at startup instead of on the first PVC
+func checkBasePathWritable(basePath string) error {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return fmt.Errorf("failed to create base path %s: %v", basePath, err)
+	}
+
+	f, err := os.CreateTemp(basePath, ".write-test-")
+	if err != nil {
+		return fmt.Errorf("base path %s is not writable: %v", basePath, err)
+	}
+	f.Close()
+
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("failed to remove test file %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// provisionerName is the name StorageClasses refer to us by
+const provisionerName = "custom-provisioner"
+
 func main() {
+	// Subcommands run instead of the provisioner
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			klog.InitFlags(nil)
+			runMigrate(os.Args[2:])
+			return
+		case "agent":
+			klog.InitFlags(nil)
+			registerMetrics()
+			runAgent(os.Args[2:])
+			return
+		}
+	}
+
+	var cfg provisionerConfig
+	cfg.addFlags(flag.CommandLine)
+	adminTokenFile := flag.String("admin-token-file", "", "File holding the bearer token required by administrative endpoints such as POST /gc, they are disabled when empty")
+	httpAddress := flag.String("http-address", ":8080", "Address to serve /metrics and /healthz on, empty disables the HTTP server")
+	logLevel := flag.Int("log-level", 0, "Log verbosity, same as -v: 1 logs every Provision/Delete call, 2 the decisions taken, 4 every filesystem step. "+
+		"Use -vmodule=fsutil=4 to see only the filesystem steps")
+	volumeMetricsInterval := flag.Duration("volume-metrics-interval", 5*time.Minute, "How often the provisioner_volume_size_bytes and provisioner_volume_count metrics are recomputed from the PV list, 0 disables them")
+	usageScanInterval := flag.Duration("usage-scan-interval", 0, "How often the space used by every volume is measured for the provisioner_volume_used_bytes metric, 0 disables the scan")
+	usageScanWorkers := flag.Int("usage-scan-workers", 4, "Directories the usage scan reads in parallel")
+	nodeCapacityInterval := flag.Duration("node-capacity-interval", 0, "How often the running node's custom-provisioner/free-bytes and custom-provisioner/allocated-bytes annotations are refreshed, "+
+		"0 disables them; needs --node-name and RBAC to patch nodes")
+	nodeCapacityChangePercent := flag.Int("node-capacity-change-percent", 5, "Only patch the node's capacity annotations when a value moved by more than this percentage")
+	otelEndpoint := flag.String("otel-endpoint", "", "Optional OTLP/HTTP endpoint (host:port) to send provision/delete traces to, tracing is disabled when empty")
+	otelInsecure := flag.Bool("otel-insecure", false, "Send traces to the OTLP endpoint without TLS")
+	policyConfigMap := flag.String("policy-configmap", "", "Optional namespace/name of a ConfigMap with per-StorageClass defaults (minSize, maxSize, reclaimPolicy, dirMode), StorageClass parameters take precedence")
+	klog.InitFlags(nil)
+	flag.Parse()
+	if err := applyLogLevel(flag.CommandLine, *logLevel); err != nil {
+		klog.Fatalf("Invalid --log-level: %v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		klog.Fatalf("Invalid flags: %v", err)
+	}
+	removeProgressFiles, removeProgressInterval = cfg.deleteProgressFiles, cfg.deleteProgressInterval
+
+	// Tracing is optional, without an endpoint the global no-op tracer is used
+	if *otelEndpoint != "" {
+		shutdown, err := initTracing(context.Background(), *otelEndpoint, *otelInsecure)
+		if err != nil {
+			klog.Fatalf("Failed to initialize tracing: %v", err)
+		}
+		defer shutdown(context.Background())
+		klog.Infof("Sending traces to %s", *otelEndpoint)
+	}
+
 	// Use "InClusterConfig" to create a new clientset
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -114,10 +1055,184 @@ func main() {
 		klog.Fatalf("Failed to create clientset: %v", err)
 	}
 
-	provisioner := NewCustomProvisioner(clientset)
+	// Render a per-node base path from the running node's labels
+	if isBasePathTemplate(cfg.basePath) {
+		rendered, err := renderBasePath(context.Background(), clientset, cfg.basePath, cfg.nodeName)
+		if err != nil {
+			klog.Fatalf("Failed to resolve base path: %v", err)
+		}
+		klog.Infof("Base path %s resolved to %s on node %s", cfg.basePath, rendered, cfg.nodeName)
+		cfg.basePath = rendered
+	}
+
+	// Everything started below runs until SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Fail fast if the base path can't be written to, otherwise every Provision call would fail later
+	if err := checkBasePathWritable(cfg.basePath); err != nil {
+		klog.Fatalf("Base path self-test failed: %v", err)
+	}
+	for id, path := range cfg.basePathPool {
+		if err := checkBasePathWritable(path); err != nil {
+			klog.Fatalf("Self-test of base path %s failed: %v", id, err)
+		}
+	}
+	// Containment checks compare against the real directory, a symlinked base path keeps being used in PV sources
+	cfg.realBasePath, err = filepath.EvalSymlinks(cfg.basePath)
+	if err != nil {
+		klog.Fatalf("Failed to resolve base path %s: %v", cfg.basePath, err)
+	}
+	if cfg.realBasePath != filepath.Clean(cfg.basePath) {
+		klog.Infof("Base path %s resolves to %s", cfg.basePath, cfg.realBasePath)
+	}
+
+	// Events are recorded on PVCs and PVs under our own component name
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "custom-provisioner", Host: cfg.identity})
+
+	// Load and watch the per-StorageClass defaults if a policy ConfigMap was given
+	policies := newPolicyStore()
+	if *policyConfigMap != "" {
+		if err := policies.watch(clientset, *policyConfigMap, wait.NeverStop); err != nil {
+			klog.Fatalf("Failed to watch policy ConfigMap: %v", err)
+		}
+	}
+
+	// Initialize the default backend and every backend PVCs are allowed to select, after making sure the
+	// commands they run are installed
+	var enabled []string
+	seen := map[string]bool{}
+	for _, name := range append([]string{cfg.backend}, cfg.allowedBackends...) {
+		if !seen[name] {
+			seen[name] = true
+			enabled = append(enabled, name)
+		}
+	}
+	if cfg.checkTools {
+		if err := checkTools(enabled, cfg); err != nil {
+			klog.Fatalf("Backend dependency check failed: %v", err)
+		}
+	}
+	backends := map[string]VolumeBackend{}
+	for _, name := range enabled {
+		backend, err := newBackend(name, cfg, clientset)
+		if err != nil {
+			klog.Fatalf("Failed to initialize backend %s: %v", name, err)
+		}
+		backends[name] = backend
+	}
+
+	provisioner := NewCustomProvisioner(clientset, recorder, cfg, backends, policies)
+	if cfg.auditLog != "" {
+		audit, err := newAuditLog(cfg.auditLog, int64(cfg.auditLogMaxSizeMB)<<20, cfg.auditLogMaxBackups, cfg.identity)
+		if err != nil {
+			klog.Fatalf("Failed to open audit log: %v", err)
+		}
+		provisioner.audit = audit
+	}
+	// Bring back the directories of bound volumes lost with a disk, before their pods retry mounting them
+	if cfg.recreateMissingDirs {
+		if err := provisioner.recreateMissingDirs(ctx); err != nil {
+			klog.Errorf("Failed to recreate missing volume directories: %v", err)
+		}
+	}
+	// The committed ceiling needs to know what is already provisioned before the first PVC is admitted
+	if cfg.maxCommittedBytes.Quantity != nil {
+		if err := provisioner.seedCommitted(context.Background()); err != nil {
+			klog.Fatalf("Failed to seed committed bytes: %v", err)
+		}
+	}
+	go provisioner.toggleReadOnlyOnSignal()
+	if provisioner.annotations != nil {
+		go provisioner.annotations.run(context.Background())
+	}
+	if cfg.enableTTLReaper {
+		go provisioner.runTTLReaper(ctx, cfg.ttlReaperInterval)
+	}
+	if cfg.archiveRetention > 0 || cfg.archiveMaxSize.Quantity != nil {
+		go provisioner.runArchivePruner(ctx, cfg.archivePruneInterval)
+	}
+	if cfg.mountProbeInterval > 0 {
+		go provisioner.runMountProbe(ctx, cfg.mountProbeInterval)
+	}
+	if *nodeCapacityInterval > 0 {
+		if cfg.nodeName == "" {
+			klog.Fatalf("--node-capacity-interval needs --node-name")
+		}
+		go provisioner.runNodeCapacity(ctx, *nodeCapacityInterval, *nodeCapacityChangePercent)
+	}
+
+	if *httpAddress != "" {
+		var adminToken string
+		if *adminTokenFile != "" {
+			data, err := os.ReadFile(*adminTokenFile)
+			if err != nil {
+				klog.Fatalf("Failed to read admin token: %v", err)
+			}
+			adminToken = strings.TrimSpace(string(data))
+		}
+		registerMetrics()
+		if cfg.maintenanceWindow.set {
+			prometheus.MustRegister(provisioner.config.maintenanceWindow.nextStartGauge())
+		}
+		startHTTPServer(*httpAddress, provisioner, adminToken)
+		if *volumeMetricsInterval > 0 {
+			go provisioner.runVolumeStats(ctx, *volumeMetricsInterval)
+		}
+		if *usageScanInterval > 0 {
+			go provisioner.runUsageScanner(ctx, *usageScanInterval, *usageScanWorkers)
+		}
+	}
+
+	// Clear out volumes a crash left half built in the staging directory
+	if cfg.stagingMaxAge > 0 {
+		go func() {
+			if err := provisioner.sweepStaging(ctx, cfg.stagingMaxAge); err != nil {
+				klog.Errorf("Staging sweep failed: %v", err)
+			}
+		}()
+	}
+
+	// Look for volumes left behind without a PV once at startup, deleting them only with --gc-orphans and then
+	// only inside the maintenance window. /readyz waits for the scan, but not for the window or beyond the timeout.
+	go func() {
+		if cfg.gcOrphans && !provisioner.config.maintenanceWindow.open(time.Now()) {
+			provisioner.reconciled.Store(true)
+			if !provisioner.config.maintenanceWindow.waitOpen(ctx, "the startup orphan GC") {
+				return
+			}
+		}
+		if _, err := provisioner.collectOrphans(ctx); err != nil {
+			klog.Errorf("Startup orphan scan failed: %v", err)
+		}
+		provisioner.reconciled.Store(true)
+	}()
+	if cfg.reconcileTimeout > 0 {
+		time.AfterFunc(cfg.reconcileTimeout, func() {
+			if !provisioner.reconciled.Swap(true) {
+				klog.Warningf("Startup orphan scan still running after %v, reporting ready anyway", cfg.reconcileTimeout)
+			}
+		})
+	}
 
 	// Important!! Create a new ProvisionController instance and run it
-	pc := controller.NewProvisionController(clientset, "custom-provisioner", provisioner, controller.LeaderElection(false))
+	pc := controller.NewProvisionController(clientset, provisionerName, provisioner, controller.LeaderElection(false))
 	klog.Infof("Starting custom provisioner...")
-	pc.Run(context.Background())
+	// Run never returns without leader election, its workers stop picking up claims once ctx is done
+	go pc.Run(ctx)
+
+	// SIGTERM, SIGINT and anything else ending ctx land here, in-flight operations finish before the report
+	<-ctx.Done()
+	klog.Infof("Shutting down, waiting up to %v for running operations", cfg.shutdownDrainTimeout)
+	provisioner.drain(cfg.shutdownDrainTimeout)
+	if cfg.shutdownReport != "" {
+		if err := provisioner.writeShutdownReport(cfg.shutdownReport); err != nil {
+			klog.Errorf("Failed to write shutdown report: %v", err)
+		} else {
+			klog.Infof("Wrote shutdown report to %s", cfg.shutdownReport)
+		}
+	}
+	klog.Flush()
 }
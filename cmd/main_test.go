@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"flag"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns the flag defaults with a fresh temporary base path
+func newTestConfig(t *testing.T) provisionerConfig {
+	t.Helper()
+	var c provisionerConfig
+	c.addFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	c.basePath = t.TempDir()
+	c.realBasePath = c.basePath
+	c.identity = "test-provisioner"
+	c.nodeName = ""
+	if err := c.validate(); err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+	return c
+}
+
+// newTestProvisioner builds a provisioner on a fake clientset holding objects, with the hostpath backend plus any
+// extra backends given
+func newTestProvisioner(t *testing.T, config provisionerConfig, extra []VolumeBackend, objects ...runtime.Object) *customProvisioner {
+	t.Helper()
+	backends := map[string]VolumeBackend{hostPathBackendName: &hostPathBackend{}}
+	for _, b := range extra {
+		backends[b.Name()] = b
+	}
+	p := NewCustomProvisioner(fake.NewSimpleClientset(objects...), record.NewFakeRecorder(100), config, backends, newPolicyStore())
+	if b, ok := backends[config.backend]; ok {
+		p.backend = b
+	}
+	return p
+}
+
+// testPVC returns a 1Mi ReadWriteOnce claim
+func testPVC(namespace, name string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(namespace + "-" + name + "-uid")},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Mi")},
+			},
+		},
+	}
+}
+
+// testClass returns a StorageClass of ours without parameters
+func testClass(name string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}, Provisioner: provisionerName}
+}
+
+// cancellingBackend is the hostpath backend cancelling the provision as soon as Create starts, and finishing the
+// create only afterwards, like a slow disk outliving --provision-timeout
+type cancellingBackend struct {
+	hostPathBackend
+	cancel  context.CancelFunc
+	created chan struct{}
+}
+
+func (b *cancellingBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	defer close(b.created)
+	b.cancel()
+	time.Sleep(50 * time.Millisecond)
+	if err := b.hostPathBackend.Create(context.Background(), path, sizeBytes, mode); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(path, "data"), []byte("half made"), 0644)
+}
+
+func TestProvisionCancelledDuringCreate(t *testing.T) {
+	config := newTestConfig(t)
+	backend := &cancellingBackend{created: make(chan struct{})}
+	p := newTestProvisioner(t, config, nil)
+	p.backend = backend
+	p.backends[hostPathBackendName] = backend
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backend.cancel = cancel
+	pvc := testPVC("default", "cancelled")
+	pv, state, err := p.Provision(ctx, controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+	if err == nil || pv != nil {
+		t.Fatalf("Provision = %v, %v, want an error", pv, err)
+	}
+	if state != controller.ProvisioningReschedule {
+		t.Errorf("state = %s, want %s", state, controller.ProvisioningReschedule)
+	}
+
+	// The abandoned create owns the removal, it happens once the create is done
+	<-backend.created
+	staging := filepath.Join(config.basePath, stagingDirName, hostPathBackendName)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(staging)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("staging directory still holds %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(config.basePath, "pv-default-cancelled")); !os.IsNotExist(err) {
+		t.Errorf("volume path exists after a cancelled provision: %v", err)
+	}
+}
+
+func TestProvisionPreBoundPVC(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+	pvc := testPVC("default", "prebound")
+	pvc.Spec.VolumeName = "static-pv"
+
+	pv, state, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+	if err == nil || pv != nil {
+		t.Fatalf("Provision = %v, %v, want an error deferring to static binding", pv, err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("state = %s, want %s", state, controller.ProvisioningFinished)
+	}
+	entries, err := os.ReadDir(config.basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("base path holds %v after provisioning a pre-bound PVC", entries)
+	}
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pvs.Items) != 0 {
+		t.Errorf("%d PVs exist after provisioning a pre-bound PVC", len(pvs.Items))
+	}
+}
+
+// provisionTestVolume provisions pvc with the test class and fails the test unless that worked
+func provisionTestVolume(t *testing.T, p *customProvisioner, pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolume {
+	t.Helper()
+	pv, state, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+	if err != nil || state != controller.ProvisioningFinished {
+		t.Fatalf("Provision = %s, %v", state, err)
+	}
+	pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: pvc.Namespace, Name: pvc.Name, UID: pvc.UID}
+	return pv
+}
+
+func TestDeleteHonorsRetainSetAfterBinding(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+	pv := provisionTestVolume(t, p, testPVC("default", "retained"))
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimDelete {
+		t.Fatalf("provisioned with reclaim policy %s, want Delete", pv.Spec.PersistentVolumeReclaimPolicy)
+	}
+	data := filepath.Join(pv.Spec.HostPath.Path, "data")
+	if err := os.WriteFile(data, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An operator switches the bound PV to Retain, the class still says Delete
+	pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+	err := p.Delete(context.Background(), pv)
+	if _, ok := err.(*controller.IgnoredError); !ok {
+		t.Errorf("Delete = %v, want an IgnoredError", err)
+	}
+	content, err := os.ReadFile(data)
+	if err != nil || string(content) != "keep me" {
+		t.Errorf("data after Delete = %q, %v, want it kept", content, err)
+	}
+}
+
+func TestProvisionStampsStorageClassName(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+
+	pv, _, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: testPVC("default", "classed"), StorageClass: testClass("fast")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Spec.StorageClassName != "fast" {
+		t.Errorf("storageClassName = %q, want fast", pv.Spec.StorageClassName)
+	}
+
+	// A classless claim gets a classless PV, so it still binds
+	pv, _, err = p.Provision(context.Background(), controller.ProvisionOptions{PVC: testPVC("default", "classless")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Spec.StorageClassName != "" {
+		t.Errorf("storageClassName of a classless claim = %q, want it empty", pv.Spec.StorageClassName)
+	}
+}
+
+// exportingBackend stands in for the nfs backend, it keeps plain hostpath directories without touching exports
+type exportingBackend struct {
+	hostPathBackend
+}
+
+func (b *exportingBackend) Name() string { return nfsBackendName }
+
+func TestDeleteRoutesPerVolumeSource(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, []VolumeBackend{&exportingBackend{}})
+	sources := map[string]func(path string) (corev1.PersistentVolumeSource, string){
+		"hostpath": func(path string) (corev1.PersistentVolumeSource, string) {
+			return corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: path}}, hostPathBackendName
+		},
+		"local": func(path string) (corev1.PersistentVolumeSource, string) {
+			return corev1.PersistentVolumeSource{Local: &corev1.LocalVolumeSource{Path: path}}, hostPathBackendName
+		},
+		"nfs": func(path string) (corev1.PersistentVolumeSource, string) {
+			return corev1.PersistentVolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs.example", Path: path}}, nfsBackendName
+		},
+		"csi": func(path string) (corev1.PersistentVolumeSource, string) {
+			return corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: provisionerName, VolumeHandle: path,
+				VolumeAttributes: map[string]string{csiPathAttribute: path}}}, hostPathBackendName
+		},
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(config.basePath, "pv-"+name)
+			if err := os.Mkdir(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			spec, backend := source(path)
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-" + name, Annotations: map[string]string{annBackend: backend}},
+				Spec:       corev1.PersistentVolumeSpec{PersistentVolumeSource: spec, PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete},
+			}
+			if err := p.Delete(context.Background(), pv); err != nil {
+				t.Fatalf("Delete = %v", err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("volume directory still there: %v", err)
+			}
+		})
+	}
+
+	// An NFS source of another backend points at a server's path, never at ours
+	path := filepath.Join(config.basePath, "pv-foreign")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-foreign"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs.example", Path: path}}},
+	}
+	if err := p.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("Delete = %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("directory behind a foreign NFS source was removed: %v", err)
+	}
+}
+
+func TestDeleteThroughSymlinkedBase(t *testing.T) {
+	config := newTestConfig(t)
+	config.basePath, config.realBasePath = symlinkedBase(t)
+	config.forbiddenSubpaths = []string{".system"}
+	p := newTestProvisioner(t, config, nil)
+	pv := provisionTestVolume(t, p, testPVC("default", "linked"))
+
+	// The PV records the path with the symlink resolved, it still names the same directory
+	pv.Spec.HostPath.Path = filepath.Join(config.realBasePath, pv.Name)
+	if err := p.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("Delete = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.basePath, pv.Name)); !os.IsNotExist(err) {
+		t.Errorf("volume directory still there: %v", err)
+	}
+
+	// A protected directory is refused whichever way the PV names it
+	system := filepath.Join(config.realBasePath, ".system")
+	if err := os.Mkdir(system, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pv.Spec.HostPath.Path = system
+	if err := p.Delete(context.Background(), pv); err == nil {
+		t.Errorf("Delete of %s succeeded, want it refused", system)
+	}
+	if _, err := os.Stat(system); err != nil {
+		t.Errorf("protected directory was removed: %v", err)
+	}
+}
+
+func TestProvisionRetriesAfterPersistFailure(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+	pvc := testPVC("default", "unsaved")
+	first := provisionTestVolume(t, p, pvc)
+	data := filepath.Join(first.Spec.HostPath.Path, "data")
+	if err := os.WriteFile(data, []byte("written early"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The controller failed to save the PV and calls Provision again for the same claim
+	second := provisionTestVolume(t, p, pvc)
+	if second.Name != first.Name || second.Spec.HostPath.Path != first.Spec.HostPath.Path {
+		t.Errorf("retry provisioned %s at %s, want %s at %s", second.Name, second.Spec.HostPath.Path, first.Name, first.Spec.HostPath.Path)
+	}
+	if content, err := os.ReadFile(data); err != nil || string(content) != "written early" {
+		t.Errorf("data after the retry = %q, %v, want it kept", content, err)
+	}
+
+	// Another claim of the same name doesn't take the directory over
+	other := testPVC("default", "unsaved")
+	other.UID = "other-uid"
+	if pv, _, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: other, StorageClass: testClass("test")}); err == nil {
+		t.Errorf("Provision for another claim = %s, want an error", pv.Spec.HostPath.Path)
+	}
+}
+
+// recordedEvents drains the events the fake recorder of p has seen so far
+func recordedEvents(p *customProvisioner) []string {
+	var events []string
+	for {
+		select {
+		case event := <-p.recorder.(*record.FakeRecorder).Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestProvisionWithoutStorageClass(t *testing.T) {
+	config := newTestConfig(t)
+	config.defaultReclaimPolicy = string(corev1.PersistentVolumeReclaimRetain)
+	p := newTestProvisioner(t, config, nil)
+
+	pv, state, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: testPVC("default", "legacy")})
+	if err != nil || state != controller.ProvisioningFinished {
+		t.Fatalf("Provision = %s, %v", state, err)
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		t.Errorf("reclaim policy = %s, want the --default-reclaim-policy Retain", pv.Spec.PersistentVolumeReclaimPolicy)
+	}
+	if _, err := os.Stat(pv.Spec.HostPath.Path); err != nil {
+		t.Errorf("volume directory missing: %v", err)
+	}
+	var warned bool
+	for _, event := range recordedEvents(p) {
+		if strings.HasPrefix(event, "Warning DefaultApplied PVC has no StorageClass") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("no DefaultApplied warning for a PVC without a StorageClass")
+	}
+}
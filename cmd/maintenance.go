@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a daily UTC time range destructive background tasks are confined to, the TTL reaper,
+// archive pruning and orphan GC. A range whose end is before its start wraps past midnight. The zero value has
+// no window, so everything may run at any time. Provisioning and deletes of PVs the user released are never gated.
+type maintenanceWindow struct {
+	set        bool
+	start, end time.Duration
+}
+
+func (w *maintenanceWindow) String() string {
+	if w == nil || !w.set {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", clockString(w.start), clockString(w.end))
+}
+
+// Set parses HH:MM-HH:MM
+func (w *maintenanceWindow) Set(value string) error {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return fmt.Errorf("expected HH:MM-HH:MM in UTC, e.g. 02:00-04:00")
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("maintenance window %s is empty", value)
+	}
+	*w = maintenanceWindow{set: true, start: start, end: end}
+	return nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func clockString(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// open reports whether now falls inside the window, always true without one
+func (w *maintenanceWindow) open(now time.Time) bool {
+	if !w.set {
+		return true
+	}
+	now = now.UTC()
+	offset := now.Sub(now.Truncate(24 * time.Hour))
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// nextStart returns when the window opens next, now while it is open
+func (w *maintenanceWindow) nextStart(now time.Time) time.Time {
+	if w.open(now) {
+		return now
+	}
+	now = now.UTC()
+	next := now.Truncate(24 * time.Hour).Add(w.start)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// waitOpen blocks until the window is open, returning false when ctx ends first
+func (w *maintenanceWindow) waitOpen(ctx context.Context, task string) bool {
+	now := time.Now()
+	if w.open(now) {
+		return true
+	}
+	next := w.nextStart(now)
+	klog.Infof("Deferring %s to the maintenance window opening at %s", task, next.Format(time.RFC3339))
+	timer := time.NewTimer(next.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// nextStartGauge exposes when the window opens next as a Unix timestamp, the current time while it is open
+func (w *maintenanceWindow) nextStartGauge() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "provisioner_maintenance_window_next_start_timestamp_seconds",
+		Help: "When the maintenance window gating the TTL reaper, archive pruning and orphan GC opens next, the current time while it is open.",
+	}, func() float64 {
+		return float64(w.nextStart(time.Now()).Unix())
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"time"
+)
+
+// markerFileName is written into every volume we create, recording which PVC the directory belongs to
+const markerFileName = ".custom-provisioner.json"
+
+// volumeMarker is the content of the ownership marker file
+type volumeMarker struct {
+	PVName       string    `json:"pvName"`
+	PVCNamespace string    `json:"pvcNamespace"`
+	PVCName      string    `json:"pvcName"`
+	PVCUID       string    `json:"pvcUID"`
+	Backend      string    `json:"backend,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	// SizeBytes is the storage the PVC requested, 0 when unknown. Pool directories keep it while free, so a
+	// claim is only handed a directory that was sized for at least its request.
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// Pool marks a directory that is emptied and kept for reuse instead of deleted, see the reuseDir parameter
+	Pool bool `json:"pool,omitempty"`
+	// Free marks a pool directory no volume is using, the PVC fields are empty then
+	Free bool `json:"free,omitempty"`
+}
+
+// writeMarker records the owning PVC inside the volume directory
+func writeMarker(volumePath, pvName, backend string, pvc *corev1.PersistentVolumeClaim, pool bool) error {
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	return storeMarker(volumePath, volumeMarker{
+		PVName:       pvName,
+		PVCNamespace: pvc.Namespace,
+		PVCName:      pvc.Name,
+		PVCUID:       string(pvc.UID),
+		Backend:      backend,
+		CreatedAt:    time.Now().UTC(),
+		SizeBytes:    requested.Value(),
+		Pool:         pool,
+	})
+}
+
+func storeMarker(volumePath string, m volumeMarker) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(volumePath, markerFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write ownership marker: %v", err)
+	}
+	return nil
+}
+
+// readMarker returns the ownership marker of the volume directory
+func readMarker(volumePath string) (*volumeMarker, error) {
+	data, err := os.ReadFile(filepath.Join(volumePath, markerFileName))
+	if err != nil {
+		return nil, err
+	}
+	var m volumeMarker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid ownership marker in %s: %v", volumePath, err)
+	}
+	return &m, nil
+}
+
+// resumeExistingVolume decides whether an existing volume directory can be reused for the PVC, treating it as
+// the leftover of an earlier attempt whose PV never made it to the API server, e.g. after a controller restart.
+// The directory is refused when a PV of that name exists for another claim, when its marker names a different
+// PVC that is still active, or when it was created by another backend. A directory of a PVC that is gone is only
+// taken over once its marker is older than --stale-volume-grace, and its marker is then rewritten for this PVC.
+func (p *customProvisioner) resumeExistingVolume(ctx context.Context, volumeName, volumePath string, backend VolumeBackend, pvc *corev1.PersistentVolumeClaim) (controller.ProvisioningState, error) {
+	m, markerErr := readMarker(volumePath)
+	if markerErr == nil && m.PVCUID == string(pvc.UID) {
+		return controller.ProvisioningFinished, nil
+	}
+
+	// A PV of this name holds on to the directory, e.g. a Released volume of an older claim with the same name
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, volumeName, metav1.GetOptions{})
+	if err == nil {
+		if pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.UID == pvc.UID {
+			return controller.ProvisioningFinished, nil
+		}
+		return controller.ProvisioningFinished, fmt.Errorf("volume %s already exists at %s and belongs to PV %s", volumeName, volumePath, pv.Name)
+	}
+	if !apierrors.IsNotFound(err) {
+		return controller.ProvisioningInBackground, fmt.Errorf("failed to check for an existing PV %s: %v", volumeName, err)
+	}
+
+	if os.IsNotExist(markerErr) || !p.config.writeMarker {
+		// No marker to go by: the directory name is derived from this PVC, so it's the leftover of a crash before the
+		// marker was written, or a volume from before markers
+		klog.Infof("Volume %s at %s has no ownership marker and no PV, resuming it for PVC %s/%s", volumeName, volumePath, pvc.Namespace, pvc.Name)
+		return p.adoptExistingVolume(volumeName, volumePath, backend, pvc)
+	}
+	if markerErr != nil {
+		return controller.ProvisioningFinished, fmt.Errorf("volume %s already exists at %s: %v", volumeName, volumePath, markerErr)
+	}
+	if markerBackend(m) != backend.Name() {
+		return controller.ProvisioningFinished, fmt.Errorf("volume %s already exists at %s and was created by the %s backend", volumeName, volumePath, markerBackend(m))
+	}
+
+	owner, err := p.client.CoreV1().PersistentVolumeClaims(m.PVCNamespace).Get(ctx, m.PVCName, metav1.GetOptions{})
+	switch {
+	case err == nil && string(owner.UID) == m.PVCUID && owner.DeletionTimestamp == nil:
+		return controller.ProvisioningFinished, fmt.Errorf("volume %s already exists at %s and belongs to active PVC %s/%s", volumeName, volumePath, m.PVCNamespace, m.PVCName)
+	case err != nil && !apierrors.IsNotFound(err):
+		return controller.ProvisioningInBackground, fmt.Errorf("failed to check owner %s/%s of existing volume %s: %v", m.PVCNamespace, m.PVCName, volumeName, err)
+	}
+	if age := time.Since(m.CreatedAt); age < p.config.staleVolumeGrace {
+		return controller.ProvisioningReschedule, fmt.Errorf("volume %s already exists at %s for deleted PVC %s/%s, it can be taken over in %v",
+			volumeName, volumePath, m.PVCNamespace, m.PVCName, (p.config.staleVolumeGrace - age).Round(time.Second))
+	}
+	klog.Warningf("Volume %s at %s belonged to PVC %s/%s (UID %s) which no longer exists, resuming it for PVC %s/%s",
+		volumeName, volumePath, m.PVCNamespace, m.PVCName, m.PVCUID, pvc.Namespace, pvc.Name)
+	return p.adoptExistingVolume(volumeName, volumePath, backend, pvc)
+}
+
+// adoptExistingVolume records the PVC as the owner of a directory being resumed
+func (p *customProvisioner) adoptExistingVolume(volumeName, volumePath string, backend VolumeBackend, pvc *corev1.PersistentVolumeClaim) (controller.ProvisioningState, error) {
+	if !p.config.writeMarker {
+		return controller.ProvisioningFinished, nil
+	}
+	if err := writeMarker(volumePath, volumeName, backend.Name(), pvc, false); err != nil {
+		return controller.ProvisioningInBackground, err
+	}
+	return controller.ProvisioningFinished, nil
+}
+
+// verifyMarkerOwner makes sure the directory still belongs to the claim the PV was bound to, so a path that got
+// reused by another volume is never wiped. Volumes without a marker (created before markers, or with
+// --write-marker=false) can't be checked and pass.
+func verifyMarkerOwner(volumePath string, volume *corev1.PersistentVolume) error {
+	m, err := readMarker(volumePath)
+	if os.IsNotExist(err) {
+		klog.Warningf("Volume %s at %s has no ownership marker, deleting without verification", volume.Name, volumePath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if volume.Spec.ClaimRef == nil || m.PVCUID != string(volume.Spec.ClaimRef.UID) {
+		claimUID := "<none>"
+		if volume.Spec.ClaimRef != nil {
+			claimUID = string(volume.Spec.ClaimRef.UID)
+		}
+		return fmt.Errorf("ownership marker in %s belongs to PVC %s/%s (UID %s) but PV %s was bound to UID %s",
+			volumePath, m.PVCNamespace, m.PVCName, m.PVCUID, volume.Name, claimUID)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller/metrics"
+)
+
+var (
+	// capacityCheckFailures counts provisions refused by the pre-provision check, reason is "bytes", "inodes",
+	// "committed" (sparse reservations) or "remote" (a full storage agent)
+	capacityCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "provisioner_capacity_check_failures_total",
+		Help: "Number of provision attempts rejected because the base path was low on free bytes, inodes or uncommitted space, at --max-committed-bytes, or the node was below --min-free-memory for a tmpfs volume.",
+	}, []string{"reason"})
+
+	// defaultsApplied counts provisions that fell back to a default, reason is the StorageClass parameter that was
+	// defaulted or "storageClass" for PVCs without a class
+	defaultsApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "provisioner_defaults_applied_total",
+		Help: "Number of times provisioning used a default because the PVC or its StorageClass didn't say otherwise.",
+	}, []string{"reason"})
+
+	// deletesSkipped counts the deletes --no-delete turned into no-ops
+	deletesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "provisioner_deletes_skipped_total",
+		Help: "Number of volume deletes skipped without touching the data because of --no-delete.",
+	})
+
+	// readOnlyMode is 1 while provisioning is frozen by read-only mode
+	readOnlyMode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "provisioner_read_only",
+		Help: "Whether the provisioner is in read-only mode (1) or provisioning normally (0).",
+	})
+)
+
+// registerMetrics registers our metrics together with the ones the provision controller updates,
+// the controller only registers its own when it serves metrics itself which we don't let it do
+func registerMetrics() {
+	prometheus.MustRegister(
+		capacityCheckFailures,
+		classDeferred,
+		classInFlight,
+		classWaiting,
+		defaultsApplied,
+		deleteProgress,
+		deletesSkipped,
+		mkfsDuration,
+		mkfsWait,
+		poolReuse,
+		provisionPhaseDuration,
+		readOnlyMode,
+		volumeStats,
+		volumeUsedBytes,
+		metrics.M.PersistentVolumeClaimProvisionTotal,
+		metrics.M.PersistentVolumeClaimProvisionFailedTotal,
+		metrics.M.PersistentVolumeClaimProvisionDurationSeconds,
+		metrics.M.PersistentVolumeDeleteTotal,
+		metrics.M.PersistentVolumeDeleteFailedTotal,
+		metrics.M.PersistentVolumeDeleteDurationSeconds,
+	)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// annProvisionedBy is set by the provision controller on every PV it created for us
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+	// migrateJournalDir keeps a copy of every PV being recreated under the new base, so an interrupted run can finish it
+	migrateJournalDir = ".migrate-journal"
+	// migratingSuffix marks a directory that is still being copied across filesystems
+	migratingSuffix = ".migrating"
+)
+
+// runMigrate implements "custom-provisioner migrate --from <old> --to <new>": it moves the directory of every PV we
+// provisioned under the old base path to the new one and repoints the PV. PV sources are immutable, so each PV is
+// recreated with the same name and claimRef; workloads using the volumes should be stopped while migrating.
+// Every step can be repeated, so simply run the command again if it was interrupted.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "Old base path the volumes live under")
+	to := fs.String("to", "", "New base path to move the volumes to")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be moved")
+	kubeconfig := fs.String("kubeconfig", "", "Path to a kubeconfig, the in-cluster config is used when empty")
+	fs.Parse(args)
+
+	if *from == "" || *to == "" {
+		klog.Fatalf("Both --from and --to are required")
+	}
+	oldBase, newBase := filepath.Clean(*from), filepath.Clean(*to)
+	if oldBase == newBase {
+		klog.Fatalf("--from and --to are the same path")
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		klog.Fatalf("Failed to create client config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create clientset: %v", err)
+	}
+
+	m := &migration{client: clientset, oldBase: oldBase, newBase: newBase, dryRun: *dryRun}
+	if err := m.run(context.Background()); err != nil {
+		klog.Fatalf("Migration failed: %v", err)
+	}
+}
+
+type migration struct {
+	client  kubernetes.Interface
+	oldBase string
+	newBase string
+	dryRun  bool
+}
+
+func (m *migration) run(ctx context.Context) error {
+	journal := filepath.Join(m.newBase, migrateJournalDir)
+	if !m.dryRun {
+		if err := os.MkdirAll(journal, 0700); err != nil {
+			return fmt.Errorf("failed to create journal directory: %v", err)
+		}
+		// Finish PVs a previous run deleted but didn't get to recreate
+		if err := m.replayJournal(ctx, journal); err != nil {
+			return err
+		}
+	}
+
+	pvs, err := m.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	var moved, skipped int
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Annotations[annProvisionedBy] != provisionerName || pv.Spec.HostPath == nil {
+			continue
+		}
+		rel, err := filepath.Rel(m.oldBase, filepath.Clean(pv.Spec.HostPath.Path))
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			skipped++
+			continue
+		}
+		src, dst := pv.Spec.HostPath.Path, filepath.Join(m.newBase, rel)
+
+		if m.dryRun {
+			klog.Infof("Would move PV %s from %s to %s", pv.Name, src, dst)
+			moved++
+			continue
+		}
+		if err := moveDir(src, dst); err != nil {
+			return fmt.Errorf("failed to move volume of PV %s: %v", pv.Name, err)
+		}
+		if err := m.recreatePV(ctx, journal, pv, dst); err != nil {
+			return fmt.Errorf("failed to repoint PV %s: %v", pv.Name, err)
+		}
+		klog.Infof("Moved PV %s from %s to %s", pv.Name, src, dst)
+		moved++
+	}
+
+	klog.Infof("Migration done: %d volume(s) moved, %d PV(s) not under %s skipped (dry run: %v)", moved, skipped, m.oldBase, m.dryRun)
+	return nil
+}
+
+// moveDir moves src to dst, renaming when possible and copying across filesystems otherwise.
+// A dst that already exists without src means an earlier run finished the move.
+func moveDir(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+		return fmt.Errorf("neither %s nor %s exists", src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// Different filesystems: copy into a staging name first so a half copied directory is never mistaken for done
+	staging := dst + migratingSuffix
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := runCommand(context.Background(), "cp", "-a", src, staging); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// recreatePV replaces pv with an identical PV whose HostPath is newPath. The old PV is set to Retain first so
+// deleting it never triggers our Delete, and the new one is journaled before the old one goes away.
+func (m *migration) recreatePV(ctx context.Context, journal string, pv *corev1.PersistentVolume, newPath string) error {
+	replacement := pv.DeepCopy()
+	replacement.ObjectMeta = metav1.ObjectMeta{
+		Name:        pv.Name,
+		Labels:      pv.Labels,
+		Annotations: pv.Annotations,
+		Finalizers:  pv.Finalizers,
+	}
+	replacement.Spec.HostPath.Path = newPath
+	replacement.Status = corev1.PersistentVolumeStatus{}
+
+	data, err := json.Marshal(replacement)
+	if err != nil {
+		return err
+	}
+	journalFile := filepath.Join(journal, pv.Name+".json")
+	if err := os.WriteFile(journalFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to journal PV: %v", err)
+	}
+
+	pvs := m.client.CoreV1().PersistentVolumes()
+	retain := []byte(`{"spec":{"persistentVolumeReclaimPolicy":"Retain"}}`)
+	if _, err := pvs.Patch(ctx, pv.Name, types.MergePatchType, retain, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set Retain: %v", err)
+	}
+	if err := pvs.Delete(ctx, pv.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete: %v", err)
+	}
+	// The pv-protection finalizer keeps a bound PV around, drop it so the old object actually goes away
+	noFinalizers := []byte(`{"metadata":{"finalizers":null}}`)
+	if _, err := pvs.Patch(ctx, pv.Name, types.MergePatchType, noFinalizers, metav1.PatchOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to remove finalizers: %v", err)
+	}
+	return m.createFromJournal(ctx, journalFile)
+}
+
+// createFromJournal creates the PV stored in the journal file and removes the file once that worked
+func (m *migration) createFromJournal(ctx context.Context, journalFile string) error {
+	data, err := os.ReadFile(journalFile)
+	if err != nil {
+		return err
+	}
+	var pv corev1.PersistentVolume
+	if err := json.Unmarshal(data, &pv); err != nil {
+		return fmt.Errorf("invalid journal file %s: %v", journalFile, err)
+	}
+
+	pvs := m.client.CoreV1().PersistentVolumes()
+	for {
+		_, err := pvs.Create(ctx, &pv, metav1.CreateOptions{})
+		if err == nil {
+			break
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create PV %s: %v", pv.Name, err)
+		}
+		// Either the old object is still being deleted, or an earlier run already created the replacement
+		existing, err := pvs.Get(ctx, pv.Name, metav1.GetOptions{})
+		if err == nil && existing.DeletionTimestamp == nil {
+			if existing.Spec.HostPath == nil || existing.Spec.HostPath.Path != pv.Spec.HostPath.Path {
+				return fmt.Errorf("PV %s exists and does not point at %s", pv.Name, pv.Spec.HostPath.Path)
+			}
+			break
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return os.Remove(journalFile)
+}
+
+// replayJournal recreates the PVs left in the journal by an interrupted run
+func (m *migration) replayJournal(ctx context.Context, journal string) error {
+	entries, err := os.ReadDir(journal)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		klog.Infof("Finishing interrupted migration of PV %s", strings.TrimSuffix(entry.Name(), ".json"))
+		if err := m.createFromJournal(ctx, filepath.Join(journal, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
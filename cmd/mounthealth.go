@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"k8s.io/klog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// isStaleMountError reports whether err means the filesystem under a path went away rather than the path itself,
+// e.g. a stale NFS handle, a FUSE daemon that died or an NFS server that can't be reached
+func isStaleMountError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ESTALE, syscall.ENOTCONN, syscall.EHOSTDOWN, syscall.EHOSTUNREACH} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountHealth tracks whether the base path's filesystem is usable. Once marked unavailable, provisions are
+// rescheduled and deletes retried without touching the half-mounted path, until a probe finds it healthy again.
+type mountHealth struct {
+	mu  sync.Mutex
+	err error
+}
+
+// unavailable returns why the base path can't be used, nil when it can
+func (m *mountHealth) unavailable() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *mountHealth) set(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil && m.err == nil {
+		klog.Errorf("Base path became unavailable, pausing provisioning and deletion: %v", err)
+	} else if err == nil && m.err != nil {
+		klog.Infof("Base path is available again, resuming")
+	}
+	m.err = err
+}
+
+// checkMount reports whether err says the base path's mount went stale and marks it unavailable if so. Without
+// probing nothing would ever mark it available again, then the error is only reported.
+func (p *customProvisioner) checkMount(err error) bool {
+	if !isStaleMountError(err) {
+		return false
+	}
+	if p.config.mountProbeInterval <= 0 {
+		return true
+	}
+	p.mount.set(fmt.Errorf("%s: %v", p.config.basePath, err))
+	return true
+}
+
+// probeMount stats and lists the base path, both hang or fail on a stale mount
+func (p *customProvisioner) probeMount(ctx context.Context) error {
+	return p.fsOp(ctx, "probe", p.config.basePath, func() error {
+		if _, err := os.Stat(p.config.basePath); err != nil {
+			return err
+		}
+		f, err := os.Open(p.config.basePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Readdirnames(1)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return err
+	})
+}
+
+// runMountProbe re-probes the base path every interval until ctx is cancelled. Any probe failure keeps the
+// provisioner unavailable, only a clean probe makes it available again.
+func (p *customProvisioner) runMountProbe(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.probeMount(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			p.mount.set(fmt.Errorf("%s: %v", p.config.basePath, err))
+		} else {
+			p.mount.set(nil)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
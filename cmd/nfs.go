@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	nfsBackendName = "nfs"
+	// defaultNFSExportOptions gives every client read-write access, override them with --nfs-export-options
+	defaultNFSExportOptions = "*(rw,sync,no_subtree_check,no_root_squash)"
+	// nfsExportComment tags the lines we add, so lines an operator wrote are never touched
+	nfsExportComment = "# custom-provisioner"
+)
+
+// SourceBackend is implemented by backends whose volumes are not consumed as a HostPath on this node
+type SourceBackend interface {
+	VolumeBackend
+	// VolumeSource returns the source the PV uses for the volume at path
+	VolumeSource(path string) corev1.PersistentVolumeSource
+	// NodeLocal reports whether pods using the volume must run on the node holding it
+	NodeLocal() bool
+}
+
+// csiPathAttribute is the CSI volume attribute holding the directory of a volume we serve through CSI
+const csiPathAttribute = "path"
+
+// volumeSourcePath returns the local path behind a PV we created, whatever source type it is exposed through.
+// NFS sources only count for our nfs backend, other NFS PVs point at a server's path, not ours.
+func volumeSourcePath(volume *corev1.PersistentVolume) (string, bool) {
+	switch {
+	case volume.Spec.HostPath != nil:
+		return volume.Spec.HostPath.Path, true
+	case volume.Spec.Local != nil:
+		return volume.Spec.Local.Path, true
+	case volume.Spec.NFS != nil && volumeBackendName(volume) == nfsBackendName:
+		return volume.Spec.NFS.Path, true
+	case volume.Spec.CSI != nil && volume.Spec.CSI.VolumeAttributes[csiPathAttribute] != "":
+		return volume.Spec.CSI.VolumeAttributes[csiPathAttribute], true
+	default:
+		return "", false
+	}
+}
+
+// nfsBackend creates plain directories and exports each of them through the node's NFS server, so the volume can
+// be mounted ReadWriteMany from any node. Exports are lines in the exports file tagged with nfsExportComment.
+type nfsBackend struct {
+	hostPathBackend
+	server        string
+	exportOptions string
+	exportsFile   string
+	// mu serializes edits of the exports file
+	mu sync.Mutex
+}
+
+func newNFSBackend(config provisionerConfig) (*nfsBackend, error) {
+	if config.nfsServer == "" {
+		return nil, fmt.Errorf("the nfs backend needs --nfs-server, the address clients mount the exports from")
+	}
+	if strings.ContainsAny(config.nfsExportOptions, "\n#") {
+		return nil, fmt.Errorf("invalid --nfs-export-options %q", config.nfsExportOptions)
+	}
+	if _, err := os.Stat(config.nfsExportsFile); err != nil {
+		return nil, fmt.Errorf("exports file: %v", err)
+	}
+	return &nfsBackend{
+		server:        config.nfsServer,
+		exportOptions: config.nfsExportOptions,
+		exportsFile:   config.nfsExportsFile,
+	}, nil
+}
+
+func (b *nfsBackend) Name() string {
+	return nfsBackendName
+}
+
+func (b *nfsBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	if strings.ContainsAny(path, " \t\n") {
+		return fmt.Errorf("path %q can't be exported, it contains whitespace", path)
+	}
+	if err := b.hostPathBackend.Create(ctx, path, sizeBytes, mode); err != nil {
+		return err
+	}
+	if err := b.editExports(ctx, path, true); err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+	return nil
+}
+
+func (b *nfsBackend) Delete(ctx context.Context, path string) error {
+	// Unexport first so no client writes into a directory that is being removed
+	if err := b.editExports(ctx, path, false); err != nil {
+		return err
+	}
+	return b.hostPathBackend.Delete(ctx, path)
+}
+
+func (b *nfsBackend) VolumeSource(path string) corev1.PersistentVolumeSource {
+	return corev1.PersistentVolumeSource{
+		NFS: &corev1.NFSVolumeSource{
+			Server: b.server,
+			Path:   path,
+		},
+	}
+}
+
+func (b *nfsBackend) NodeLocal() bool {
+	return false
+}
+
+// editExports adds or removes the export line of path and makes the NFS server reload its exports.
+// Both directions are idempotent so retried provisions and deletes don't duplicate or miss lines.
+func (b *nfsBackend) editExports(ctx context.Context, path string, add bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := os.ReadFile(b.exportsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", b.exportsFile, err)
+	}
+
+	var lines []string
+	found := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line == "" && len(lines) == 0 {
+			continue
+		}
+		if isOurExport(line, path) {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	if add && !found {
+		lines = append(lines, fmt.Sprintf("%s %s %s", path, b.exportOptions, nfsExportComment))
+	}
+	if add == found {
+		// Already in the wanted state, still reload in case an earlier attempt failed before exportfs ran
+		return runCommand(ctx, "exportfs", "-ra")
+	}
+
+	// The exports file is usually bind mounted from the host, so it is rewritten in place rather than renamed over
+	if err := os.WriteFile(b.exportsFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", b.exportsFile, err)
+	}
+	return runCommand(ctx, "exportfs", "-ra")
+}
+
+// isOurExport reports whether line is the export we added for path
+func isOurExport(line, path string) bool {
+	fields := strings.Fields(line)
+	return len(fields) >= 2 && fields[0] == path && strings.HasSuffix(strings.TrimSpace(line), nfsExportComment)
+}
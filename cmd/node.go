@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// basePathTemplateData is what a templated --base-path can refer to, e.g. /data/{{.NodeLabels.disktype}}
+type basePathTemplateData struct {
+	NodeName   string
+	NodeLabels map[string]string
+}
+
+// isBasePathTemplate reports whether the base path needs rendering against the running node
+func isBasePathTemplate(basePath string) bool {
+	return strings.Contains(basePath, "{{")
+}
+
+// renderBasePath renders a templated base path with the labels of the node the provisioner runs on
+func renderBasePath(ctx context.Context, client kubernetes.Interface, basePath, nodeName string) (string, error) {
+	if nodeName == "" {
+		return "", fmt.Errorf("base path %q is a template but the node name is unknown, set --node-name or NODE_NAME", basePath)
+	}
+
+	// missingkey=error makes a typo in the label name fail startup instead of rendering "<no value>"
+	tmpl, err := template.New("base-path").Option("missingkey=error").Parse(basePath)
+	if err != nil {
+		return "", fmt.Errorf("invalid base path template %q: %v", basePath, err)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get node %s: %v", nodeName, err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, basePathTemplateData{NodeName: node.Name, NodeLabels: node.Labels}); err != nil {
+		return "", fmt.Errorf("failed to render base path template %q for node %s: %v", basePath, nodeName, err)
+	}
+
+	rendered := filepath.Clean(out.String())
+	if !filepath.IsAbs(rendered) {
+		return "", fmt.Errorf("base path template %q rendered to %q on node %s, which is not an absolute path", basePath, rendered, nodeName)
+	}
+	return rendered, nil
+}
+
+// Values of --node-taint-sensitivity
+const (
+	taintSensitivityNone       = "none"
+	taintSensitivityCordon     = "cordon"
+	taintSensitivityNoSchedule = "noschedule"
+)
+
+// nodeUnavailable returns why new workloads can't land on node under the given sensitivity, or "" if they can
+func nodeUnavailable(node *corev1.Node, sensitivity string) string {
+	if sensitivity == taintSensitivityNone {
+		return ""
+	}
+	if node.Spec.Unschedulable {
+		return "node is cordoned"
+	}
+	if sensitivity == taintSensitivityNoSchedule {
+		for _, taint := range node.Spec.Taints {
+			if taint.Effect == corev1.TaintEffectNoSchedule || taint.Effect == corev1.TaintEffectNoExecute {
+				return fmt.Sprintf("node has taint %s=%s:%s", taint.Key, taint.Value, taint.Effect)
+			}
+		}
+	}
+	return ""
+}
+
+// nodeAffinityFor pins a PV to node through its hostname label, falling back to the node name when the label is missing
+func nodeAffinityFor(node *corev1.Node) *corev1.VolumeNodeAffinity {
+	hostname, ok := node.Labels[corev1.LabelHostname]
+	if !ok {
+		hostname = node.Name
+	}
+	return &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      corev1.LabelHostname,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{hostname},
+				}},
+			}},
+		},
+	}
+}
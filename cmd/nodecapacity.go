@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// annFreeBytes and annAllocatedBytes on the Node report the free space on the base path and the capacity of
+	// the volumes we provisioned there
+	annFreeBytes      = "custom-provisioner/free-bytes"
+	annAllocatedBytes = "custom-provisioner/allocated-bytes"
+)
+
+// allocatedOnNode sums the capacity of our volumes on the node's base path. A volume counts when its node
+// affinity selects the node, or when it has none and lives under the base path.
+func (p *customProvisioner) allocatedOnNode(ctx context.Context, node *corev1.Node) (int64, error) {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PVs: %v", err)
+	}
+	var allocated int64
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		path, ok := volumeSourcePath(pv)
+		if !ok || pv.Annotations[annProvisionedBy] != provisionerName || !volumeUnderBase(path, p.config.basePath, p.config.realBasePath) {
+			continue
+		}
+		if pv.Spec.NodeAffinity != nil && !affinitySelectsNode(pv.Spec.NodeAffinity, node) {
+			continue
+		}
+		allocated += pv.Spec.Capacity.Storage().Value()
+	}
+	return allocated, nil
+}
+
+// affinitySelectsNode reports whether any hostname term of the affinity names the node, the only kind of term
+// our volumes are pinned with
+func affinitySelectsNode(affinity *corev1.VolumeNodeAffinity, node *corev1.Node) bool {
+	if affinity.Required == nil {
+		return true
+	}
+	hostname, ok := node.Labels[corev1.LabelHostname]
+	if !ok {
+		hostname = node.Name
+	}
+	for _, term := range affinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key != corev1.LabelHostname || expr.Operator != corev1.NodeSelectorOpIn {
+				continue
+			}
+			for _, v := range expr.Values {
+				if v == hostname {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// changedBeyond reports whether value moved more than percent away from the one in the annotation, a missing or
+// unparsable annotation always counts as changed
+func changedBeyond(annotation string, value int64, percent int) bool {
+	old, err := strconv.ParseInt(annotation, 10, 64)
+	if err != nil {
+		return true
+	}
+	diff := value - old
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff*100 > old*int64(percent)
+}
+
+// updateNodeCapacity reports the free and allocated bytes on the running node's annotations. The node is only
+// patched when a value moved more than changePercent, so a busy disk doesn't churn the Node object.
+func (p *customProvisioner) updateNodeCapacity(ctx context.Context, changePercent int) error {
+	node, err := p.client.CoreV1().Nodes().Get(ctx, p.config.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p.config.basePath, &st); err != nil {
+		return fmt.Errorf("failed to statfs %s: %v", p.config.basePath, err)
+	}
+	free := int64(st.Bavail) * st.Bsize
+	allocated, err := p.allocatedOnNode(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	if !changedBeyond(node.Annotations[annFreeBytes], free, changePercent) && !changedBeyond(node.Annotations[annAllocatedBytes], allocated, changePercent) {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annFreeBytes:      strconv.FormatInt(free, 10),
+				annAllocatedBytes: strconv.FormatInt(allocated, 10),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := p.client.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	klog.V(logDecisions).Infof("Reported %d free and %d allocated bytes on node %s", free, allocated, node.Name)
+	return nil
+}
+
+// runNodeCapacity reports the node's capacity every interval until ctx is cancelled. Without the RBAC to patch
+// nodes the reporting is turned off with a warning instead of failing every interval.
+func (p *customProvisioner) runNodeCapacity(ctx context.Context, interval time.Duration, changePercent int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := p.updateNodeCapacity(ctx, changePercent)
+		if apierrors.IsForbidden(err) {
+			klog.Warningf("Not allowed to report capacity on node %s, giving up: %v", p.config.nodeName, err)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			klog.Errorf("Failed to report node capacity: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
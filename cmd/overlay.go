@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	overlayBackendName = "overlay"
+	// overlayStateDir holds the per-volume upper and work directories, it has to be on the same filesystem as the volumes
+	overlayStateDir = ".overlay"
+)
+
+// overlayBackend mounts every volume as an overlayfs with a shared read-only lower directory and its own
+// writable upper layer, so many pods can start from the same content without copying it
+type overlayBackend struct {
+	basePath string
+	lowerDir string
+}
+
+// newOverlayBackend checks the lower directory exists and can be read before any volume is built on it
+func newOverlayBackend(basePath, lowerDir string) (*overlayBackend, error) {
+	if lowerDir == "" {
+		return nil, fmt.Errorf("the overlay backend needs --overlay-lower")
+	}
+	if !filepath.IsAbs(lowerDir) {
+		return nil, fmt.Errorf("--overlay-lower %s must be an absolute path", lowerDir)
+	}
+	info, err := os.Stat(lowerDir)
+	if err != nil {
+		return nil, fmt.Errorf("overlay lower directory: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("overlay lower %s is not a directory", lowerDir)
+	}
+	if _, err := os.ReadDir(lowerDir); err != nil {
+		return nil, fmt.Errorf("overlay lower directory %s is not readable: %v", lowerDir, err)
+	}
+	return &overlayBackend{basePath: basePath, lowerDir: lowerDir}, nil
+}
+
+func (b *overlayBackend) Name() string {
+	return overlayBackendName
+}
+
+// layerDirs returns the state directory of the volume at path and the upper and work directories inside it
+func (b *overlayBackend) layerDirs(path string) (string, string, string) {
+	state := filepath.Join(b.basePath, overlayStateDir, filepath.Base(path))
+	return state, filepath.Join(state, "upper"), filepath.Join(state, "work")
+}
+
+func (b *overlayBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	state, upper, work := b.layerDirs(path)
+	for _, dir := range []string{upper, work, path} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			os.RemoveAll(state)
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+	// The mounted volume root takes its mode from the upper directory
+	if err := os.Chmod(upper, mode); err != nil {
+		b.Delete(ctx, path)
+		return fmt.Errorf("failed to set mode on overlay upper directory: %v", err)
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", b.lowerDir, upper, work)
+	if err := runCommand(ctx, "mount", "-t", "overlay", "overlay", "-o", options, path); err != nil {
+		b.Delete(ctx, path)
+		return err
+	}
+	return nil
+}
+
+// Resume mounts the layers again when the mount is gone
+func (b *overlayBackend) Resume(ctx context.Context, path string) error {
+	mounted, err := isMountPoint(path)
+	if err != nil || mounted {
+		return err
+	}
+	_, upper, work := b.layerDirs(path)
+	for _, dir := range []string{upper, work} {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("overlay layer %s: %v", dir, err)
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", b.lowerDir, upper, work)
+	return runCommand(ctx, "mount", "-t", "overlay", "overlay", "-o", options, path)
+}
+
+func (b *overlayBackend) Delete(ctx context.Context, path string) error {
+	// The mount may already be gone, e.g. after a node reboot, then only the directories are left to remove
+	mounted, err := isMountPoint(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := runCommand(ctx, "umount", path); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	// The upper layer holds the volume's data
+	state, _, _ := b.layerDirs(path)
+	return removeTree(ctx, state)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"testing"
+	"time"
+)
+
+// phaseSample returns the observation count and sum of a provision phase so far
+func phaseSample(t *testing.T, phase string) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := provisionPhaseDuration.WithLabelValues(phase).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// provisionPhases are the phases of a default hostpath provision, in order
+var provisionPhases = []string{"validation", "space-check", "mkdir", "rename", "pv-object"}
+
+func TestPhaseTimerObservesProvisionPhases(t *testing.T) {
+	config := newTestConfig(t)
+	config.phaseMetrics = true
+	p := newTestProvisioner(t, config, nil)
+	counts, sums := map[string]uint64{}, map[string]float64{}
+	for _, phase := range append(provisionPhases, "skeleton") {
+		counts[phase], sums[phase] = phaseSample(t, phase)
+	}
+
+	start := time.Now()
+	_, _, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: testPVC("default", "timed"), StorageClass: testClass("test")})
+	elapsed := time.Since(start).Seconds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each phase runs from the end of the one before, together they can't take longer than the provision
+	var total float64
+	for _, phase := range provisionPhases {
+		count, sum := phaseSample(t, phase)
+		if count != counts[phase]+1 {
+			t.Errorf("phase %s observed %d times, want once", phase, count-counts[phase])
+		}
+		total += sum - sums[phase]
+	}
+	if total > elapsed {
+		t.Errorf("phases add up to %fs, more than the %fs the provision took", total, elapsed)
+	}
+	// Phases that don't apply aren't observed
+	if count, _ := phaseSample(t, "skeleton"); count != counts["skeleton"] {
+		t.Errorf("skeleton phase observed without --skeleton-dir")
+	}
+}
+
+func TestPhaseTimerDisabled(t *testing.T) {
+	timer := newPhaseTimer(false)
+	if timer != nil {
+		t.Fatalf("newPhaseTimer(false) = %v, want nil", timer)
+	}
+	before, _ := phaseSample(t, "validation")
+	timer.mark("validation")
+	if after, _ := phaseSample(t, "validation"); after != before {
+		t.Errorf("a nil phaseTimer observed a phase")
+	}
+}
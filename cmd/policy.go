@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"os"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys understood both in StorageClass parameters and in the per-class entries of the policy ConfigMap
+const (
+	paramMinSize       = "minSize"
+	paramMaxSize       = "maxSize"
+	paramReclaimPolicy = "reclaimPolicy"
+	paramDirMode       = "dirMode"
+	paramReuseDir      = "reuseDir"
+	paramArchive       = "archiveOnDelete"
+	paramWorkers       = "provisionWorkers"
+	paramGranularity   = "sizeGranularity"
+	paramCapacityUnit  = "capacityUnit"
+)
+
+// Values of the capacityUnit parameter
+const (
+	capacityUnitBinary  = "binary"
+	capacityUnitDecimal = "decimal"
+)
+
+const defaultDirMode os.FileMode = 0755
+
+// volumePolicy is the effective set of defaults and limits applied to a single Provision call
+type volumePolicy struct {
+	minSize       *resource.Quantity
+	maxSize       *resource.Quantity
+	reclaimPolicy corev1.PersistentVolumeReclaimPolicy
+	dirMode       os.FileMode
+	// reuseDir empties volumes on delete and keeps their directory in a pool for later claims
+	reuseDir bool
+	// archiveOnDelete moves volumes to the archive directory on delete instead of removing them
+	archiveOnDelete bool
+	// sizeGranularity is what requested sizes must be a multiple of, nil when any size goes
+	sizeGranularity *resource.Quantity
+	// capacityFormat is how the PV capacity is written, empty keeps the request as the PVC wrote it
+	capacityFormat resource.Format
+	// workers caps the provisions of the class running at the same time, 0 means no cap
+	workers int
+	// durable fsyncs the new volume before its PV is created, from --fsync-on-create or the PVC's annDurable
+	durable bool
+	// defaulted lists the parameters that fell back to a flag default, neither the class nor the ConfigMap set them.
+	// dirMode isn't listed, every volume has a mode and taking --default-dir-mode's is the normal case.
+	defaulted []string
+}
+
+// policyStore keeps the per-StorageClass defaults loaded from the policy ConfigMap.
+// Each data key of the ConfigMap is a StorageClass name and its value is a YAML map
+// using the same keys as the StorageClass parameters, e.g.
+//
+//	fast-ssd: |
+//	  maxSize: 50Gi
+//	  reclaimPolicy: Retain
+type policyStore struct {
+	mu      sync.RWMutex
+	classes map[string]map[string]string
+}
+
+func newPolicyStore() *policyStore {
+	return &policyStore{classes: map[string]map[string]string{}}
+}
+
+// get returns a copy of the ConfigMap defaults for the given class, nil store or unknown class yields an empty map
+func (s *policyStore) get(className string) map[string]string {
+	out := map[string]string{}
+	if s == nil {
+		return out
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, v := range s.classes[className] {
+		out[k] = v
+	}
+	return out
+}
+
+// snapshot returns a copy of all stored per-class defaults
+func (s *policyStore) snapshot() map[string]map[string]string {
+	out := map[string]map[string]string{}
+	if s == nil {
+		return out
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for className, entry := range s.classes {
+		out[className] = map[string]string{}
+		for k, v := range entry {
+			out[className][k] = v
+		}
+	}
+	return out
+}
+
+// load replaces the stored defaults with the content of the ConfigMap, entries that fail to parse are skipped
+func (s *policyStore) load(cm *corev1.ConfigMap) {
+	classes := map[string]map[string]string{}
+	for className, raw := range cm.Data {
+		entry := map[string]string{}
+		if err := yaml.Unmarshal([]byte(raw), &entry); err != nil {
+			klog.Errorf("Ignoring policy for StorageClass %s in ConfigMap %s/%s: %v", className, cm.Namespace, cm.Name, err)
+			continue
+		}
+		classes[className] = entry
+	}
+
+	s.mu.Lock()
+	s.classes = classes
+	s.mu.Unlock()
+	klog.Infof("Loaded provisioning policy for %d StorageClass(es) from ConfigMap %s/%s", len(classes), cm.Namespace, cm.Name)
+}
+
+func (s *policyStore) clear() {
+	s.mu.Lock()
+	s.classes = map[string]map[string]string{}
+	s.mu.Unlock()
+}
+
+// watch starts an informer on the policy ConfigMap (given as namespace/name) and reloads the store on every change
+func (s *policyStore) watch(client kubernetes.Interface, ref string, stopCh <-chan struct{}) error {
+	namespace, name, found := strings.Cut(ref, "/")
+	if !found || namespace == "" || name == "" {
+		return fmt.Errorf("invalid policy ConfigMap reference %q, expected namespace/name", ref)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 10*time.Minute,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.load(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			s.load(obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			klog.Warningf("Policy ConfigMap %s was deleted, falling back to StorageClass parameters only", ref)
+			s.clear()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register policy ConfigMap handler: %v", err)
+	}
+
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for policy ConfigMap %s to sync", ref)
+	}
+	return nil
+}
+
+// checkGranularity refuses a requested size that isn't a multiple of the class's sizeGranularity, naming the
+// closest sizes that would be accepted
+func checkGranularity(requested resource.Quantity, granularity *resource.Quantity) error {
+	if granularity == nil {
+		return nil
+	}
+	step := granularity.Value()
+	size := requested.Value()
+	if size%step == 0 {
+		return nil
+	}
+	below := size - size%step
+	above := below + step
+	suggestion := resource.NewQuantity(above, resource.BinarySI).String()
+	if below > 0 {
+		suggestion = resource.NewQuantity(below, resource.BinarySI).String() + " or " + suggestion
+	}
+	return fmt.Errorf("requested storage %s is not a multiple of the %s %s, request %s instead", requested.String(), paramGranularity, granularity.String(), suggestion)
+}
+
+// formatCapacity writes capacity in the given unit system, binary as Ki/Mi/Gi and decimal as k/M/G. Only the
+// notation changes, never the number of bytes: a size that isn't a whole number of the unit's steps comes out in
+// a smaller suffix or plain bytes, e.g. 10Gi is 10737418240 in decimal. Pair decimal with a decimal
+// sizeGranularity (1G) and binary with a binary one (1Gi) to get whole units. An empty format keeps capacity as is.
+func formatCapacity(capacity resource.Quantity, format resource.Format) resource.Quantity {
+	if format == "" || capacity.Format == format {
+		return capacity
+	}
+	return *resource.NewQuantity(capacity.Value(), format)
+}
+
+// reportDefaults tells the PVC which parameters fell back to the flag defaults and counts each of them
+func (p *customProvisioner) reportDefaults(pvc *corev1.PersistentVolumeClaim, policy *volumePolicy) {
+	if len(policy.defaulted) == 0 {
+		return
+	}
+	applied := make([]string, 0, len(policy.defaulted))
+	for _, k := range policy.defaulted {
+		defaultsApplied.WithLabelValues(k).Inc()
+		switch k {
+		case paramReclaimPolicy:
+			applied = append(applied, fmt.Sprintf("%s=%s", k, policy.reclaimPolicy))
+		case paramMinSize:
+			applied = append(applied, fmt.Sprintf("%s=%s", k, policy.minSize.String()))
+		case paramMaxSize:
+			applied = append(applied, fmt.Sprintf("%s=%s", k, policy.maxSize.String()))
+		}
+	}
+	p.recorder.Eventf(pvc, corev1.EventTypeNormal, "DefaultApplied", "Using provisioner defaults for %s", strings.Join(applied, ", "))
+}
+
+// resolvePolicy merges the flag defaults, the ConfigMap defaults for the class and the class parameters (in
+// increasing precedence) and parses the result. The reclaim policy is, from highest precedence: the reclaimPolicy
+// class parameter, the ConfigMap entry, --namespace-reclaim-overrides for the PVC's namespace, the class's
+// reclaimPolicy field and --default-reclaim-policy. The API server fills the field in with Delete when a class
+// leaves it out, so it can't tell a deliberate policy from a defaulted one, the parameter is how a class insists.
+func (p *customProvisioner) resolvePolicy(class *storagev1.StorageClass, namespace string) (*volumePolicy, error) {
+	defaults := p.config.defaultParams()
+	params := map[string]string{}
+	for k, v := range defaults {
+		params[k] = v
+	}
+	configured := p.policies.get(class.Name)
+	for k, v := range configured {
+		params[k] = v
+	}
+	for k, v := range class.Parameters {
+		params[k] = v
+	}
+
+	policy := &volumePolicy{
+		reclaimPolicy: corev1.PersistentVolumeReclaimPolicy(p.config.defaultReclaimPolicy),
+		dirMode:       defaultDirMode,
+		workers:       p.config.classProvisionWorkers,
+	}
+	nsPolicy, nsOverride := p.config.namespaceReclaimOverrides[namespace]
+	if nsOverride {
+		policy.reclaimPolicy = nsPolicy
+	} else if class.ReclaimPolicy != nil {
+		policy.reclaimPolicy = *class.ReclaimPolicy
+	}
+	for k := range defaults {
+		if k == paramDirMode {
+			continue
+		}
+		if _, ok := configured[k]; !ok {
+			if _, ok := class.Parameters[k]; !ok {
+				policy.defaulted = append(policy.defaulted, k)
+			}
+		}
+	}
+	_, configuredReclaim := configured[paramReclaimPolicy]
+	_, classReclaim := class.Parameters[paramReclaimPolicy]
+	if class.ReclaimPolicy == nil && !nsOverride && !configuredReclaim && !classReclaim {
+		policy.defaulted = append(policy.defaulted, paramReclaimPolicy)
+	}
+	sort.Strings(policy.defaulted)
+
+	if v, ok := params[paramMinSize]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", paramMinSize, v, err)
+		}
+		policy.minSize = &q
+	}
+	if v, ok := params[paramMaxSize]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", paramMaxSize, v, err)
+		}
+		policy.maxSize = &q
+	}
+	if policy.minSize != nil && policy.maxSize != nil && policy.minSize.Cmp(*policy.maxSize) > 0 {
+		return nil, fmt.Errorf("%s %s is larger than %s %s", paramMinSize, policy.minSize.String(), paramMaxSize, policy.maxSize.String())
+	}
+
+	if v, ok := params[paramReclaimPolicy]; ok {
+		switch rp := corev1.PersistentVolumeReclaimPolicy(v); rp {
+		case corev1.PersistentVolumeReclaimDelete, corev1.PersistentVolumeReclaimRetain:
+			policy.reclaimPolicy = rp
+		default:
+			return nil, fmt.Errorf("invalid %s %q, must be Delete or Retain", paramReclaimPolicy, v)
+		}
+	}
+
+	if v, ok := params[paramDirMode]; ok {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid %s %q, expected an octal permission like 0755", paramDirMode, v)
+		}
+		policy.dirMode = os.FileMode(mode)
+	}
+
+	if v, ok := params[paramReuseDir]; ok {
+		reuse, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected true or false", paramReuseDir, v)
+		}
+		policy.reuseDir = reuse
+	}
+
+	if v, ok := params[paramArchive]; ok {
+		archive, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expected true or false", paramArchive, v)
+		}
+		policy.archiveOnDelete = archive
+	}
+	if v, ok := params[paramGranularity]; ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil || q.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected a positive size like 1Gi", paramGranularity, v)
+		}
+		policy.sizeGranularity = &q
+	}
+
+	if v, ok := params[paramCapacityUnit]; ok {
+		switch v {
+		case capacityUnitBinary:
+			policy.capacityFormat = resource.BinarySI
+		case capacityUnitDecimal:
+			policy.capacityFormat = resource.DecimalSI
+		default:
+			return nil, fmt.Errorf("invalid %s %q, expected %s or %s", paramCapacityUnit, v, capacityUnitBinary, capacityUnitDecimal)
+		}
+	}
+
+	if v, ok := params[paramWorkers]; ok {
+		workers, err := strconv.Atoi(v)
+		if err != nil || workers < 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected a non-negative number", paramWorkers, v)
+		}
+		policy.workers = workers
+	}
+
+	if policy.reuseDir && policy.archiveOnDelete {
+		return nil, fmt.Errorf("%s and %s can't be combined", paramReuseDir, paramArchive)
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"reflect"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"strings"
+	"testing"
+)
+
+func TestResolvePolicyReportsDefaults(t *testing.T) {
+	retain := corev1.PersistentVolumeReclaimRetain
+	tests := []struct {
+		name    string
+		flags   []string
+		params  map[string]string
+		reclaim *corev1.PersistentVolumeReclaimPolicy
+		want    []string
+	}{
+		{name: "bare class", want: []string{paramReclaimPolicy}},
+		{name: "class reclaim policy", reclaim: &retain},
+		{name: "explicit dir mode", params: map[string]string{paramDirMode: "0700"}, reclaim: &retain},
+		{name: "flag min size", flags: []string{"--default-min-size=1Mi"}, reclaim: &retain, want: []string{paramMinSize}},
+		{name: "class min size", flags: []string{"--default-min-size=1Mi"}, params: map[string]string{paramMinSize: "2Mi"}, reclaim: &retain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseTestFlags(t, append([]string{"--identity=test-provisioner"}, tt.flags...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newTestProvisioner(t, config, nil)
+			class := testClass("test")
+			class.Parameters, class.ReclaimPolicy = tt.params, tt.reclaim
+			policy, err := p.resolvePolicy(class, "default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(policy.defaulted, tt.want) {
+				t.Errorf("defaulted = %v, want %v", policy.defaulted, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisionDoesNotReportDirModeDefault(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+	provisionTestVolume(t, p, testPVC("default", "plain"))
+	for _, event := range recordedEvents(p) {
+		if strings.Contains(event, paramDirMode) {
+			t.Errorf("event %q reports the directory mode as a default", event)
+		}
+	}
+}
+
+func TestResolvePolicyReclaimPrecedence(t *testing.T) {
+	config, err := parseTestFlags(t, "--identity=test-provisioner", "--namespace-reclaim-overrides=prod=Retain,dev=Delete", "--default-reclaim-policy=Retain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProvisioner(t, config, nil)
+	retain, del := corev1.PersistentVolumeReclaimRetain, corev1.PersistentVolumeReclaimDelete
+	tests := []struct {
+		name      string
+		namespace string
+		field     *corev1.PersistentVolumeReclaimPolicy
+		params    map[string]string
+		want      corev1.PersistentVolumeReclaimPolicy
+	}{
+		// The API server defaults the field to Delete on every class
+		{name: "namespace beats defaulted class field", namespace: "prod", field: &del, want: retain},
+		{name: "namespace without class field", namespace: "prod", want: retain},
+		{name: "class field beats flag default", namespace: "other", field: &del, want: del},
+		{name: "namespace beats flag default", namespace: "dev", want: del},
+		{name: "flag default", namespace: "other", want: retain},
+		{name: "class parameter beats all", namespace: "prod", field: &retain, params: map[string]string{paramReclaimPolicy: "Delete"}, want: del},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := testClass("test")
+			class.ReclaimPolicy, class.Parameters = tt.field, tt.params
+			policy, err := p.resolvePolicy(class, tt.namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.reclaimPolicy != tt.want {
+				t.Errorf("reclaim policy = %s, want %s", policy.reclaimPolicy, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisionReportsDefaultsOnce(t *testing.T) {
+	config := newTestConfig(t)
+	config.classProvisionWorkers = 1
+	p := newTestProvisioner(t, config, nil)
+	pvc := testPVC("default", "retried")
+
+	// The class's only worker is busy, the first attempt is deferred
+	release, err := p.classes.acquire("test", "other-uid", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, state, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+	if err == nil || state != controller.ProvisioningNoChange {
+		t.Fatalf("Provision with the class busy = %s, %v, want it deferred", state, err)
+	}
+	release()
+	provisionTestVolume(t, p, pvc)
+
+	reported := 0
+	for _, event := range recordedEvents(p) {
+		if strings.Contains(event, "DefaultApplied") {
+			reported++
+		}
+	}
+	if reported != 1 {
+		t.Errorf("DefaultApplied reported %d times, want once", reported)
+	}
+}
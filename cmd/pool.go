@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// annReuseDir marks a PV whose directory goes back to the pool on delete instead of being removed
+const annReuseDir = "custom-provisioner/reuse-dir"
+
+// poolReuse counts the provisions of reuseDir classes by base path and whether they got a pooled directory
+// ("reused") or the pool had none free ("created"), too many created ones mean the pool is undersized
+var poolReuse = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "provisioner_pool_reuse_total",
+	Help: "Number of provisions of reuseDir classes that reused a pooled directory or created a new one, by base path.",
+}, []string{"base_path", "result"})
+
+// recordPoolUse reports whether a pool class provision reused a pooled directory or created a fresh one
+func (p *customProvisioner) recordPoolUse(pvc *corev1.PersistentVolumeClaim, basePath, volumePath string, reused bool) {
+	if reused {
+		poolReuse.WithLabelValues(basePath, "reused").Inc()
+		p.recorder.Eventf(pvc, corev1.EventTypeNormal, "PoolDirReused", "Reused pooled directory %s", volumePath)
+		return
+	}
+	poolReuse.WithLabelValues(basePath, "created").Inc()
+	p.recorder.Eventf(pvc, corev1.EventTypeNormal, "PoolDirCreated", "No pooled directory was free, created %s", volumePath)
+}
+
+// poolBackendAllowed reports whether directories of the backend can be emptied in place and handed out again
+func poolBackendAllowed(name string) bool {
+	return name == hostPathBackendName || name == btrfsBackendName
+}
+
+// claimPoolDir looks for a pool directory for the PVC on the base paths: one an earlier attempt already claimed
+// for it, otherwise a free one sized for at least its request, which is then claimed by writing the PVC into its
+// marker. Directories are only taken when their marker says free and nothing but the marker is left in them, so
+// an active volume is never handed out twice. It returns the directory and the annBasePathID of the pool base
+// path it is on, "" for --base-path. An empty directory means the pool has nothing to offer and a new one should
+// be created. Operators can pre-create pool directories by writing {"pool":true,"free":true} as the marker, those
+// have no recorded size and fit any request.
+func (p *customProvisioner) claimPoolDir(ctx context.Context, pvName string, backend VolumeBackend, pvc *corev1.PersistentVolumeClaim) (string, string, error) {
+	basePaths := []string{p.config.basePath}
+	if poolBasePathSupported(backend.Name()) {
+		basePaths = p.config.basePaths()
+	}
+
+	var free []string
+	for _, basePath := range basePaths {
+		entries, err := os.ReadDir(basePath)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read base path %s: %v", basePath, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			dir := filepath.Join(basePath, entry.Name())
+			marker, err := readMarker(dir)
+			if err != nil || !marker.Pool {
+				continue
+			}
+			if marker.PVCUID == string(pvc.UID) {
+				klog.Infof("Reusing pool directory %s already claimed for PVC %s/%s", dir, pvc.Namespace, pvc.Name)
+				return dir, p.config.basePathID(basePath), nil
+			}
+			if marker.Free && markerBackend(marker) == backend.Name() && poolDirFits(marker, pvc) {
+				free = append(free, dir)
+			}
+		}
+	}
+
+	for _, dir := range free {
+		if claimed, err := p.claimFreeDir(ctx, dir, pvName, backend, pvc); err != nil {
+			klog.Warningf("Failed to claim pool directory %s: %v", dir, err)
+		} else if claimed {
+			klog.Infof("Claimed pool directory %s for PVC %s/%s", dir, pvc.Namespace, pvc.Name)
+			return dir, p.config.basePathID(filepath.Dir(dir)), nil
+		}
+	}
+	return "", "", nil
+}
+
+// claimFreeDir takes dir for the PVC if it is still free, empty and large enough, rechecking under the path lock.
+// Backends enforcing the size get the directory limited to the PVC's request before it is handed out.
+func (p *customProvisioner) claimFreeDir(ctx context.Context, dir, pvName string, backend VolumeBackend, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	unlock := p.locks.lock(dir)
+	defer unlock()
+
+	marker, err := readMarker(dir)
+	if err != nil || !marker.Pool || !marker.Free || !poolDirFits(marker, pvc) {
+		return false, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() != markerFileName {
+			klog.Warningf("Pool directory %s is marked free but not empty, skipping it", dir)
+			return false, nil
+		}
+	}
+	if lb, ok := backend.(LimitingBackend); ok {
+		requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if err := p.fsOp(ctx, "limit", dir, func() error { return lb.SetLimit(ctx, dir, requested.Value()) }); err != nil {
+			return false, fmt.Errorf("failed to limit %s to %d bytes: %v", dir, requested.Value(), err)
+		}
+	}
+	if err := writeMarker(dir, pvName, backend.Name(), pvc, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// poolDirFits reports whether the pool directory was sized for at least the PVC's request, directories without a
+// recorded size fit any
+func poolDirFits(m *volumeMarker, pvc *corev1.PersistentVolumeClaim) bool {
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	return m.SizeBytes == 0 || m.SizeBytes >= requested.Value()
+}
+
+// releasePoolDir empties the volume's directory and marks it free, keeping the directory, its recorded size and
+// any size limit of its backend for the next claim
+func releasePoolDir(volumePath, backend string) error {
+	entries, err := os.ReadDir(volumePath)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if m, err := readMarker(volumePath); err == nil {
+		size = m.SizeBytes
+	}
+	// Mark the directory taken-but-released first, so a crash half way never leaves a free marker on leftover data
+	if err := storeMarker(volumePath, volumeMarker{Backend: backend, CreatedAt: time.Now().UTC(), SizeBytes: size, Pool: true}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == markerFileName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(volumePath, entry.Name())); err != nil {
+			return fmt.Errorf("failed to empty %s: %v", volumePath, err)
+		}
+	}
+	return storeMarker(volumePath, volumeMarker{Backend: backend, CreatedAt: time.Now().UTC(), SizeBytes: size, Pool: true, Free: true})
+}
+
+// markerBackend returns the backend recorded in a marker, markers from before backends existed are plain directories
+func markerBackend(m *volumeMarker) string {
+	if m.Backend == "" {
+		return hostPathBackendName
+	}
+	return m.Backend
+}
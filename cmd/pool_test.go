@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFreePoolDir creates a free pool directory of the backend recorded at size bytes
+func writeFreePoolDir(t *testing.T, basePath, name, backend string, size int64) string {
+	t.Helper()
+	path := filepath.Join(basePath, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeMarker(path, volumeMarker{Backend: backend, CreatedAt: time.Now().UTC(), SizeBytes: size, Pool: true, Free: true}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// limitingBackend stands in for the btrfs backend, it records the limits set instead of touching qgroups
+type limitingBackend struct {
+	hostPathBackend
+	limits map[string]int64
+}
+
+func (b *limitingBackend) Name() string { return btrfsBackendName }
+
+func (b *limitingBackend) SetLimit(ctx context.Context, path string, sizeBytes int64) error {
+	b.limits[path] = sizeBytes
+	return nil
+}
+
+func TestClaimPoolDirChecksRecordedSize(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestProvisioner(t, config, nil)
+	small := writeFreePoolDir(t, config.basePath, "pv-default-small", hostPathBackendName, 1<<20)
+
+	pvc := testPVC("default", "big")
+	pvc.Spec.Resources.Requests[corev1.ResourceStorage] = resource.MustParse("2Mi")
+	dir, _, err := p.claimPoolDir(context.Background(), "pv-default-big", &hostPathBackend{}, pvc)
+	if err != nil || dir != "" {
+		t.Fatalf("claimPoolDir for 2Mi = %q, %v, want the 1Mi directory left alone", dir, err)
+	}
+
+	pvc = testPVC("default", "fits")
+	dir, _, err = p.claimPoolDir(context.Background(), "pv-default-fits", &hostPathBackend{}, pvc)
+	if err != nil || dir != small {
+		t.Fatalf("claimPoolDir for 1Mi = %q, %v, want %s", dir, err, small)
+	}
+	// The size is kept through release for the next claim
+	if err := releasePoolDir(dir, hostPathBackendName); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := readMarker(dir); err != nil || m.SizeBytes != 1<<20 || !m.Free {
+		t.Errorf("marker after release = %+v, %v, want it free at 1Mi", m, err)
+	}
+}
+
+func TestClaimPoolDirSetsBackendLimit(t *testing.T) {
+	config := newTestConfig(t)
+	backend := &limitingBackend{limits: map[string]int64{}}
+	p := newTestProvisioner(t, config, []VolumeBackend{backend})
+	dir := writeFreePoolDir(t, config.basePath, "pv-default-large", btrfsBackendName, 1<<30)
+
+	got, _, err := p.claimPoolDir(context.Background(), "pv-default-limited", backend, testPVC("default", "limited"))
+	if err != nil || got != dir {
+		t.Fatalf("claimPoolDir = %q, %v, want %s", got, err, dir)
+	}
+	if backend.limits[dir] != 1<<20 {
+		t.Errorf("limit of the claimed directory = %d, want the 1Mi request", backend.limits[dir])
+	}
+}
+
+func TestClaimPoolDirScansBasePathPool(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	p := newTestProvisioner(t, config, nil)
+	dir := writeFreePoolDir(t, disk2, "pv-default-old", hostPathBackendName, 0)
+
+	got, id, err := p.claimPoolDir(context.Background(), "pv-default-pooled", &hostPathBackend{}, testPVC("default", "pooled"))
+	if err != nil || got != dir || id != "disk2" {
+		t.Errorf("claimPoolDir = %q, %q, %v, want %s on disk2", got, id, err, dir)
+	}
+}
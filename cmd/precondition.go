@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"os"
+	"text/template"
+	"time"
+)
+
+// deletePreconditionPoll is how often Delete looks at the precondition file while waiting for it
+const deletePreconditionPoll = 2 * time.Second
+
+// deletePreconditionData is what --delete-precondition-file can refer to, e.g. /backups/{{.PVName}}.done
+type deletePreconditionData struct {
+	PVName       string
+	VolumePath   string
+	PVCNamespace string
+	PVCName      string
+	PVCUID       string
+}
+
+// parseDeletePrecondition parses the --delete-precondition-file template, missing keys are an error
+func parseDeletePrecondition(text string) (*template.Template, error) {
+	tmpl, err := template.New("delete-precondition-file").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --delete-precondition-file template %q: %v", text, err)
+	}
+	return tmpl, nil
+}
+
+// deletePreconditionPath renders the precondition file of the volume
+func (p *customProvisioner) deletePreconditionPath(volume *corev1.PersistentVolume, volumePath string) (string, error) {
+	tmpl, err := parseDeletePrecondition(p.config.deletePreconditionFile)
+	if err != nil {
+		return "", err
+	}
+	data := deletePreconditionData{PVName: volume.Name, VolumePath: volumePath}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		data.PVCNamespace, data.PVCName, data.PVCUID = ref.Namespace, ref.Name, string(ref.UID)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render --delete-precondition-file for volume %s: %v", volume.Name, err)
+	}
+	return out.String(), nil
+}
+
+// waitDeletePrecondition blocks until the volume's precondition file exists, or is gone with
+// --delete-precondition-absent, giving up after --delete-precondition-timeout. The error makes the controller
+// retry the delete later.
+func (p *customProvisioner) waitDeletePrecondition(ctx context.Context, volume *corev1.PersistentVolume, volumePath string) error {
+	path, err := p.deletePreconditionPath(volume, volumePath)
+	if err != nil {
+		return err
+	}
+	want := "to exist"
+	if p.config.deletePreconditionAbsent {
+		want = "to be removed"
+	}
+	met := func() bool {
+		_, err := os.Stat(path)
+		if p.config.deletePreconditionAbsent {
+			return os.IsNotExist(err)
+		}
+		return err == nil
+	}
+
+	deadline := time.Now().Add(p.config.deletePreconditionTimeout)
+	ticker := time.NewTicker(deletePreconditionPoll)
+	defer ticker.Stop()
+	for !met() {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("delete precondition not met: waited %v for %s %s", p.config.deletePreconditionTimeout, path, want)
+		}
+		klog.V(logDecisions).Infof("Waiting for %s %s before deleting volume %s", path, want, volume.Name)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for %s %s: %v", path, want, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
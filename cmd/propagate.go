@@ -0,0 +1,42 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"strings"
+)
+
+// reservedAnnotationPrefixes belong to us or to Kubernetes, PVC annotations under them never reach the PV
+var reservedAnnotationPrefixes = []string{"custom-provisioner/", "pv.kubernetes.io/", "volume.kubernetes.io/", "volume.beta.kubernetes.io/"}
+
+// reservedAnnotation reports whether key is one only the provisioner or Kubernetes may set on a PV
+func reservedAnnotation(key string) bool {
+	for _, prefix := range reservedAnnotationPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// propagateAnnotations copies the PVC annotations matching one of prefixes into annotations, e.g. for backup
+// tools selecting PVs by them. Reserved keys and keys the provisioner already set are never overwritten.
+func propagateAnnotations(pvc *corev1.PersistentVolumeClaim, prefixes []string, annotations map[string]string) {
+	for key, value := range pvc.Annotations {
+		matched := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if _, set := annotations[key]; set || reservedAnnotation(key) {
+			klog.Warningf("Not propagating annotation %s of PVC %s/%s, it is reserved for the provisioner", key, pvc.Namespace, pvc.Name)
+			continue
+		}
+		annotations[key] = value
+	}
+}
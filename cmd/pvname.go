@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+	"strings"
+)
+
+// Values of --pv-name-conflict
+const (
+	pvNameConflictUniquify = "uniquify"
+	pvNameConflictFail     = "fail"
+)
+
+// Values of --long-pvc-names
+const (
+	longPVCNamesTruncate = "truncate"
+	longPVCNamesReject   = "reject"
+)
+
+// uidSuffixLength is the length of the -<first 8 UID characters> suffix keeping shortened or conflicting names unique
+const uidSuffixLength = len("-12345678")
+
+// maxVolumeNameLength keeps derived PV names valid even after uniquify adds its suffix
+const maxVolumeNameLength = validation.DNS1123SubdomainMaxLength - uidSuffixLength
+
+// volumeNameFor derives the PV name of a PVC, pv-<namespace>-<name>. A PVC name longer than --max-pvc-name-length,
+// or too long for a valid PV name, is either rejected with --long-pvc-names=reject, so the user picks a shorter
+// one, or cut short and suffixed with the PVC's UID to stay unique.
+func (p *customProvisioner) volumeNameFor(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	prefix := fmt.Sprintf("pv-%s-", pvc.Namespace)
+	limit := maxVolumeNameLength - len(prefix)
+	if max := p.config.maxPVCNameLength; max > 0 && max < limit {
+		limit = max
+	}
+	if len(pvc.Name) <= limit {
+		return prefix + pvc.Name, nil
+	}
+	if p.config.longPVCNames == longPVCNamesReject {
+		return "", fmt.Errorf("PVC name is %d characters long, at most %d are accepted, use a shorter name", len(pvc.Name), limit)
+	}
+	// A cut right before a dash or dot would leave two separators in a row
+	name := fmt.Sprintf("%s%s-%.8s", prefix, strings.TrimRight(pvc.Name[:limit-uidSuffixLength], "-."), pvc.UID)
+	klog.Infof("PVC %s/%s has a name longer than %d characters, naming its volume %s", pvc.Namespace, pvc.Name, limit, name)
+	return name, nil
+}
+
+// resolvePVName checks the PV name derived from the PVC against the PVs that already exist. The controller
+// treats an existing PV of the same name as saved, so a leftover of an earlier PVC with the same name would
+// silently swallow the new claim. A PV already bound to this PVC is returned for adoption. Anything else
+// either fails the provision or, with uniquify, moves to a name suffixed with the PVC's UID.
+func (p *customProvisioner) resolvePVName(ctx context.Context, pvc *corev1.PersistentVolumeClaim, name string) (string, *corev1.PersistentVolume, error) {
+	candidates := []string{name}
+	if p.config.pvNameConflict == pvNameConflictUniquify {
+		candidates = append(candidates, fmt.Sprintf("%s-%.8s", name, pvc.UID))
+	}
+	for _, candidate := range candidates {
+		existing, err := p.client.CoreV1().PersistentVolumes().Get(ctx, candidate, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if candidate != name {
+				klog.Infof("PV %s already exists for another claim, provisioning PVC %s/%s as %s", name, pvc.Namespace, pvc.Name, candidate)
+			}
+			return candidate, nil, nil
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to look up PV %s: %v", candidate, err)
+		}
+		if ref := existing.Spec.ClaimRef; ref != nil && ref.UID == pvc.UID {
+			return candidate, existing, nil
+		}
+	}
+	return "", nil, fmt.Errorf("PV %s already exists and belongs to another claim, see --pv-name-conflict", name)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"testing"
+)
+
+// leftoverPV returns a PV of name bound to pvc
+func leftoverPV(name string, pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{ClaimRef: &corev1.ObjectReference{
+			Namespace: pvc.Namespace, Name: pvc.Name, UID: pvc.UID}},
+	}
+}
+
+func TestProvisionPVNameConflict(t *testing.T) {
+	pvc := testPVC("default", "data")
+	// The PV of an earlier, deleted claim of the same name is still around
+	earlier := testPVC("default", "data")
+	earlier.UID = "earlier-uid"
+
+	t.Run("uniquify", func(t *testing.T) {
+		config := newTestConfig(t)
+		p := newTestProvisioner(t, config, nil, leftoverPV("pv-default-data", earlier))
+		pv, _, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "pv-default-data-" + string(pvc.UID)[:8]; pv.Name != want {
+			t.Errorf("PV name = %q, want %q", pv.Name, want)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		config := newTestConfig(t)
+		config.pvNameConflict = pvNameConflictFail
+		p := newTestProvisioner(t, config, nil, leftoverPV("pv-default-data", earlier))
+		pv, state, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+		if err == nil || pv != nil {
+			t.Fatalf("Provision = %v, %v, want a conflict error", pv, err)
+		}
+		if state != controller.ProvisioningFinished {
+			t.Errorf("state = %s, want %s", state, controller.ProvisioningFinished)
+		}
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		config := newTestConfig(t)
+		saved := leftoverPV("pv-default-data", pvc)
+		p := newTestProvisioner(t, config, nil, saved)
+		pv, _, err := p.Provision(context.Background(), controller.ProvisionOptions{PVC: pvc, StorageClass: testClass("test")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.Name != saved.Name || pv.Spec.ClaimRef.UID != pvc.UID {
+			t.Errorf("Provision = %s bound to %s, want the saved PV handed back", pv.Name, pv.Spec.ClaimRef.UID)
+		}
+	})
+}
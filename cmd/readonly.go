@@ -0,0 +1,28 @@
+package main
+
+import (
+	"k8s.io/klog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// setReadOnly switches read-only mode on or off, while on Provision refuses new volumes but Delete keeps working
+func (p *customProvisioner) setReadOnly(readOnly bool) {
+	p.readOnly.Store(readOnly)
+	if readOnly {
+		readOnlyMode.Set(1)
+	} else {
+		readOnlyMode.Set(0)
+	}
+	klog.Infof("Read-only mode is now %v", readOnly)
+}
+
+// toggleReadOnlyOnSignal flips read-only mode every time the process receives SIGUSR1
+func (p *customProvisioner) toggleReadOnlyOnSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	for range sigCh {
+		p.setReadOnly(!p.readOnly.Load())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+	"time"
+)
+
+// receiptPrefix starts the name of every receipt ConfigMap, the PV name follows
+const receiptPrefix = "custom-provisioner-receipt-"
+
+// receiptName returns the name of the receipt ConfigMap of a PV, hashing PV names too long to fit
+func receiptName(pvName string) string {
+	name := receiptPrefix + pvName
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	return fmt.Sprintf("%s%x", receiptPrefix, sha256.Sum256([]byte(pvName)))
+}
+
+// writeReceipt records a provisioned volume in a ConfigMap next to its PVC, for GitOps tools reconciling what was
+// provisioned. A receipt is informational: failing to write one, e.g. without RBAC in the namespace, only warns.
+func (p *customProvisioner) writeReceipt(ctx context.Context, pvc *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume, path string) {
+	capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      receiptName(pv.Name),
+			Namespace: pvc.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": provisionerName},
+		},
+		Data: map[string]string{
+			"pvName":        pv.Name,
+			"pvcName":       pvc.Name,
+			"path":          path,
+			"size":          capacity.String(),
+			"provisionedAt": time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	configMaps := p.client.CoreV1().ConfigMaps(pvc.Namespace)
+	_, err := configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// A retried provision updates the receipt of its earlier attempt
+		var existing *corev1.ConfigMap
+		if existing, err = configMaps.Get(ctx, cm.Name, metav1.GetOptions{}); err == nil {
+			existing.Labels, existing.Data = cm.Labels, cm.Data
+			_, err = configMaps.Update(ctx, existing, metav1.UpdateOptions{})
+		}
+	}
+	if apierrors.IsForbidden(err) {
+		klog.Warningf("Not allowed to write the receipt of volume %s in namespace %s, check the provisioner's RBAC: %v", pv.Name, pvc.Namespace, err)
+		return
+	}
+	if err != nil {
+		klog.Warningf("Failed to write the receipt of volume %s in namespace %s: %v", pv.Name, pvc.Namespace, err)
+	}
+}
+
+// deleteReceipt removes the receipt ConfigMap of a deleted volume, a missing one is fine and failures only warn
+func (p *customProvisioner) deleteReceipt(ctx context.Context, pv *corev1.PersistentVolume) {
+	if pv.Spec.ClaimRef == nil {
+		return
+	}
+	namespace := pv.Spec.ClaimRef.Namespace
+	err := p.client.CoreV1().ConfigMaps(namespace).Delete(ctx, receiptName(pv.Name), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.Warningf("Failed to delete the receipt of volume %s in namespace %s: %v", pv.Name, namespace, err)
+	}
+}
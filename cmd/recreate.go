@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// annDirMode records the octal mode of the volume directory as provisioned, setgid included
+	annDirMode = "custom-provisioner/dir-mode"
+	// annDirOwner records the uid:gid owning the volume directory as provisioned
+	annDirOwner = "custom-provisioner/dir-owner"
+)
+
+// dirAnnotations describes how the directory at path is set up, for --recreate-missing-dirs to restore it
+func dirAnnotations(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	mode := uint32(info.Mode().Perm())
+	if info.Mode()&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	annotations := map[string]string{annDirMode: fmt.Sprintf("%04o", mode)}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		annotations[annDirOwner] = fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+	return annotations, nil
+}
+
+// restoreDir creates the directory of a PV the way its annotations say it was provisioned, with the default mode
+// and our own user for PVs from before they were recorded
+func restoreDir(path string, pv *corev1.PersistentVolume) error {
+	mode := uint32(defaultDirMode)
+	if v, ok := pv.Annotations[annDirMode]; ok {
+		parsed, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation %q: %v", annDirMode, v, err)
+		}
+		mode = uint32(parsed)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		return err
+	}
+	if v, ok := pv.Annotations[annDirOwner]; ok {
+		uid, gid, _ := strings.Cut(v, ":")
+		u, uErr := strconv.Atoi(uid)
+		g, gErr := strconv.Atoi(gid)
+		if uErr != nil || gErr != nil {
+			return fmt.Errorf("invalid %s annotation %q", annDirOwner, v)
+		}
+		if err := os.Chown(path, u, g); err != nil {
+			return fmt.Errorf("failed to restore owner of %s: %v", path, err)
+		}
+	}
+	// Chmod after the chown, which may clear setgid
+	fileMode := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	return os.Chmod(path, fileMode)
+}
+
+// recreateMissingDirs recreates, empty, the directories of bound PVs of ours that have gone missing, e.g. after a
+// disk was replaced, so their pods can mount again. The data is gone either way, each one is logged loudly and
+// reported on the PV. Only hostpath volumes are handled, mounts, reservations and remote volumes can't be rebuilt
+// from nothing, and adopted directories are left to whoever manages them.
+func (p *customProvisioner) recreateMissingDirs(ctx context.Context) error {
+	var node *corev1.Node
+	if p.config.nodeName != "" {
+		var err error
+		if node, err = p.client.CoreV1().Nodes().Get(ctx, p.config.nodeName, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("failed to get node %s: %v", p.config.nodeName, err)
+		}
+	}
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	recreated := 0
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		path, ok := volumeSourcePath(pv)
+		if !ok || pv.Annotations[annProvisionedBy] != provisionerName || pv.Status.Phase != corev1.VolumeBound || pv.Spec.ClaimRef == nil {
+			continue
+		}
+		if volumeBackendName(pv) != hostPathBackendName || pv.Annotations[annExternal] == "true" {
+			continue
+		}
+		// Only our own disks, a base path shared by several nodes has each node's volumes pinned to it
+		if p.checkPoolBasePath(pv, path) != nil || (pv.Annotations[annBasePathID] == "" && !volumeUnderBase(path, p.config.basePath, p.config.realBasePath)) {
+			continue
+		}
+		if node != nil && pv.Spec.NodeAffinity != nil && !affinitySelectsNode(pv.Spec.NodeAffinity, node) {
+			continue
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+
+		unlock := p.locks.lock(path)
+		err := restoreDir(path, pv)
+		if err == nil && (p.config.writeMarker || pv.Annotations[annReuseDir] == "true") {
+			ref := pv.Spec.ClaimRef
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: ref.Namespace, Name: ref.Name, UID: ref.UID}}
+			err = writeMarker(path, pv.Name, volumeBackendName(pv), pvc, pv.Annotations[annReuseDir] == "true")
+		}
+		unlock()
+		if err != nil {
+			klog.Errorf("Failed to recreate missing directory %s of volume %s: %v", path, pv.Name, err)
+			continue
+		}
+		klog.Warningf("Recreated missing directory %s of bound volume %s (PVC %s/%s) empty, any data it held is lost",
+			path, pv.Name, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+		p.recorder.Eventf(pv, corev1.EventTypeWarning, "VolumeDirRecreated", "Directory %s was missing and has been recreated empty, its earlier data is lost", path)
+		recreated++
+	}
+	if recreated > 0 {
+		klog.Warningf("Recreated %d missing volume directories", recreated)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	remoteBackendName = "remote"
+	// annNode records on the PV which storage node a remote volume lives on
+	annNode = "custom-provisioner/node"
+	// paramRemoteNode names the storage node in StorageClass parameters when the scheduler didn't pick one
+	paramRemoteNode = "remoteNode"
+	// defaultRemoteAgentPort is where "custom-provisioner agent" listens unless told otherwise
+	defaultRemoteAgentPort = 9443
+	// defaultRemoteTimeout bounds a single agent request unless --remote-timeout says otherwise
+	defaultRemoteTimeout = 30 * time.Second
+)
+
+// RemoteBackend is implemented by backends whose volumes live on another node than the one the provisioner runs on
+type RemoteBackend interface {
+	VolumeBackend
+	// CreateOnNode creates the volume named name on node and returns its path there
+	CreateOnNode(ctx context.Context, node *corev1.Node, name string, sizeBytes int64, mode os.FileMode) (string, error)
+	// DeleteOnNode removes the volume at path on node together with all of its data
+	DeleteOnNode(ctx context.Context, node *corev1.Node, path string) error
+}
+
+// agentVolumeRequest is the body of POST /volumes on the storage agent
+type agentVolumeRequest struct {
+	Name      string      `json:"name"`
+	SizeBytes int64       `json:"sizeBytes"`
+	Mode      os.FileMode `json:"mode"`
+}
+
+// agentVolumeResponse is returned by POST /volumes on the storage agent
+type agentVolumeResponse struct {
+	Path string `json:"path"`
+}
+
+// errAgentNoCapacity is returned when the agent refuses a volume because its node is out of space
+type errAgentNoCapacity struct {
+	msg string
+}
+
+func (e *errAgentNoCapacity) Error() string {
+	return e.msg
+}
+
+// remoteBackend talks to the storage agent ("custom-provisioner agent") running on every storage node
+type remoteBackend struct {
+	httpClient *http.Client
+	port       int
+	token      string
+}
+
+// newRemoteBackend sets up the agent client with the configured CA, bearer token and timeout
+func newRemoteBackend(config provisionerConfig) (*remoteBackend, error) {
+	tlsConfig := &tls.Config{}
+	if config.remoteCAFile != "" {
+		pem, err := os.ReadFile(config.remoteCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote agent CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.remoteCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	var token string
+	if config.remoteTokenFile != "" {
+		data, err := os.ReadFile(config.remoteTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote agent token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	return &remoteBackend{
+		httpClient: &http.Client{
+			Timeout:   config.remoteTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		port:  config.remoteAgentPort,
+		token: token,
+	}, nil
+}
+
+func (b *remoteBackend) Name() string {
+	return remoteBackendName
+}
+
+// Create and Delete are only reachable without a node through a bug, remote volumes always go through the *OnNode methods
+func (b *remoteBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	return fmt.Errorf("the remote backend needs a target node")
+}
+
+func (b *remoteBackend) Delete(ctx context.Context, path string) error {
+	return fmt.Errorf("the remote backend needs a target node")
+}
+
+func (b *remoteBackend) CreateOnNode(ctx context.Context, node *corev1.Node, name string, sizeBytes int64, mode os.FileMode) (string, error) {
+	body, err := json.Marshal(agentVolumeRequest{Name: name, SizeBytes: sizeBytes, Mode: mode})
+	if err != nil {
+		return "", err
+	}
+	respBody, status, err := b.do(ctx, node, http.MethodPost, "/volumes", body)
+	if err != nil {
+		return "", err
+	}
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusInsufficientStorage:
+		return "", &errAgentNoCapacity{msg: fmt.Sprintf("node %s: %s", node.Name, respBody)}
+	default:
+		return "", fmt.Errorf("agent on node %s answered %d: %s", node.Name, status, respBody)
+	}
+
+	var resp agentVolumeResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return "", fmt.Errorf("invalid response from agent on node %s: %v", node.Name, err)
+	}
+	return resp.Path, nil
+}
+
+func (b *remoteBackend) DeleteOnNode(ctx context.Context, node *corev1.Node, path string) error {
+	respBody, status, err := b.do(ctx, node, http.MethodDelete, "/volumes?path="+url.QueryEscape(path), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNoContent {
+		return fmt.Errorf("agent on node %s answered %d: %s", node.Name, status, respBody)
+	}
+	return nil
+}
+
+// do sends one request to the agent on node, addressed by the node's internal IP
+func (b *remoteBackend) do(ctx context.Context, node *corev1.Node, method, path string, body []byte) ([]byte, int, error) {
+	address := nodeInternalIP(node)
+	if address == "" {
+		return nil, 0, fmt.Errorf("node %s has no internal IP", node.Name)
+	}
+	endpoint := "https://" + net.JoinHostPort(address, strconv.Itoa(b.port)) + path
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("request to agent on node %s failed: %v", node.Name, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read response from agent on node %s: %v", node.Name, err)
+	}
+	return bytes.TrimSpace(respBody), resp.StatusCode, nil
+}
+
+func nodeInternalIP(node *corev1.Node) string {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			return addr.Address
+		}
+	}
+	return ""
+}
+
+// remoteTargetNode returns the storage node for a remote volume: the node picked by the scheduler for late
+// binding classes, otherwise the node named by the class's remoteNode parameter
+func (p *customProvisioner) remoteTargetNode(ctx context.Context, options controller.ProvisionOptions) (*corev1.Node, error) {
+	if options.SelectedNode != nil {
+		return options.SelectedNode, nil
+	}
+	name, ok := options.StorageClass.Parameters[paramRemoteNode]
+	if !ok {
+		return nil, fmt.Errorf("the remote backend needs a selected node or the %s StorageClass parameter", paramRemoteNode)
+	}
+	node, err := p.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage node %s: %v", name, err)
+	}
+	return node, nil
+}
+
+// createRemoteVolume asks the agent on node to create the volume and returns its path there
+func (p *customProvisioner) createRemoteVolume(ctx context.Context, backend RemoteBackend, node *corev1.Node, volumeName string, pvc *corev1.PersistentVolumeClaim, policy *volumePolicy) (string, controller.ProvisioningState, error) {
+	quota := quotaSize(pvc)
+	backingBytes := paddedSize(quota.Value(), p.config.capacityPaddingPercent)
+
+	unlock := p.locks.lock(node.Name + ":" + volumeName)
+	defer unlock()
+
+	path, err := backend.CreateOnNode(ctx, node, volumeName, backingBytes, policy.dirMode)
+	if err != nil {
+		// A full node is node specific just like locally, let the scheduler pick another one
+		if _, ok := err.(*errAgentNoCapacity); ok {
+			capacityCheckFailures.WithLabelValues("remote").Inc()
+			return "", controller.ProvisioningReschedule, err
+		}
+		// The agent may have been unreachable after creating the directory, so the outcome is unknown
+		return "", controller.ProvisioningInBackground, fmt.Errorf("failed to create volume on node %s: %v", node.Name, err)
+	}
+	klog.Infof("Created volume %s at %s on node %s", volumeName, path, node.Name)
+	return path, controller.ProvisioningFinished, nil
+}
+
+// deleteRemoteVolume deletes a volume through the agent of the node recorded on the PV
+func (p *customProvisioner) deleteRemoteVolume(ctx context.Context, backend RemoteBackend, volume *corev1.PersistentVolume) error {
+	nodeName, ok := volume.Annotations[annNode]
+	if !ok {
+		return fmt.Errorf("remote volume %s has no %s annotation", volume.Name, annNode)
+	}
+	node, err := p.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get storage node %s: %v", nodeName, err)
+	}
+
+	volumePath, _ := volumeSourcePath(volume)
+	unlock := p.locks.lock(nodeName + ":" + volumePath)
+	defer unlock()
+
+	klog.Infof("Deleting volume %s at path %s on node %s", volume.Name, volumePath, nodeName)
+	// The data is on the agent's node, its size isn't known here
+	err = backend.DeleteOnNode(ctx, node, volumePath)
+	p.audit.record(auditEntry{Operation: auditDelete, PV: volume.Name, Path: volumePath, Node: nodeName, PVCUID: claimUID(volume),
+		Backend: remoteBackendName, BytesRemoved: -1}, err)
+	if err != nil {
+		klog.Errorf("Failed to delete volume %s at path %s on node %s: %v", volume.Name, volumePath, nodeName, err)
+		return p.recordDeleteFailure(ctx, volume, err)
+	}
+	klog.Infof("Successfully deleted volume %s at path %s on node %s", volume.Name, volumePath, nodeName)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// removeBatch is how many entries removeTree reads from a directory at a time
+	removeBatch = 1024
+	// maxRemovePasses bounds the passes over a directory that keeps getting new entries while it's removed
+	maxRemovePasses = 3
+)
+
+var (
+	// removeProgressFiles and removeProgressInterval are how often a running removal logs its progress, whichever
+	// comes first, set from --delete-progress-files and --delete-progress-interval
+	removeProgressFiles    int64 = 100000
+	removeProgressInterval       = 30 * time.Second
+
+	// deleteProgress is the number of entries removed so far by each running removal
+	deleteProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "provisioner_delete_progress",
+		Help: "Files and directories removed so far by each volume deletion in progress.",
+	}, []string{"volume"})
+)
+
+// treeRemover removes a tree entry by entry, keeping count for the progress log
+type treeRemover struct {
+	root    string
+	removed int64
+	// loggedAt and loggedRemoved are the time and count of the last progress log line
+	loggedAt      time.Time
+	loggedRemoved int64
+	gauge         prometheus.Gauge
+}
+
+// removeTree removes path and everything below it like os.RemoveAll, but a directory at a time so a volume with
+// millions of files logs its progress and can be interrupted. A cancelled ctx stops the walk with an error, what is
+// left is removed by the retried Delete.
+func removeTree(ctx context.Context, path string) error {
+	start := time.Now()
+	volume := filepath.Base(path)
+	r := &treeRemover{root: path, loggedAt: start, gauge: deleteProgress.WithLabelValues(volume)}
+	defer deleteProgress.DeleteLabelValues(volume)
+
+	err := r.remove(ctx, path)
+	if err == nil && (r.removed >= removeProgressFiles || time.Since(start) >= removeProgressInterval) {
+		klog.Infof("Removed all %d entries of %s in %v", r.removed, path, time.Since(start).Round(time.Second))
+	}
+	return err
+}
+
+func (r *treeRemover) remove(ctx context.Context, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		err = os.Remove(path)
+	} else {
+		// Removing entries while the directory is read may make the read skip some, those are caught by a
+		// directory that isn't empty yet and another pass over it
+		for pass := 1; ; pass++ {
+			if err = r.emptyDir(ctx, path); err != nil {
+				return err
+			}
+			err = os.Remove(path)
+			if err == nil || !errors.Is(err, syscall.ENOTEMPTY) || pass == maxRemovePasses {
+				break
+			}
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.count()
+	return nil
+}
+
+// emptyDir removes the entries of dir, reading it removeBatch entries at a time
+func (r *treeRemover) emptyDir(ctx context.Context, dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		entries, err := f.ReadDir(removeBatch)
+		for _, entry := range entries {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("removal of %s interrupted after %d entries: %v", r.root, r.removed, ctxErr)
+			}
+			if err := r.remove(ctx, filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// count records one removed entry and logs the progress when it's due
+func (r *treeRemover) count() {
+	r.removed++
+	if r.removed%removeBatch == 0 {
+		r.gauge.Set(float64(r.removed))
+	}
+	if r.removed-r.loggedRemoved < removeProgressFiles && time.Since(r.loggedAt) < removeProgressInterval {
+		return
+	}
+	r.gauge.Set(float64(r.removed))
+	klog.Infof("Removing %s: %d entries removed so far", r.root, r.removed)
+	r.loggedAt, r.loggedRemoved = time.Now(), r.removed
+}
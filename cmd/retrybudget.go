@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v7/controller"
+	"sync"
+	"time"
+)
+
+// notAttemptedError turns a PVC away before any work was done on it, e.g. in read-only mode, while the base path is
+// unavailable or within --min-provision-interval of its last attempt. It doesn't count against the PVC's attempts.
+type notAttemptedError struct {
+	err error
+}
+
+func (e *notAttemptedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notAttemptedError) Unwrap() error {
+	return e.err
+}
+
+// provisionFailures is the failure history of one PVC
+type provisionFailures struct {
+	count   int
+	last    time.Time
+	lastErr string
+}
+
+// provisionBudget counts the failed provisions of every PVC UID for --max-provision-attempts. A PVC that used up
+// its budget fails fast until it went --provision-attempts-window without a real attempt, then its history is
+// evicted and it gets a fresh budget. Recreating the PVC gives it a new UID and so a new budget right away.
+type provisionBudget struct {
+	mu       sync.Mutex
+	failures map[types.UID]*provisionFailures
+}
+
+// exhausted returns the failure history of the PVC when it has used up limit attempts
+func (b *provisionBudget) exhausted(uid types.UID, limit int, window time.Duration, now time.Time) (provisionFailures, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.failures[uid]
+	if !ok || f.count < limit {
+		return provisionFailures{}, false
+	}
+	if now.Sub(f.last) >= window {
+		delete(b.failures, uid)
+		return provisionFailures{}, false
+	}
+	return *f, true
+}
+
+// failed records a failed attempt for the PVC and returns how many it has had, evicting the histories of PVCs
+// that haven't failed within window, deleted PVCs among them
+func (b *provisionBudget) failed(uid types.UID, err error, window time.Duration, now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures == nil {
+		b.failures = map[types.UID]*provisionFailures{}
+	}
+	for other, f := range b.failures {
+		if now.Sub(f.last) >= window {
+			delete(b.failures, other)
+		}
+	}
+	f, ok := b.failures[uid]
+	if !ok {
+		f = &provisionFailures{}
+		b.failures[uid] = f
+	}
+	f.count++
+	f.last = now
+	f.lastErr = err.Error()
+	return f.count
+}
+
+// succeeded forgets the failures of a provisioned PVC
+func (b *provisionBudget) succeeded(uid types.UID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, uid)
+}
+
+// checkBudget fails a PVC that used up its attempts without trying again, nil while it has attempts left
+func (p *customProvisioner) checkBudget(pvc *corev1.PersistentVolumeClaim) error {
+	if p.config.maxProvisionAttempts <= 0 {
+		return nil
+	}
+	f, ok := p.budget.exhausted(pvc.UID, p.config.maxProvisionAttempts, p.config.provisionAttemptsWindow, time.Now())
+	if !ok {
+		return nil
+	}
+	return fmt.Errorf("giving up after %d failed provision attempts, the last %v ago: %s", f.count, time.Since(f.last).Round(time.Second), f.lastErr)
+}
+
+// chargeBudget records the outcome of a provision and turns the failure using up the PVC's last attempt into a
+// terminal one, with an event telling the user the claim looks unsatisfiable. Deferred provisions, e.g. waiting for
+// a class slot, and provisions turned away before any work, see notAttemptedError, are not the claim's fault and
+// don't count.
+func (p *customProvisioner) chargeBudget(pvc *corev1.PersistentVolumeClaim, state controller.ProvisioningState, err error) (controller.ProvisioningState, error) {
+	if p.config.maxProvisionAttempts <= 0 {
+		return state, err
+	}
+	if err == nil {
+		p.budget.succeeded(pvc.UID)
+		return state, err
+	}
+	var notAttempted *notAttemptedError
+	if state == controller.ProvisioningNoChange || errors.As(err, &notAttempted) || p.readOnly.Load() {
+		return state, err
+	}
+	failures := p.budget.failed(pvc.UID, err, p.config.provisionAttemptsWindow, time.Now())
+	if failures < p.config.maxProvisionAttempts {
+		return state, err
+	}
+	if failures == p.config.maxProvisionAttempts {
+		klog.Errorf("Giving up provisioning PVC %s/%s after %d failed attempts: %v", pvc.Namespace, pvc.Name, failures, err)
+		p.recorder.Eventf(pvc, corev1.EventTypeWarning, "ProvisioningUnsatisfiable",
+			"Giving up after %d failed provision attempts, the claim looks unsatisfiable: %v. Fix and recreate the PVC, or wait %v for another round of attempts",
+			failures, err, p.config.provisionAttemptsWindow)
+	}
+	return controller.ProvisioningFinished, fmt.Errorf("giving up after %d failed provision attempts: %v", failures, err)
+}
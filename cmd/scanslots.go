@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/klog"
+)
+
+// scanSlots bounds the background tasks walking the disk at the same time for --max-concurrent-scans: the usage
+// scanner, the orphan scan, archive pruning and the staging sweep. A nil scanSlots lets every task run at once.
+type scanSlots chan struct{}
+
+func newScanSlots(limit int) scanSlots {
+	if limit <= 0 {
+		return nil
+	}
+	return make(scanSlots, limit)
+}
+
+// acquire waits for a free slot and returns the func giving it back, or ctx's error when ctx ends first
+func (s scanSlots) acquire(ctx context.Context, task string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	select {
+	case s <- struct{}{}:
+		return func() { <-s }, nil
+	default:
+	}
+	klog.V(logDecisions).Infof("Waiting for a scan slot for the %s, %d scans are running", task, cap(s))
+	select {
+	case s <- struct{}{}:
+		return func() { <-s }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gave up waiting for a scan slot for the %s: %v", task, ctx.Err())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+	"net/http"
+	"strings"
+)
+
+// startHTTPServer serves /metrics, /healthz, /readyz and /config on address in the background, /healthz also reports the current mode.
+// Administrative endpoints require adminToken as bearer token and are not served at all without one.
+func startHTTPServer(address string, p *customProvisioner, adminToken string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if p.readOnly.Load() {
+			w.Write([]byte("ok (read-only)"))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		// Not ready while the base path's mount is stale, the process itself is fine so /healthz keeps passing
+		if err := p.mount.unavailable(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !p.reconciled.Load() {
+			http.Error(w, "startup orphan scan still running", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		// Flags are fixed at startup, the read-only mode and the policy ConfigMap are reported as they are right now
+		flags := p.config.effective()
+		flags["read-only"] = p.readOnly.Load()
+		writeJSON(w, map[string]interface{}{
+			"provisioner": provisionerName,
+			"flags":       flags,
+			"policies":    p.policies.snapshot(),
+		})
+	})
+	if adminToken != "" {
+		mux.Handle("/gc", requireToken(adminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			summary, err := p.collectOrphans(r.Context())
+			if err == errGCRunning {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, summary)
+		})))
+	}
+
+	go func() {
+		klog.Infof("Serving metrics and health checks on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+}
+
+// requireToken rejects requests that don't carry token as "Authorization: Bearer <token>"
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("Failed to write HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownReportTimeout bounds the PV list the shutdown report takes its volume counts from
+const shutdownReportTimeout = 10 * time.Second
+
+// sessionStats counts what this process did since it started, for the shutdown report
+type sessionStats struct {
+	startedAt       time.Time
+	provisions      atomic.Int64
+	provisionErrors atomic.Int64
+	deletes         atomic.Int64
+	deleteErrors    atomic.Int64
+	// inFlight is the number of Provision and Delete calls running right now
+	inFlight atomic.Int64
+}
+
+// track counts one Provision or Delete call, the returned func records how it ended
+func (s *sessionStats) track(ok, failed *atomic.Int64) func(error) {
+	s.inFlight.Add(1)
+	return func(err error) {
+		if err != nil {
+			failed.Add(1)
+		} else {
+			ok.Add(1)
+		}
+		s.inFlight.Add(-1)
+	}
+}
+
+// shutdownReport is the JSON summary written to --shutdown-report when the provisioner stops
+type shutdownReport struct {
+	Identity        string    `json:"identity"`
+	StartedAt       time.Time `json:"startedAt"`
+	StoppedAt       time.Time `json:"stoppedAt"`
+	UptimeSeconds   int64     `json:"uptimeSeconds"`
+	Provisions      int64     `json:"provisions"`
+	ProvisionErrors int64     `json:"provisionErrors"`
+	Deletes         int64     `json:"deletes"`
+	DeleteErrors    int64     `json:"deleteErrors"`
+	// InFlight is the number of calls the drain gave up waiting for
+	InFlight int64 `json:"inFlight"`
+	// ManagedVolumes and CommittedBytes come from the PV list, -1 when it failed
+	ManagedVolumes int64  `json:"managedVolumes"`
+	CommittedBytes int64  `json:"committedBytes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// drain waits up to timeout for the running Provision and Delete calls to return, it reports whether they all did
+func (p *customProvisioner) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for p.stats.inFlight.Load() > 0 {
+		if !time.Now().Before(deadline) {
+			klog.Warningf("%d operations still running after waiting %v, shutting down anyway", p.stats.inFlight.Load(), timeout)
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// writeShutdownReport summarizes the session into path, replacing it atomically
+func (p *customProvisioner) writeShutdownReport(path string) error {
+	now := time.Now()
+	report := shutdownReport{
+		Identity:        p.config.identity,
+		StartedAt:       p.stats.startedAt.UTC(),
+		StoppedAt:       now.UTC(),
+		UptimeSeconds:   int64(now.Sub(p.stats.startedAt).Seconds()),
+		Provisions:      p.stats.provisions.Load(),
+		ProvisionErrors: p.stats.provisionErrors.Load(),
+		Deletes:         p.stats.deletes.Load(),
+		DeleteErrors:    p.stats.deleteErrors.Load(),
+		InFlight:        p.stats.inFlight.Load(),
+		ManagedVolumes:  -1,
+		CommittedBytes:  -1,
+	}
+
+	// The provisioner's own context is gone by now, the list gets one of its own
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownReportTimeout)
+	defer cancel()
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to list PVs: %v", err)
+	} else {
+		report.ManagedVolumes, report.CommittedBytes = 0, 0
+		for i := range pvs.Items {
+			pv := &pvs.Items[i]
+			if pv.Annotations[annProvisionedBy] != provisionerName {
+				continue
+			}
+			report.ManagedVolumes++
+			if path, ok := volumeSourcePath(pv); ok && volumeUnderBase(path, p.config.basePath, p.config.realBasePath) {
+				report.CommittedBytes += pv.Spec.Capacity.Storage().Value()
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".shutdown-report-")
+	if err != nil {
+		return fmt.Errorf("failed to create shutdown report: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write shutdown report: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write shutdown report: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
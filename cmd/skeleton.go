@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// copySkeleton copies the contents of the skeleton directory into a new volume, keeping the permission bits of
+// every entry after masking them with mask. The volume directory itself keeps the mode it was created with. Files
+// are created by us, so with --inherit-parent-group they pick up the volume's group through its setgid bit like
+// anything a pod writes; directories keep that setgid bit whatever the mask.
+func copySkeleton(skeleton, volumePath string, mask *modeFlag) error {
+	return filepath.WalkDir(skeleton, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(skeleton, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(volumePath, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			mode := mask.apply(info.Mode().Perm())
+			if err := os.Mkdir(target, mode); err != nil {
+				return err
+			}
+			// Mkdir inherited setgid from the parent if it has it, Chmod must not clear it
+			created, err := os.Stat(target)
+			if err != nil {
+				return err
+			}
+			return os.Chmod(target, mode|created.Mode()&os.ModeSetgid)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, mask.apply(info.Mode().Perm()))
+		default:
+			return fmt.Errorf("%s is not a regular file, directory or symlink", path)
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// The umask applied on create, so set the mode explicitly
+	return os.Chmod(dst, mode)
+}
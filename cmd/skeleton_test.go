@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSkeleton lays out a nested skeleton directory with explicit modes, whatever the umask
+func writeSkeleton(t *testing.T) string {
+	t.Helper()
+	skeleton := t.TempDir()
+	for _, dir := range []string{"bin", "bin/lib"} {
+		path := filepath.Join(skeleton, dir)
+		if err := os.Mkdir(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, mode := range map[string]os.FileMode{"conf": 0666, "bin/run": 0777, "bin/lib/data": 0662} {
+		path := filepath.Join(skeleton, file)
+		if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("run", filepath.Join(skeleton, "bin", "link")); err != nil {
+		t.Fatal(err)
+	}
+	return skeleton
+}
+
+func TestCopySkeletonMasksRecursively(t *testing.T) {
+	skeleton := writeSkeleton(t)
+	volume := filepath.Join(t.TempDir(), "pv-default-skel")
+	if err := os.Mkdir(volume, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// A volume with --inherit-parent-group has the setgid bit, nested directories must keep it
+	if err := os.Chmod(volume, 0775|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	var mask modeFlag
+	if err := mask.Set("0775"); err != nil {
+		t.Fatal(err)
+	}
+	if err := copySkeleton(skeleton, volume, &mask); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]os.FileMode{
+		"conf":         0664,
+		"bin":          0775 | os.ModeDir | os.ModeSetgid,
+		"bin/run":      0775,
+		"bin/lib":      0775 | os.ModeDir | os.ModeSetgid,
+		"bin/lib/data": 0660,
+	}
+	for rel, mode := range want {
+		info, err := os.Lstat(filepath.Join(volume, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			continue
+		}
+		if got := info.Mode() & (os.ModePerm | os.ModeDir | os.ModeSetgid); got != mode {
+			t.Errorf("%s has mode %v, want %v", rel, got, mode)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(volume, "bin", "link")); err != nil || link != "run" {
+		t.Errorf("bin/link = %q, %v, want a symlink to run", link, err)
+	}
+	info, err := os.Stat(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0775 {
+		t.Errorf("volume directory mode changed to %04o", info.Mode().Perm())
+	}
+}
+
+func TestCopySkeletonWithoutMask(t *testing.T) {
+	skeleton := writeSkeleton(t)
+	volume := t.TempDir()
+	if err := copySkeleton(skeleton, volume, &modeFlag{}); err != nil {
+		t.Fatal(err)
+	}
+	for rel, mode := range map[string]os.FileMode{"conf": 0666, "bin": 0777, "bin/lib/data": 0662} {
+		info, err := os.Stat(filepath.Join(volume, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %04o, want the skeleton's %04o", rel, info.Mode().Perm(), mode)
+		}
+	}
+}
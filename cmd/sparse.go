@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	sparseReserveBackendName = "sparse-reserve"
+	// reserveFileName is the sparse file recording the size committed to a sparse-reserve volume
+	reserveFileName = ".custom-provisioner-reserve"
+)
+
+// sparseReserveBackend is a plain directory holding a sparse reservation file sized to the volume. Nothing stops
+// a pod from writing more, but the reservations let the capacity check refuse volumes once the committed sizes
+// would exceed the filesystem, a thin quota without loop mounts.
+type sparseReserveBackend struct {
+	hostPathBackend
+}
+
+func (b *sparseReserveBackend) Name() string {
+	return sparseReserveBackendName
+}
+
+func (b *sparseReserveBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	if err := b.hostPathBackend.Create(ctx, path, sizeBytes, mode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(path, reserveFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0400)
+	if err != nil {
+		os.RemoveAll(path)
+		return fmt.Errorf("failed to create reservation file: %v", err)
+	}
+	defer f.Close()
+	// Truncate only sets the size, no blocks are allocated
+	if err := f.Truncate(sizeBytes); err != nil {
+		os.RemoveAll(path)
+		return fmt.Errorf("failed to size reservation file: %v", err)
+	}
+	return nil
+}
+
+// committedBytes sums the reservation files of the volumes under basePath
+func committedBytes(basePath string) (int64, error) {
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read base path %s: %v", basePath, err)
+	}
+	var committed int64
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(basePath, entry.Name(), reserveFileName))
+		if err != nil {
+			continue
+		}
+		committed += info.Size()
+	}
+	return committed, nil
+}
+
+// checkCommitted refuses a sparse-reserve volume of requestBytes when it would commit more than the size of the
+// filesystem holding basePath
+func checkCommitted(basePath string, requestBytes int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(basePath, &st); err != nil {
+		return fmt.Errorf("failed to statfs %s: %v", basePath, err)
+	}
+	committed, err := committedBytes(basePath)
+	if err != nil {
+		return err
+	}
+	total := int64(st.Blocks) * st.Bsize
+	if committed+requestBytes > total {
+		return &capacityCheckFailed{
+			reason: "committed",
+			msg:    fmt.Sprintf("not enough uncommitted space on %s: requested %d bytes, %d of %d bytes already reserved", basePath, requestBytes, committed, total),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stagingDirName is where volumes are built under the base path before they are renamed into place, one
+// subdirectory per backend so leftovers can be torn down the way they were made
+const stagingDirName = ".tmp"
+
+// stagingSupported reports whether volumes of the backend survive being renamed, mounts and NFS exports are
+// tied to their path and are created in place instead
+func stagingSupported(backend VolumeBackend) bool {
+	name := backend.Name()
+	return name == hostPathBackendName || name == btrfsBackendName || name == sparseReserveBackendName
+}
+
+// stagingPath returns where the volume is built before it's renamed to its final path
+func stagingPath(basePath, backend, volumeName string) string {
+	return filepath.Join(basePath, stagingDirName, backend, volumeName)
+}
+
+// prepareStaging makes sure the backend's staging directory exists and holds nothing from an earlier attempt
+// at the volume, the caller holds the volume path's lock
+func (p *customProvisioner) prepareStaging(ctx context.Context, backend VolumeBackend, stagePath string) error {
+	if err := os.MkdirAll(filepath.Dir(stagePath), 0700); err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	if _, err := os.Lstat(stagePath); err == nil {
+		klog.Infof("Removing %s left behind by an earlier attempt", stagePath)
+		if err := backend.Delete(ctx, stagePath); err != nil {
+			return fmt.Errorf("failed to remove leftover %s: %v", stagePath, err)
+		}
+	}
+	return nil
+}
+
+// sweepStaging removes half built volumes a crash left in the staging directories of the base paths. Entries
+// younger than maxAge are skipped, another replica sharing the base path may still be building them.
+func (p *customProvisioner) sweepStaging(ctx context.Context, maxAge time.Duration) error {
+	release, err := p.scans.acquire(ctx, "staging sweep")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// One unreadable disk doesn't keep the others from being swept
+	var sweepErr error
+	for _, basePath := range p.config.basePaths() {
+		if err := p.sweepStagingOf(ctx, basePath, maxAge); err != nil && sweepErr == nil {
+			sweepErr = err
+		}
+	}
+	return sweepErr
+}
+
+// sweepStagingOf sweeps the staging directory of one base path
+func (p *customProvisioner) sweepStagingOf(ctx context.Context, basePath string, maxAge time.Duration) error {
+	root := filepath.Join(basePath, stagingDirName)
+	backendDirs, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory %s: %v", root, err)
+	}
+
+	removed := 0
+	for _, backendDir := range backendDirs {
+		if !backendDir.IsDir() {
+			continue
+		}
+		backend, err := p.backendFor(backendDir.Name())
+		if err != nil {
+			klog.Warningf("Not sweeping staging directory %s: %v", filepath.Join(root, backendDir.Name()), err)
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(root, backendDir.Name()))
+		if err != nil {
+			klog.Warningf("Failed to read staging directory %s: %v", filepath.Join(root, backendDir.Name()), err)
+			continue
+		}
+		for _, entry := range entries {
+			path := filepath.Join(root, backendDir.Name(), entry.Name())
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			age := time.Since(info.ModTime())
+			if age < maxAge {
+				klog.V(logDecisions).Infof("Keeping staging entry %s, it is only %v old", path, age.Round(time.Second))
+				continue
+			}
+
+			unlock := p.locks.lock(filepath.Join(basePath, entry.Name()))
+			err = p.fsOp(ctx, "sweep", path, func() error { return backend.Delete(ctx, path) })
+			unlock()
+			if err != nil {
+				klog.Errorf("Failed to remove stale staging entry %s: %v", path, err)
+				continue
+			}
+			klog.Infof("Removed stale staging entry %s, last modified %v ago", path, age.Round(time.Second))
+			removed++
+		}
+	}
+	if removed > 0 {
+		klog.Infof("Staging sweep removed %d stale entries from %s", removed, root)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepStagingCoversBasePathPool(t *testing.T) {
+	config := newTestConfig(t)
+	disk2 := t.TempDir()
+	config.basePathPool = basePathPoolFlag{"disk2": disk2}
+	p := newTestProvisioner(t, config, nil)
+
+	var stale []string
+	for _, basePath := range []string{config.basePath, disk2} {
+		path := stagingPath(basePath, hostPathBackendName, "pv-default-stale")
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+		stale = append(stale, path)
+	}
+	fresh := stagingPath(disk2, hostPathBackendName, "pv-default-fresh")
+	if err := os.MkdirAll(fresh, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.sweepStaging(context.Background(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("stale staging entry %s survived the sweep: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh staging entry %s was swept: %v", filepath.Base(fresh), err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// findStaticPV looks for an available, unclaimed PV that the PV controller could bind to the PVC instead of
+// us creating a new one: same class, matching the PVC selector, big enough and offering all requested access modes
+func (p *customProvisioner) findStaticPV(ctx context.Context, pvc *corev1.PersistentVolumeClaim, className string) (*corev1.PersistentVolume, error) {
+	listOptions := metav1.ListOptions{}
+	if pvc.Spec.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(pvc.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector on PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+		listOptions.LabelSelector = selector.String()
+	}
+
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Status.Phase != corev1.VolumeAvailable || pv.Spec.ClaimRef != nil || pv.Spec.StorageClassName != className {
+			continue
+		}
+		if capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]; !ok || capacity.Cmp(requested) < 0 {
+			continue
+		}
+		if !volumeModesMatch(pv, pvc) || !hasAccessModes(pv.Spec.AccessModes, pvc.Spec.AccessModes) {
+			continue
+		}
+		return pv, nil
+	}
+	return nil, nil
+}
+
+func volumeModesMatch(pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) bool {
+	pvMode, pvcMode := corev1.PersistentVolumeFilesystem, corev1.PersistentVolumeFilesystem
+	if pv.Spec.VolumeMode != nil {
+		pvMode = *pv.Spec.VolumeMode
+	}
+	if pvc.Spec.VolumeMode != nil {
+		pvcMode = *pvc.Spec.VolumeMode
+	}
+	return pvMode == pvcMode
+}
+
+// hasAccessModes reports whether every wanted access mode is in have
+func hasAccessModes(have, wanted []corev1.PersistentVolumeAccessMode) bool {
+	for _, w := range wanted {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	tmpfsBackendName = "tmpfs"
+	// meminfoPath is where the kernel reports the node's memory
+	meminfoPath = "/proc/meminfo"
+)
+
+// tmpfsBackend mounts a tmpfs sized to the request at every volume path, RAM backed scratch space whose data is
+// gone with the mount. Like the overlay backend it needs a privileged container with Bidirectional mount
+// propagation.
+type tmpfsBackend struct{}
+
+func (b *tmpfsBackend) Name() string {
+	return tmpfsBackendName
+}
+
+func (b *tmpfsBackend) Create(ctx context.Context, path string, sizeBytes int64, mode os.FileMode) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create volume directory: %v", err)
+	}
+	options := fmt.Sprintf("size=%d,mode=%o", sizeBytes, mode.Perm())
+	if err := runCommand(ctx, "mount", "-t", "tmpfs", "-o", options, "tmpfs", path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func (b *tmpfsBackend) Delete(ctx context.Context, path string) error {
+	mounted, err := isMountPoint(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := runCommand(ctx, "umount", path); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// memAvailable returns the MemAvailable estimate of /proc/meminfo in bytes, the memory new allocations can take
+// without the node swapping
+func memAvailable() (int64, error) {
+	f, err := os.Open(meminfoPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", meminfoPath, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemAvailable:    1234567 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid MemAvailable in %s: %v", meminfoPath, err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", meminfoPath, err)
+	}
+	return 0, fmt.Errorf("no MemAvailable in %s", meminfoPath)
+}
+
+// checkFreeMemory refuses a tmpfs volume while the node has less than minFree bytes of memory available, filling
+// RAM backed volumes on a node under memory pressure gets pods OOM killed
+func checkFreeMemory(minFree int64) error {
+	available, err := memAvailable()
+	if err != nil {
+		return err
+	}
+	if available < minFree {
+		return &capacityCheckFailed{
+			reason: "memory",
+			msg:    fmt.Sprintf("not enough free memory for a tmpfs volume: %d bytes available, --min-free-memory is %d bytes", available, minFree),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// requiredTools returns the external commands the named backend runs, none for backends working in-process
+func requiredTools(backend string, config provisionerConfig) []string {
+	switch backend {
+	case btrfsBackendName:
+		return []string{"btrfs"}
+	case overlayBackendName, tmpfsBackendName:
+		return []string{"mount", "umount"}
+	case nfsBackendName:
+		return []string{"exportfs"}
+	case encryptedBackendName:
+		return []string{"gocryptfs", "fusermount"}
+	case loopbackBackendName:
+		fsType := config.loopbackFSType
+		if fsType == "" {
+			fsType = defaultLoopbackFSType
+		}
+		return []string{"mkfs." + fsType, "mount", "umount"}
+	}
+	return nil
+}
+
+// checkTools makes sure every command the given backends run is on PATH, so a slim image fails at startup
+// rather than on the first PVC. The error lists each missing command with the backends needing it.
+func checkTools(backends []string, config provisionerConfig) error {
+	neededBy := map[string][]string{}
+	for _, backend := range backends {
+		for _, tool := range requiredTools(backend, config) {
+			if _, err := exec.LookPath(tool); err != nil {
+				neededBy[tool] = append(neededBy[tool], backend)
+			}
+		}
+	}
+	if len(neededBy) == 0 {
+		return nil
+	}
+	missing := make([]string, 0, len(neededBy))
+	for tool, users := range neededBy {
+		missing = append(missing, fmt.Sprintf("%s (needed by %s)", tool, strings.Join(users, ", ")))
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("missing on PATH: %s", strings.Join(missing, "; "))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// topologyAffinity turns the StorageClass allowedTopologies into a PV node affinity. When the volume's node is
+// known (pinned to the running node, or selected by the scheduler) only the terms matching that node are kept and
+// an error is returned if there are none; a pinned volume additionally keeps its hostname requirement in every term.
+func topologyAffinity(allowed []corev1.TopologySelectorTerm, node *corev1.Node, pinned bool) (*corev1.VolumeNodeAffinity, error) {
+	var terms []corev1.NodeSelectorTerm
+	for _, topology := range allowed {
+		if node != nil && !nodeMatchesTopology(node, topology) {
+			continue
+		}
+		var term corev1.NodeSelectorTerm
+		for _, expr := range topology.MatchLabelExpressions {
+			term.MatchExpressions = append(term.MatchExpressions, corev1.NodeSelectorRequirement{
+				Key:      expr.Key,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   expr.Values,
+			})
+		}
+		if pinned {
+			term.MatchExpressions = append(term.MatchExpressions, nodeAffinityFor(node).Required.NodeSelectorTerms[0].MatchExpressions...)
+		}
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 0 {
+		if node != nil {
+			return nil, fmt.Errorf("node %s is not in the allowed topologies of the StorageClass", node.Name)
+		}
+		return nil, nil
+	}
+	return &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: terms}}, nil
+}
+
+// nodeMatchesTopology reports whether the node's labels satisfy every expression of the topology term
+func nodeMatchesTopology(node *corev1.Node, topology corev1.TopologySelectorTerm) bool {
+	for _, expr := range topology.MatchLabelExpressions {
+		value, ok := node.Labels[expr.Key]
+		if !ok {
+			return false
+		}
+		found := false
+		for _, v := range expr.Values {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until initTracing installs a real TracerProvider, so spans cost next to nothing when tracing is off
+var tracer = otel.Tracer("custom-provisioner")
+
+// initTracing sets up an OTLP/HTTP exporter sending spans to endpoint (host:port) and returns a function flushing them on shutdown
+func initTracing(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("custom-provisioner")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("custom-provisioner")
+	return provider.Shutdown, nil
+}
+
+// endSpan records the outcome of an operation on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("outcome", "success"))
+	}
+	span.End()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"time"
+)
+
+const (
+	// annTTL on a PVC asks for the volume to be reaped this long after it was provisioned, e.g. "2h"
+	annTTL = "custom-provisioner/ttl"
+	// annExpiresAt is set on the PV of a PVC with a TTL, in RFC 3339
+	annExpiresAt = "custom-provisioner/expires-at"
+	// annProtected on the PV or the PVC keeps an expired volume from being reaped
+	annProtected = "custom-provisioner/protected"
+)
+
+// volumeExpiry returns when the volume of the PVC expires according to its TTL annotation, zero without one
+func volumeExpiry(pvc *corev1.PersistentVolumeClaim, now time.Time) (time.Time, error) {
+	v, ok := pvc.Annotations[annTTL]
+	if !ok {
+		return time.Time{}, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return time.Time{}, fmt.Errorf("invalid %s annotation %q, expected a positive duration like 2h", annTTL, v)
+	}
+	return now.Add(ttl).UTC(), nil
+}
+
+// reapExpired deletes the PVCs whose volumes expired. Deleting the claim hands the volume to the normal reclaim
+// flow, so a Retain volume keeps its data and a Delete volume is removed by our Delete. Volumes protected by
+// annProtected on either the PV or the PVC are left alone.
+func (p *customProvisioner) reapExpired(ctx context.Context) error {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PVs: %v", err)
+	}
+
+	now := time.Now()
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		v, ok := pv.Annotations[annExpiresAt]
+		if !ok || pv.Annotations[annProvisionedBy] != provisionerName {
+			continue
+		}
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			klog.Warningf("PV %s has an invalid %s annotation %q, not reaping it", pv.Name, annExpiresAt, v)
+			continue
+		}
+		if now.Before(expiresAt) || pv.Annotations[annProtected] == "true" {
+			continue
+		}
+		ref := pv.Spec.ClaimRef
+		if ref == nil || pv.Status.Phase != corev1.VolumeBound {
+			// Unbound volumes are already in the hands of the reclaim flow
+			continue
+		}
+
+		pvc, err := p.client.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			klog.Errorf("Failed to get PVC %s/%s of expired PV %s: %v", ref.Namespace, ref.Name, pv.Name, err)
+			continue
+		}
+		if pvc.UID != ref.UID || pvc.DeletionTimestamp != nil || pvc.Annotations[annProtected] == "true" {
+			continue
+		}
+
+		klog.Infof("Volume %s expired at %s, deleting PVC %s/%s", pv.Name, v, pvc.Namespace, pvc.Name)
+		uid := pvc.UID
+		err = p.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Errorf("Failed to delete expired PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		p.recorder.Eventf(pv, corev1.EventTypeNormal, "VolumeExpired", "Volume expired at %s, deleted PVC %s/%s", v, pvc.Namespace, pvc.Name)
+	}
+	return nil
+}
+
+// runTTLReaper looks for expired volumes every interval until ctx is cancelled, skipping the intervals outside
+// the maintenance window
+func (p *customProvisioner) runTTLReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !p.config.maintenanceWindow.open(time.Now()) {
+			klog.V(logDecisions).Infof("Outside the maintenance window %s, not reaping expired volumes", p.config.maintenanceWindow.String())
+		} else if err := p.reapExpired(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("TTL reaper failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// usageCacheMaxAge forces a full rescan of a volume now and then. Writes into existing files don't change any
+// directory's mtime, so the per-directory cache alone would miss files growing in place.
+const usageCacheMaxAge = 30 * time.Minute
+
+// volumeUsedBytes is the space used by every volume on this node as of the last usage scan
+var volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "provisioner_volume_used_bytes",
+	Help: "Bytes used by the files of each volume, as of the last usage scan.",
+}, []string{"pv"})
+
+// dirUsage is the cached content of one directory: the size of the files directly in it and its subdirectories
+type dirUsage struct {
+	mtime   time.Time
+	files   int64
+	subdirs []string
+}
+
+// usageCalculator sums up the size of volume directories. It walks the tree like filepath.WalkDir, reading
+// directory entries without an extra Lstat per directory, scans sibling subdirectories in parallel up to the
+// worker limit and stops as soon as ctx is cancelled. A directory whose mtime didn't change since the last scan
+// reuses its cached file total, so an unchanged volume costs one stat per directory instead of one per file.
+type usageCalculator struct {
+	slots chan struct{}
+
+	mu        sync.Mutex
+	dirs      map[string]dirUsage
+	fullScans map[string]time.Time
+}
+
+func newUsageCalculator(workers int) *usageCalculator {
+	if workers < 1 {
+		workers = 1
+	}
+	return &usageCalculator{
+		slots:     make(chan struct{}, workers),
+		dirs:      map[string]dirUsage{},
+		fullScans: map[string]time.Time{},
+	}
+}
+
+// size returns the bytes used by the files under root
+func (u *usageCalculator) size(ctx context.Context, root string) (int64, error) {
+	u.mu.Lock()
+	useCache := time.Since(u.fullScans[root]) < usageCacheMaxAge
+	u.mu.Unlock()
+
+	var total atomic.Int64
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		if ctx.Err() != nil {
+			fail(ctx.Err())
+			return
+		}
+		usage, err := u.scanDir(dir, useCache)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fail(err)
+			}
+			return
+		}
+		total.Add(usage.files)
+		for _, sub := range usage.subdirs {
+			// Hand the subdirectory to another goroutine while a worker slot is free, walk it here otherwise
+			select {
+			case u.slots <- struct{}{}:
+				wg.Add(1)
+				go func(sub string) {
+					defer wg.Done()
+					defer func() { <-u.slots }()
+					walk(sub)
+				}(sub)
+			default:
+				walk(sub)
+			}
+		}
+	}
+	walk(root)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	if !useCache {
+		u.mu.Lock()
+		u.fullScans[root] = time.Now()
+		u.mu.Unlock()
+	}
+	return total.Load(), nil
+}
+
+// scanDir returns the usage of a single directory, from the cache when allowed and its mtime is unchanged
+func (u *usageCalculator) scanDir(dir string, useCache bool) (dirUsage, error) {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return dirUsage{}, err
+	}
+	if useCache {
+		u.mu.Lock()
+		cached, ok := u.dirs[dir]
+		u.mu.Unlock()
+		if ok && cached.mtime.Equal(info.ModTime()) {
+			return cached, nil
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return dirUsage{}, err
+	}
+	usage := dirUsage{mtime: info.ModTime()}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			usage.subdirs = append(usage.subdirs, filepath.Join(dir, entry.Name()))
+			continue
+		}
+		// A sparse-reserve volume's reservation is bookkeeping, not data
+		if entry.Name() == reserveFileName {
+			continue
+		}
+		// Only files need their size, directories were classified from the entry type alone
+		fi, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return dirUsage{}, err
+		}
+		if fi.Mode().IsRegular() {
+			usage.files += fi.Size()
+		}
+	}
+
+	u.mu.Lock()
+	u.dirs[dir] = usage
+	u.mu.Unlock()
+	return usage, nil
+}
+
+// forget drops everything cached under root, e.g. once the volume is gone
+func (u *usageCalculator) forget(root string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.fullScans, root)
+	for dir := range u.dirs {
+		if dir == root || strings.HasPrefix(dir, root+string(os.PathSeparator)) {
+			delete(u.dirs, dir)
+		}
+	}
+}
+
+// scanUsage measures every volume of ours under the base path and replaces the usage metrics
+func (p *customProvisioner) scanUsage(ctx context.Context, calc *usageCalculator, seen map[string]bool) error {
+	release, err := p.scans.acquire(ctx, "usage scan")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	used := map[string]int64{}
+	current := map[string]bool{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		path, ok := volumeSourcePath(pv)
+		if !ok || pv.Annotations[annProvisionedBy] != provisionerName || !volumeUnderBase(path, p.config.basePath, p.config.realBasePath) {
+			continue
+		}
+		size, err := calc.size(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			klog.Warningf("Failed to measure volume %s at %s: %v", pv.Name, path, err)
+			continue
+		}
+		used[pv.Name] = size
+		current[path] = true
+	}
+
+	for path := range seen {
+		if !current[path] {
+			calc.forget(path)
+			delete(seen, path)
+		}
+	}
+	for path := range current {
+		seen[path] = true
+	}
+
+	volumeUsedBytes.Reset()
+	for name, size := range used {
+		volumeUsedBytes.WithLabelValues(name).Set(float64(size))
+	}
+	return nil
+}
+
+// runUsageScanner measures the volumes every interval until ctx is cancelled
+func (p *customProvisioner) runUsageScanner(ctx context.Context, interval time.Duration, workers int) {
+	calc := newUsageCalculator(workers)
+	seen := map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.scanUsage(ctx, calc, seen); err != nil && ctx.Err() == nil {
+			klog.Errorf("Usage scan failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
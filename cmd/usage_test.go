@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeUsageTree fills a volume with dirs directories of files small files each, returning the bytes written
+func writeUsageTree(tb testing.TB, root string, dirs, files int) int64 {
+	tb.Helper()
+	var total int64
+	for d := 0; d < dirs; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir-%d", d/10), fmt.Sprintf("dir-%d", d))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for f := 0; f < files; f++ {
+			content := strings.Repeat("x", f+1)
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d", f)), []byte(content), 0644); err != nil {
+				tb.Fatal(err)
+			}
+			total += int64(len(content))
+		}
+	}
+	return total
+}
+
+// walkSize is the naive usage walk the calculator replaced, one Lstat per entry and no cache
+func walkSize(root string) (int64, error) {
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+func TestUsageCalculatorSize(t *testing.T) {
+	root := t.TempDir()
+	want := writeUsageTree(t, root, 30, 20)
+	// The reservation of a sparse-reserve volume isn't counted
+	if err := os.WriteFile(filepath.Join(root, reserveFileName), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u := newUsageCalculator(4)
+	for _, scan := range []string{"full", "cached"} {
+		got, err := u.size(context.Background(), root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s scan = %d bytes, want %d", scan, got, want)
+		}
+	}
+
+	// New files change their directory's mtime, the cached scan picks them up
+	dir := filepath.Join(root, "dir-0", "dir-0")
+	if err := os.WriteFile(filepath.Join(dir, "new"), []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := u.size(context.Background(), root); err != nil || got != want+5 {
+		t.Errorf("scan after adding a file = %d, %v, want %d", got, err, want+5)
+	}
+}
+
+const (
+	benchmarkUsageDirs  = 100
+	benchmarkUsageFiles = 100
+)
+
+func BenchmarkUsageFilepathWalk(b *testing.B) {
+	root := b.TempDir()
+	want := writeUsageTree(b, root, benchmarkUsageDirs, benchmarkUsageFiles)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got, err := walkSize(root); err != nil || got != want {
+			b.Fatalf("walkSize = %d, %v, want %d", got, err, want)
+		}
+	}
+}
+
+func BenchmarkUsageCalculatorCold(b *testing.B) {
+	root := b.TempDir()
+	want := writeUsageTree(b, root, benchmarkUsageDirs, benchmarkUsageFiles)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got, err := newUsageCalculator(4).size(context.Background(), root); err != nil || got != want {
+			b.Fatalf("size = %d, %v, want %d", got, err, want)
+		}
+	}
+}
+
+func BenchmarkUsageCalculatorCached(b *testing.B) {
+	root := b.TempDir()
+	want := writeUsageTree(b, root, benchmarkUsageDirs, benchmarkUsageFiles)
+	u := newUsageCalculator(4)
+	if _, err := u.size(context.Background(), root); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got, err := u.size(context.Background(), root); err != nil || got != want {
+			b.Fatalf("size = %d, %v, want %d", got, err, want)
+		}
+	}
+}
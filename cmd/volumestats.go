@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+// volumeSizeBuckets go from 1Mi to 1Ti in steps of 4x
+var volumeSizeBuckets = prometheus.ExponentialBuckets(1<<20, 4, 11)
+
+var (
+	volumeSizeDesc = prometheus.NewDesc("provisioner_volume_size_bytes",
+		"Capacity of the volumes we provisioned, by StorageClass, as of the last inventory.", []string{"storageclass"}, nil)
+	volumeCountDesc = prometheus.NewDesc("provisioner_volume_count",
+		"Number of volumes we provisioned, by StorageClass, as of the last inventory.", []string{"storageclass"}, nil)
+)
+
+// volumeStatsCollector exposes the latest volume inventory. Sizes are a snapshot rather than observations,
+// so the histogram is rebuilt from scratch on every scrape instead of accumulating.
+type volumeStatsCollector struct {
+	mu    sync.Mutex
+	sizes map[string][]int64
+}
+
+var volumeStats = &volumeStatsCollector{sizes: map[string][]int64{}}
+
+func (c *volumeStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumeSizeDesc
+	ch <- volumeCountDesc
+}
+
+func (c *volumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for class, sizes := range c.sizes {
+		buckets := make(map[float64]uint64, len(volumeSizeBuckets))
+		var sum float64
+		for _, size := range sizes {
+			sum += float64(size)
+			for _, bound := range volumeSizeBuckets {
+				if float64(size) <= bound {
+					buckets[bound]++
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(volumeSizeDesc, uint64(len(sizes)), sum, buckets, class)
+		ch <- prometheus.MustNewConstMetric(volumeCountDesc, prometheus.GaugeValue, float64(len(sizes)), class)
+	}
+}
+
+func (c *volumeStatsCollector) set(sizes map[string][]int64) {
+	c.mu.Lock()
+	c.sizes = sizes
+	c.mu.Unlock()
+}
+
+// updateVolumeStats lists the PVs we provisioned and replaces the inventory behind the volume metrics
+func (p *customProvisioner) updateVolumeStats(ctx context.Context) error {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	sizes := map[string][]int64{}
+	for _, pv := range pvs.Items {
+		if pv.Annotations[annProvisionedBy] != provisionerName {
+			continue
+		}
+		capacity := pv.Spec.Capacity.Storage()
+		sizes[pv.Spec.StorageClassName] = append(sizes[pv.Spec.StorageClassName], capacity.Value())
+	}
+	volumeStats.set(sizes)
+	return nil
+}
+
+// runVolumeStats refreshes the volume inventory every interval until ctx is cancelled
+func (p *customProvisioner) runVolumeStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.updateVolumeStats(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("Failed to update volume metrics: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}